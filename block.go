@@ -0,0 +1,134 @@
+package yfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Every block of blocks.glob starts with a header describing its payload.
+// In format v3 a block is laid out as:
+//
+//	[0]      Block type: 0 never written, 1 data, 2 index
+//	[1:4]    Reserved, zero
+//	[4:8]    Payload length (uint32)
+//	[8:12]   CRC32C of the payload
+//	[12:20]  Inode of the file that wrote the block (uint64), 0 if unknown
+//	[20:]    Payload, then zero padding up to the block size
+//
+// Blocks of format v2 only start with the payload length. On an encrypted
+// file system the header, payload and padding are sealed together, so a
+// block holds blockSize - BlockHeaderSize - blockOverhead() payload bytes.
+// Shared blocks keep the inode of the file that wrote them; moving or
+// re-encrypting a block copies its header unchanged.
+
+const (
+	legacyFormatVersion   = 2 // Format read for copying files out of older images
+	legacyBlockHeaderSize = 4 // Payload length at the start of every block of format v2
+)
+
+// ErrFormatVersion is returned when opening a file system whose on-disk
+// format this version cannot use
+var ErrFormatVersion = errors.New("unsupported format version")
+
+// blockType identifies what a block holds
+type blockType uint8
+
+const (
+	blockUnwritten blockType = iota // Never written, all zero
+	blockData                       // File data
+	blockIndex                      // Serialized IndexBlock
+)
+
+// checkFormatVersion rejects file systems of a format this version cannot
+// open. Images of format v2 can only be opened read-only, which is how
+// Migrate reads them.
+func (yfs *YFS) checkFormatVersion() error {
+	switch version := yfs.header.Version; {
+	case version == FormatVersion:
+		return nil
+	case version == legacyFormatVersion && yfs.opts.ReadOnly:
+		return nil
+	case version == legacyFormatVersion:
+		return fmt.Errorf("%w: file system uses format v%d, which can only be opened read-only; upgrade it with Migrate", ErrFormatVersion, version)
+	default:
+		return fmt.Errorf("%w: file system uses format v%d, this version supports v%d", ErrFormatVersion, version, FormatVersion)
+	}
+}
+
+// blockHeaderSize returns the size of the header at the start of every block
+func (yfs *YFS) blockHeaderSize() int {
+	if yfs.header.Version < FormatVersion {
+		return legacyBlockHeaderSize
+	}
+	return BlockHeaderSize
+}
+
+// newInode returns an inode number no file has been given yet
+func (yfs *YFS) newInode() uint64 {
+	yfs.header.NextInode++
+	return yfs.header.NextInode
+}
+
+// frameBlock prefixes a payload with its block header
+func frameBlock(kind blockType, owner uint64, payload []byte) []byte {
+	framed := make([]byte, BlockHeaderSize+len(payload))
+	framed[0] = byte(kind)
+	binary.LittleEndian.PutUint32(framed[4:8], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(framed[8:12], crc32.Checksum(payload, journalCRCTable))
+	binary.LittleEndian.PutUint64(framed[12:20], owner)
+	copy(framed[BlockHeaderSize:], payload)
+	return framed
+}
+
+// frameLegacyBlock prefixes a payload with a block header of format v2
+func frameLegacyBlock(payload []byte) []byte {
+	framed := make([]byte, legacyBlockHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(framed, uint32(len(payload)))
+	copy(framed[legacyBlockHeaderSize:], payload)
+	return framed
+}
+
+// trimBlock drops the padding after the payload of a plain block
+func (yfs *YFS) trimBlock(blockData []byte) ([]byte, error) {
+	headerSize := yfs.blockHeaderSize()
+	if len(blockData) < headerSize {
+		return nil, fmt.Errorf("block shorter than its header: %d bytes", len(blockData))
+	}
+
+	length := binary.LittleEndian.Uint32(blockData[0:4])
+	if headerSize == BlockHeaderSize {
+		length = binary.LittleEndian.Uint32(blockData[4:8])
+	}
+
+	if uint64(length) > uint64(len(blockData)-headerSize) {
+		return nil, fmt.Errorf("invalid data length: %d bytes, max: %d bytes", length, len(blockData)-headerSize)
+	}
+
+	return blockData[:headerSize+int(length)], nil
+}
+
+// parseBlock checks the header of a trimmed block against its payload and
+// returns both. Blocks of format v2 report blockData and no owner.
+func (yfs *YFS) parseBlock(framed []byte) (blockType, uint64, []byte, error) {
+	if yfs.blockHeaderSize() == legacyBlockHeaderSize {
+		return blockData, 0, framed[legacyBlockHeaderSize:], nil
+	}
+
+	kind := blockType(framed[0])
+	owner := binary.LittleEndian.Uint64(framed[12:20])
+	payload := framed[BlockHeaderSize:]
+
+	if kind > blockIndex {
+		return 0, 0, nil, fmt.Errorf("unknown block type %d", kind)
+	}
+	if kind == blockUnwritten && len(payload) > 0 {
+		return 0, 0, nil, fmt.Errorf("unwritten block with %d bytes of payload", len(payload))
+	}
+	if crc32.Checksum(payload, journalCRCTable) != binary.LittleEndian.Uint32(framed[8:12]) {
+		return 0, 0, nil, fmt.Errorf("payload checksum mismatch")
+	}
+
+	return kind, owner, payload, nil
+}
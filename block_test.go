@@ -0,0 +1,120 @@
+package yfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/baseline-v2 was written by the first version of YFS: format v2
+// with linked index chains, no journal and a single root copy
+
+// copyBaselineImage copies the baseline image into a new directory
+func copyBaselineImage(t *testing.T) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "image")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"root.yfs", "bitmap.yfs", "blocks.glob"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "baseline-v2", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// expectBaselineFiles fails the test unless fs holds the files of the baseline image
+func expectBaselineFiles(t *testing.T, fs *YFS) {
+	t.Helper()
+
+	var big bytes.Buffer
+	for i := 0; big.Len() < 3500; i++ {
+		fmt.Fprintf(&big, "line %05d of a baseline file\n", i)
+	}
+
+	expectFile(t, fs, "/hello.txt", []byte("hello from the baseline format\n"))
+	expectFile(t, fs, "/docs/big.txt", big.Bytes())
+	if _, _, isDir, err := fs.findEntry("/docs/empty"); err != nil || !isDir {
+		t.Fatalf("empty directory missing: %v", err)
+	}
+}
+
+func TestBaselineImageReadOnly(t *testing.T) {
+	dir := copyBaselineImage(t)
+
+	if _, err := NewWithOptions(dir, Options{}); !errors.Is(err, ErrFormatVersion) {
+		t.Fatalf("read-write open of a v2 image returned %v, want ErrFormatVersion", err)
+	}
+
+	fs := openTestFS(t, dir, Options{ReadOnly: true})
+	defer fs.Close()
+	expectBaselineFiles(t, fs)
+	if err := fs.WriteFile("/new", []byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("write to a v2 image returned %v, want ErrReadOnly", err)
+	}
+}
+
+func TestUnknownFormatVersion(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	fs.mutex.Lock()
+	fs.header.Version = FormatVersion + 1
+	fs.mutex.Unlock()
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []Options{{}, {ReadOnly: true}} {
+		if _, err := NewWithOptions(dir, opts); !errors.Is(err, ErrFormatVersion) {
+			t.Fatalf("opening a newer format with %+v returned %v, want ErrFormatVersion", opts, err)
+		}
+	}
+}
+
+func TestCorruptBlockHeader(t *testing.T) {
+	damage := map[string]func(block []byte){
+		"payload": func(block []byte) { block[BlockHeaderSize+1] ^= 0xff },
+		"type":    func(block []byte) { block[0] = 7 },
+		"length":  func(block []byte) { block[7] = 0xff },
+	}
+	for name, corrupt := range damage {
+		t.Run(name, func(t *testing.T) {
+			// Without data checksums the block header is all that notices the damage
+			opts := Options{DataChecksums: DataChecksumNone}
+			fs, dir := newTestFS(t, opts)
+			if err := fs.WriteFile("/a", testData(2*fs.payloadSize(), 1)); err != nil {
+				t.Fatal(err)
+			}
+			blockID := fileEntry(t, fs, "/a").DirectBlockIds[1]
+			offset := fs.calculateBlockOffset(blockID)
+			if err := fs.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, "blocks.glob")
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			corrupt(data[offset:])
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			fs = openTestFS(t, dir, opts)
+			defer fs.Close()
+			if _, err := fs.ReadFile("/a"); err == nil {
+				t.Fatal("a block with a corrupt header was read")
+			}
+		})
+	}
+}
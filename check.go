@@ -0,0 +1,556 @@
+package yfs
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const LostAndFound = "lost+found" // Directory Check.Repair moves broken files to
+
+// CheckOptions configures Check
+type CheckOptions struct {
+	Repair bool // Free leaked blocks, fix the bitmap and reference counts, and move broken files to /lost+found
+}
+
+// ProblemKind classifies a problem Check found in a file
+type ProblemKind int
+
+const (
+	ProblemIndex       ProblemKind = iota // Index that cannot be read or references blocks out of range
+	ProblemChecksum                       // Data block that cannot be read or fails its checksum
+	ProblemCrossLinked                    // Block also claimed by another file without being shared
+	ProblemSize                           // Size that disagrees with the inline data or the chunk table
+	ProblemBlockCount                     // Block counts that disagree with the index
+	ProblemMetadata                       // Metadata failing its checksum
+)
+
+// String returns the name of the problem kind
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemIndex:
+		return "index"
+	case ProblemChecksum:
+		return "checksum"
+	case ProblemCrossLinked:
+		return "cross-linked"
+	case ProblemSize:
+		return "size"
+	case ProblemBlockCount:
+		return "block count"
+	case ProblemMetadata:
+		return "metadata"
+	default:
+		return fmt.Sprintf("ProblemKind(%d)", int(k))
+	}
+}
+
+// CheckProblem describes a problem found in a file or directory
+type CheckProblem struct {
+	Path string // Snapshot paths are prefixed with @name
+	Kind ProblemKind
+	Err  error
+}
+
+// Error describes the problem
+func (p CheckProblem) Error() string {
+	return fmt.Sprintf("%s: %s: %v", p.Path, p.Kind, p.Err)
+}
+
+// CheckReport lists what Check found and what Repair changed
+type CheckReport struct {
+	Files           int            // Files checked, in the live tree and every snapshot
+	ReachableBlocks int            // Distinct blocks referenced by the checked files
+	LeakedBlocks    []uint32       // Marked used in bitmap.yfs but referenced by no file
+	UnmarkedBlocks  []uint32       // Referenced by a file but marked free in bitmap.yfs
+	CrossLinked     []uint32       // Referenced more often than their reference count allows
+	OverCounted     []uint32       // Referenced less often than their reference count, so never freed
+	Problems        []CheckProblem // Problems found in files and directories
+
+	FreedBlocks int      // Leaked blocks freed by Repair
+	Quarantined []string // Files Repair moved to /lost+found, by their new path
+}
+
+// Clean reports whether Check found nothing wrong
+func (r *CheckReport) Clean() bool {
+	return len(r.LeakedBlocks) == 0 && len(r.UnmarkedBlocks) == 0 && len(r.CrossLinked) == 0 &&
+		len(r.OverCounted) == 0 && len(r.Problems) == 0
+}
+
+// blockClaim records the references to a block found by Check
+type blockClaim struct {
+	refs  uint32   // References found in file indexes
+	index bool     // Referenced as an index block
+	data  bool     // Referenced as a data block
+	paths []string // Files referencing the block
+}
+
+// checkedFile is a file Check walked
+type checkedFile struct {
+	path   string
+	file   *FileEntry
+	live   bool           // Whether the file is in the live tree
+	broken bool           // Whether the file is quarantined by Repair
+	counts [2]uint32      // Data and index blocks found in the index
+	claims map[uint32]int // References per block, to find blocks claimed twice by one file
+}
+
+// checker holds the state of one Check run
+type checker struct {
+	yfs    *YFS
+	report *CheckReport
+	files  []*checkedFile
+	claims map[uint32]*blockClaim
+}
+
+// Check walks the index of every file in the live tree and in every
+// snapshot, reading each index and data block, and cross-checks the blocks
+// it reaches against bitmap.yfs and the reference counts. Unlike
+// VerifyIntegrity it does not stop at the first problem.
+//
+// With opts.Repair, leaked blocks are freed, blocks in use are marked used,
+// reference counts are set to the references found and block counts are
+// corrected. Live files with a broken index, a bad data block, a
+// cross-linked block or an inconsistent size are moved to /lost+found,
+// where they can be inspected and deleted; broken snapshot files are only
+// reported.
+func (yfs *YFS) Check(opts CheckOptions) (*CheckReport, error) {
+	if opts.Repair {
+		if err := yfs.checkWritable(); err != nil {
+			return nil, err
+		}
+
+		yfs.mutex.Lock()
+		defer yfs.mutex.Unlock()
+	} else {
+		yfs.mutex.RLock()
+		defer yfs.mutex.RUnlock()
+	}
+
+	c := &checker{
+		yfs:    yfs,
+		report: &CheckReport{},
+		claims: make(map[uint32]*blockClaim),
+	}
+
+	c.checkDirectory(yfs.header.Root, "", true)
+
+	names := make([]string, 0, len(yfs.header.Snapshots))
+	for name := range yfs.header.Snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c.checkDirectory(yfs.header.Snapshots[name].Root, "@"+name, false)
+	}
+
+	c.crossCheck()
+
+	if !opts.Repair {
+		return c.report, nil
+	}
+
+	if err := c.repair(); err != nil {
+		return c.report, err
+	}
+
+	// Save changes
+	return c.report, yfs.commit()
+}
+
+// problem records a problem found in a file or directory
+func (c *checker) problem(path string, kind ProblemKind, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, CheckProblem{Path: path, Kind: kind, Err: fmt.Errorf(format, args...)})
+}
+
+// checkDirectory checks a directory and everything below it
+func (c *checker) checkDirectory(dir *DirectoryEntry, dirPath string, live bool) {
+	if !c.yfs.verifyMetadataChecksum(dir.Metadata) {
+		c.problem(dirPath+"/", ProblemMetadata, "directory metadata checksum mismatch")
+	}
+
+	names := make([]string, 0, len(dir.Files))
+	for name := range dir.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c.checkFile(dir.Files[name], dirPath+"/"+name, live)
+	}
+
+	names = names[:0]
+	for name := range dir.Directories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c.checkDirectory(dir.Directories[name], dirPath+"/"+name, live)
+	}
+}
+
+// checkFile walks the index of a file, reads its blocks and checks its
+// size and block counts
+func (c *checker) checkFile(file *FileEntry, filePath string, live bool) {
+	c.report.Files++
+	f := &checkedFile{path: filePath, file: file, live: live, claims: make(map[uint32]int)}
+	c.files = append(c.files, f)
+
+	if !c.yfs.verifyMetadataChecksum(file.Metadata) {
+		c.problem(filePath, ProblemMetadata, "file metadata checksum mismatch")
+	}
+
+	if isInline(file) {
+		if int64(len(file.InlineData)) != file.Size {
+			c.brokenFile(f, ProblemSize, "%d bytes of inline data for size %d", len(file.InlineData), file.Size)
+		}
+		if hasBlocks(file) {
+			c.brokenFile(f, ProblemSize, "inline file also references blocks")
+		}
+	}
+
+	if file.FirstIndexBlockId != NullBlockID {
+		c.walkChain(f)
+	} else {
+		c.walkTree(f)
+	}
+
+	if file.Compression != 0 {
+		c.checkChunks(f)
+	}
+
+	if f.counts[0] != file.DataBlockCount || f.counts[1] != file.IndexBlockCount {
+		c.problem(filePath, ProblemBlockCount, "index holds %d data and %d index blocks, entry says %d and %d",
+			f.counts[0], f.counts[1], file.DataBlockCount, file.IndexBlockCount)
+	}
+}
+
+// brokenFile records a problem that gets a file quarantined by Repair
+func (c *checker) brokenFile(f *checkedFile, kind ProblemKind, format string, args ...any) {
+	f.broken = true
+	c.problem(f.path, kind, format, args...)
+}
+
+// claim records a reference from a file to a block and reports whether the
+// block is in range
+func (c *checker) claim(f *checkedFile, blockID uint32, index bool) bool {
+	if blockID == NullBlockID || uint64(blockID) > c.yfs.bitmap.totalBlocks {
+		c.brokenFile(f, ProblemIndex, "block %d out of range", blockID)
+		return false
+	}
+
+	claim, exists := c.claims[blockID]
+	if !exists {
+		claim = &blockClaim{}
+		c.claims[blockID] = claim
+	}
+
+	claim.refs++
+	if index {
+		claim.index = true
+		f.counts[1]++
+	} else {
+		claim.data = true
+		f.counts[0]++
+	}
+
+	if f.claims[blockID] == 0 {
+		claim.paths = append(claim.paths, f.path)
+	}
+	f.claims[blockID]++
+	return true
+}
+
+// walkTree walks the direct blocks and indirect trees of a file
+func (c *checker) walkTree(f *checkedFile) {
+	file := f.file
+	var data []checkedBlock
+
+	for i, blockID := range file.DirectBlockIds {
+		if blockID != NullBlockID && c.claim(f, blockID, false) {
+			data = append(data, checkedBlock{n: int64(i), blockID: blockID, sum: c.yfs.checksumAt(file.DirectBlockChecksums, i)})
+		}
+	}
+
+	if len(file.IndirectBlockIds) > MaxIndirectLevels {
+		c.brokenFile(f, ProblemIndex, "too many indirect index levels: %d", len(file.IndirectBlockIds))
+		return
+	}
+
+	var walk func(blockID uint32, depth int, base, span int64)
+	walk = func(blockID uint32, depth int, base, span int64) {
+		if !c.claim(f, blockID, true) {
+			return
+		}
+		if f.claims[blockID] > 1 {
+			c.brokenFile(f, ProblemIndex, "index block %d referenced more than once", blockID)
+			return
+		}
+
+		indexBlock, err := c.yfs.readIndexBlock(blockID)
+		if err != nil {
+			c.brokenFile(f, ProblemIndex, "failed to read index block %d: %v", blockID, err)
+			return
+		}
+
+		entries := expandIndexBlock(indexBlock)
+		if len(entries) > c.yfs.indexCapacity() {
+			c.brokenFile(f, ProblemIndex, "index block %d holds %d references, max: %d", blockID, len(entries), c.yfs.indexCapacity())
+			return
+		}
+
+		childSpan := span / int64(c.yfs.indexCapacity())
+		for i, child := range entries {
+			switch {
+			case child == NullBlockID:
+			case depth > 1:
+				walk(child, depth-1, base+int64(i)*childSpan, childSpan)
+			case c.claim(f, child, false):
+				data = append(data, checkedBlock{n: base + int64(i), blockID: child, sum: c.yfs.checksumAt(indexBlock.DataChecksums, i)})
+			}
+		}
+	}
+
+	capacity := int64(c.yfs.indexCapacity())
+	base, span := int64(NumDirectBlocks), int64(1)
+	for level, blockID := range file.IndirectBlockIds {
+		span *= capacity
+		if blockID != NullBlockID {
+			walk(blockID, level+1, base, span)
+		}
+		base += span
+	}
+
+	c.checkData(f, data)
+}
+
+// walkChain walks the legacy index chain of a file
+func (c *checker) walkChain(f *checkedFile) {
+	var data []checkedBlock
+
+	for blockID := f.file.FirstIndexBlockId; blockID != NullBlockID; {
+		if !c.claim(f, blockID, true) {
+			break
+		}
+		if f.claims[blockID] > 1 {
+			c.brokenFile(f, ProblemIndex, "circular reference at index block %d", blockID)
+			break
+		}
+
+		indexBlock, err := c.yfs.readIndexBlock(blockID)
+		if err != nil {
+			c.brokenFile(f, ProblemIndex, "failed to read index block %d: %v", blockID, err)
+			break
+		}
+
+		for _, child := range expandIndexBlock(indexBlock) {
+			if c.claim(f, child, false) {
+				data = append(data, checkedBlock{n: int64(len(data)), blockID: child})
+			}
+		}
+		blockID = indexBlock.NextIndexBlockId
+	}
+
+	c.checkData(f, data)
+}
+
+// checkedBlock is a data block of a file along with its recorded checksum
+type checkedBlock struct {
+	n       int64
+	blockID uint32
+	sum     []byte
+}
+
+// checkData reads the data blocks of a file, runs of contiguous blocks at
+// once, and verifies the header of each and its recorded checksum
+func (c *checker) checkData(f *checkedFile, blocks []checkedBlock) {
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].n < blocks[j].n })
+
+	for i := 0; i < len(blocks); {
+		count := 1
+		for i+count < len(blocks) && count < MaxBlocksPerRead && blocks[i+count].blockID == blocks[i].blockID+uint32(count) {
+			count++
+		}
+
+		// A run that cannot be read as a whole is read again block by block
+		run, runErr := c.yfs.readFramedRun(blocks[i].blockID, uint32(count))
+		for j, block := range blocks[i : i+count] {
+			offset := block.n * int64(c.yfs.payloadSize())
+
+			framed := []byte(nil)
+			if runErr == nil {
+				framed = run[j]
+			} else if read, err := c.yfs.readFramedBlock(block.blockID); err != nil {
+				c.brokenFile(f, ProblemChecksum, "failed to read data block %d at offset %d: %v", block.blockID, offset, err)
+				continue
+			} else {
+				framed = read
+			}
+
+			kind, _, payload, parseErr := c.yfs.parseBlock(framed)
+			switch {
+			case parseErr != nil:
+				c.brokenFile(f, ProblemChecksum, "data block %d at offset %d: %v", block.blockID, offset, parseErr)
+			case kind != blockData:
+				c.brokenFile(f, ProblemChecksum, "block %d at offset %d is not a data block (type %d)", block.blockID, offset, kind)
+			case block.sum != nil && !bytes.Equal(c.yfs.dataChecksum.sum(payload), block.sum):
+				c.brokenFile(f, ProblemChecksum, "data checksum mismatch at offset %d (block %d)", offset, block.blockID)
+			}
+		}
+
+		i += count
+	}
+}
+
+// checkChunks checks the chunk table of a compressed file against its size
+func (c *checker) checkChunks(f *checkedFile) {
+	file := f.file
+	chunkBlocks, err := c.yfs.chunkBlocks(file)
+	if err != nil {
+		c.brokenFile(f, ProblemSize, "%v", err)
+		return
+	}
+
+	chunkSize := int64(file.CompressionChunkSize)
+	if chunks := (file.Size + chunkSize - 1) / chunkSize; int64(len(file.ChunkSizes)) > chunks {
+		c.brokenFile(f, ProblemSize, "%d chunks for size %d, at most %d expected", len(file.ChunkSizes), file.Size, chunks)
+	}
+
+	stored := int64(0)
+	for i, size := range file.ChunkSizes {
+		if int64(size) > chunkBlocks*int64(c.yfs.payloadSize()) {
+			c.brokenFile(f, ProblemSize, "chunk %d stores %d bytes, more than fit in its blocks", i, size)
+		}
+		stored += int64(size)
+	}
+
+	if stored != file.StoredSize {
+		c.brokenFile(f, ProblemSize, "chunks store %d bytes, entry says %d", stored, file.StoredSize)
+	}
+}
+
+// crossCheck compares the references found with the reference counts and
+// the bitmap
+func (c *checker) crossCheck() {
+	yfs := c.yfs
+	report := c.report
+	report.ReachableBlocks = len(c.claims)
+
+	yfs.bitmap.mutex.RLock()
+	defer yfs.bitmap.mutex.RUnlock()
+
+	for pos := uint64(0); pos < yfs.bitmap.totalBlocks; pos++ {
+		blockID := uint32(pos) + 1
+		claim := c.claims[blockID]
+		used := !yfs.isBlockFree(pos)
+
+		switch {
+		case claim == nil && used:
+			report.LeakedBlocks = append(report.LeakedBlocks, blockID)
+			continue
+		case claim == nil:
+			if yfs.header.BlockRefs[blockID] > 0 {
+				report.OverCounted = append(report.OverCounted, blockID)
+			}
+			continue
+		case !used:
+			report.UnmarkedBlocks = append(report.UnmarkedBlocks, blockID)
+		}
+
+		refs := yfs.blockRefs(blockID)
+		switch {
+		case claim.refs > refs || (claim.index && claim.data):
+			report.CrossLinked = append(report.CrossLinked, blockID)
+			for _, f := range c.files {
+				if f.claims[blockID] > 0 {
+					c.brokenFile(f, ProblemCrossLinked, "block %d is claimed by %s", blockID, strings.Join(claim.paths, ", "))
+				}
+			}
+		case claim.refs < refs:
+			report.OverCounted = append(report.OverCounted, blockID)
+		}
+	}
+}
+
+// repair frees leaked blocks, marks reachable blocks used, sets reference
+// counts to the references found and moves broken live files to /lost+found
+func (c *checker) repair() error {
+	yfs := c.yfs
+	report := c.report
+
+	yfs.bitmap.mutex.Lock()
+	for _, blockID := range report.UnmarkedBlocks {
+		yfs.markBlockUsed(uint64(blockID - 1))
+	}
+	yfs.bitmap.dirty = true
+	yfs.bitmap.mutex.Unlock()
+
+	for _, blockID := range append(append([]uint32(nil), report.CrossLinked...), report.OverCounted...) {
+		if refs := c.claimedRefs(blockID); refs > 1 {
+			if yfs.header.BlockRefs == nil {
+				yfs.header.BlockRefs = make(map[uint32]uint32)
+			}
+			yfs.header.BlockRefs[blockID] = refs
+		} else {
+			delete(yfs.header.BlockRefs, blockID)
+		}
+	}
+
+	for _, blockID := range report.LeakedBlocks {
+		delete(yfs.header.BlockRefs, blockID)
+	}
+	if err := yfs.freeBlocks(report.LeakedBlocks); err != nil {
+		return err
+	}
+	report.FreedBlocks = len(report.LeakedBlocks)
+
+	for _, f := range c.files {
+		if !f.broken {
+			f.file.DataBlockCount, f.file.IndexBlockCount = f.counts[0], f.counts[1]
+		}
+
+		lost := strings.HasPrefix(f.path, "/"+LostAndFound+"/")
+		if !f.broken || !f.live || lost {
+			continue
+		}
+
+		quarantined, err := yfs.quarantineUnsafe(f.path)
+		if err != nil {
+			return fmt.Errorf("failed to move %s to /%s: %w", f.path, LostAndFound, err)
+		}
+		report.Quarantined = append(report.Quarantined, quarantined)
+	}
+
+	return nil
+}
+
+// claimedRefs returns the references Check found to a block
+func (c *checker) claimedRefs(blockID uint32) uint32 {
+	if claim, exists := c.claims[blockID]; exists {
+		return claim.refs
+	}
+	return 0
+}
+
+// quarantineUnsafe moves a file to /lost+found under a name made from its
+// path and returns the new path
+func (yfs *YFS) quarantineUnsafe(filePath string) (string, error) {
+	name := strings.ReplaceAll(strings.Trim(filePath, "/"), "/", "_")
+
+	target := path.Join("/", LostAndFound, name)
+	for i := 1; ; i++ {
+		if _, file, isDir, err := yfs.findEntryUnsafe(target); err != nil || (!isDir && file == nil) {
+			break
+		}
+		target = path.Join("/", LostAndFound, fmt.Sprintf("%s.%d", name, i))
+	}
+
+	if err := yfs.renameUnsafe(filePath, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
@@ -0,0 +1,169 @@
+package yfs
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// patchBlocksFile overwrites bytes of a block in blocks.glob behind the file
+// system's back, starting off bytes into the block
+func patchBlocksFile(t *testing.T, fs *YFS, dir string, blockID uint32, off int64, data []byte) {
+	t.Helper()
+
+	file, err := os.OpenFile(filepath.Join(dir, "blocks.glob"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(data, fs.calculateBlockOffset(blockID)+off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectCheckClean fails the test unless Check finds nothing wrong
+func expectCheckClean(t *testing.T, fs *YFS) {
+	t.Helper()
+
+	report, err := fs.Check(CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Fatalf("check found problems: %v, leaked %v, unmarked %v, cross-linked %v, over-counted %v",
+			report.Problems, report.LeakedBlocks, report.UnmarkedBlocks, report.CrossLinked, report.OverCounted)
+	}
+}
+
+func TestCheckClean(t *testing.T) {
+	fs, _ := newTestFS(t, Options{})
+	defer fs.Close()
+
+	payload := fs.payloadSize()
+	if err := fs.CreateDirectory("/d"); err != nil {
+		t.Fatal(err)
+	}
+	for i, path := range []string{"/d/a", "/d/b"} {
+		if err := fs.WriteFile(path, testData(40*payload, int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.WriteFile("/small", []byte("inline")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CopyFile("/d/a", "/d/clone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteAt("/d/a", int64(payload), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fs.Check(CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Fatalf("clean file system reported problems: %+v", report)
+	}
+	if report.Files != 7 {
+		t.Fatalf("checked %d files, want 7", report.Files)
+	}
+}
+
+func TestCheckReportsCorruptBlock(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	payload := fs.payloadSize()
+	if err := fs.WriteFile("/a", testData(3*payload, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := fileEntry(t, fs, "/a").DirectBlockIds
+	if len(blocks) != 3 || blocks[1] != blocks[0]+1 || blocks[2] != blocks[1]+1 {
+		t.Fatalf("expected 3 contiguous data blocks, got %v", blocks)
+	}
+	fs = reopenTestFS(t, fs, dir, Options{})
+	defer fs.Close()
+
+	// A payload length past the end of the block fails the read of the whole run
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(fs.blockSize))
+	patchBlocksFile(t, fs, dir, blocks[1], 4, length)
+	patchBlocksFile(t, fs, dir, blocks[2], BlockHeaderSize, []byte{0xff})
+
+	report, err := fs.Check(CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var corrupt int
+	for _, problem := range report.Problems {
+		if problem.Path != "/a" || problem.Kind != ProblemChecksum {
+			t.Fatalf("unexpected problem: %v", problem)
+		}
+		corrupt++
+	}
+	if corrupt != 2 {
+		t.Fatalf("reported %d corrupt blocks, want 2: %v", corrupt, report.Problems)
+	}
+}
+
+func TestCheckRepair(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	payload := fs.payloadSize()
+	good := testData(20*payload, 1)
+	if err := fs.WriteFile("/good", good); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/bad", testData(20*payload, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leak one block and mark a block of /good free
+	unmarked := fileEntry(t, fs, "/good").DirectBlockIds[3]
+	fs.mutex.Lock()
+	leaked, err := fs.allocateBlocks(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.freeBlocks([]uint32{unmarked})
+	if err := fs.commit(); err != nil {
+		t.Fatal(err)
+	}
+	fs.mutex.Unlock()
+
+	patchBlocksFile(t, fs, dir, fileEntry(t, fs, "/bad").DirectBlockIds[0], BlockHeaderSize, []byte{0xff})
+
+	report, err := fs.Check(CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.LeakedBlocks) != 1 || report.LeakedBlocks[0] != leaked[0] || report.FreedBlocks != 1 {
+		t.Fatalf("leaked %v, freed %d, want block %d freed", report.LeakedBlocks, report.FreedBlocks, leaked[0])
+	}
+	if len(report.UnmarkedBlocks) != 1 || report.UnmarkedBlocks[0] != unmarked {
+		t.Fatalf("unmarked %v, want [%d]", report.UnmarkedBlocks, unmarked)
+	}
+	if len(report.Quarantined) != 1 || report.Quarantined[0] != "/lost+found/bad" {
+		t.Fatalf("quarantined %v, want [/lost+found/bad]", report.Quarantined)
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	defer fs.Close()
+
+	report, err = fs.Check(CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.LeakedBlocks)+len(report.UnmarkedBlocks)+len(report.CrossLinked)+len(report.OverCounted) != 0 {
+		t.Fatalf("blocks inconsistent after repair: %+v", report)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Path != "/lost+found/bad" {
+		t.Fatalf("expected only the quarantined file to be reported, got %v", report.Problems)
+	}
+	expectFile(t, fs, "/good", good)
+}
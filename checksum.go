@@ -0,0 +1,247 @@
+package yfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+)
+
+// DataChecksumMode selects the checksum kept for every data block
+type DataChecksumMode int
+
+const (
+	DataChecksumDefault DataChecksumMode = iota // CRC32C for new file systems (none with ChecksumNone), the stored algorithm for existing ones
+	DataChecksumNone                            // No data checksums
+	DataChecksumCRC32C                          // 4-byte CRC32C (Castagnoli)
+	DataChecksumXXH64                           // 8-byte XXH64
+	DataChecksumSHA256                          // 32-byte SHA-256
+)
+
+// String returns the name of the data checksum mode
+func (m DataChecksumMode) String() string {
+	switch m {
+	case DataChecksumDefault:
+		return "default"
+	case DataChecksumNone:
+		return "none"
+	case DataChecksumCRC32C:
+		return "crc32c"
+	case DataChecksumXXH64:
+		return "xxh64"
+	case DataChecksumSHA256:
+		return "sha256"
+	default:
+		return fmt.Sprintf("DataChecksumMode(%d)", int(m))
+	}
+}
+
+// headerValue returns the FileSystemHeader.data_checksum value for the mode
+func (m DataChecksumMode) headerValue() uint32 {
+	switch m {
+	case DataChecksumCRC32C:
+		return 1
+	case DataChecksumXXH64:
+		return 2
+	case DataChecksumSHA256:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// dataChecksumFromHeader returns the mode stored in a FileSystemHeader
+func dataChecksumFromHeader(value uint32) (DataChecksumMode, error) {
+	switch value {
+	case 0:
+		return DataChecksumNone, nil
+	case 1:
+		return DataChecksumCRC32C, nil
+	case 2:
+		return DataChecksumXXH64, nil
+	case 3:
+		return DataChecksumSHA256, nil
+	default:
+		return DataChecksumNone, fmt.Errorf("unknown data checksum algorithm in header: %d", value)
+	}
+}
+
+// size returns the number of bytes a checksum takes
+func (m DataChecksumMode) size() int {
+	switch m {
+	case DataChecksumCRC32C:
+		return 4
+	case DataChecksumXXH64:
+		return 8
+	case DataChecksumSHA256:
+		return sha256.Size
+	default:
+		return 0
+	}
+}
+
+// sum returns the checksum of a data block payload
+func (m DataChecksumMode) sum(payload []byte) []byte {
+	switch m {
+	case DataChecksumCRC32C:
+		return binary.LittleEndian.AppendUint32(nil, crc32.Checksum(payload, journalCRCTable))
+	case DataChecksumXXH64:
+		return binary.LittleEndian.AppendUint64(nil, xxh64(payload))
+	case DataChecksumSHA256:
+		sum := sha256.Sum256(payload)
+		return sum[:]
+	default:
+		return nil
+	}
+}
+
+// ChecksumError reports a data block whose contents do not match the
+// checksum recorded in the file's index
+type ChecksumError struct {
+	Path    string // File the block belongs to
+	Offset  int64  // File offset of the start of the block
+	BlockID uint32 // Data block that failed verification
+}
+
+// Error describes the corrupted block
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("data checksum mismatch in %s at offset %d (block %d)", e.Path, e.Offset, e.BlockID)
+}
+
+// verifyBlock checks the payload read for logical block n of a file against
+// the checksum recorded for it. Blocks without a checksum pass.
+func (yfs *YFS) verifyBlock(idx *fileIndex, n int64, blockID uint32, payload []byte) error {
+	sum, err := yfs.blockChecksum(idx, n)
+	if err != nil || sum == nil {
+		return err
+	}
+
+	if !bytes.Equal(yfs.dataChecksum.sum(payload), sum) {
+		return &ChecksumError{Offset: n * int64(yfs.payloadSize()), BlockID: blockID}
+	}
+	return nil
+}
+
+// withPath fills in the file path of a ChecksumError
+func withPath(err error, path string) error {
+	var checksumErr *ChecksumError
+	if errors.As(err, &checksumErr) && checksumErr.Path == "" {
+		checksumErr.Path = path
+	}
+	return err
+}
+
+// checksumAt returns the checksum stored for slot i of a packed checksum
+// list, or nil when none was recorded
+func (yfs *YFS) checksumAt(sums []byte, i int) []byte {
+	size := yfs.dataChecksum.size()
+	if size == 0 || (i+1)*size > len(sums) {
+		return nil
+	}
+
+	sum := sums[i*size : (i+1)*size]
+	if bytes.Count(sum, []byte{0}) == size {
+		return nil // Written before checksums were kept, e.g. an upgraded legacy file
+	}
+	return sum
+}
+
+// putChecksum stores a checksum in slot i of a packed checksum list
+func (yfs *YFS) putChecksum(sums []byte, i int, sum []byte) []byte {
+	size := yfs.dataChecksum.size()
+	if len(sums) < (i+1)*size {
+		sums = append(sums, make([]byte, (i+1)*size-len(sums))...)
+	}
+
+	copy(sums[i*size:], sum)
+	return sums
+}
+
+// trimChecksums drops the checksums of slot count and later
+func (yfs *YFS) trimChecksums(sums []byte, count int) []byte {
+	if size := yfs.dataChecksum.size(); len(sums) > count*size {
+		return sums[:count*size]
+	}
+	return sums
+}
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+// xxh64 returns the XXH64 hash of data with seed 0
+func xxh64(data []byte) uint64 {
+	length := uint64(len(data))
+	var h uint64
+
+	if len(data) >= 32 {
+		prime1 := xxhPrime1 // Variables, the lane seeds wrap around
+		v1 := prime1 + xxhPrime2
+		v2 := xxhPrime2
+		v3 := uint64(0)
+		v4 := -prime1
+
+		for len(data) >= 32 {
+			v1 = xxhRound(v1, binary.LittleEndian.Uint64(data[0:8]))
+			v2 = xxhRound(v2, binary.LittleEndian.Uint64(data[8:16]))
+			v3 = xxhRound(v3, binary.LittleEndian.Uint64(data[16:24]))
+			v4 = xxhRound(v4, binary.LittleEndian.Uint64(data[24:32]))
+			data = data[32:]
+		}
+
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxhMergeRound(h, v1)
+		h = xxhMergeRound(h, v2)
+		h = xxhMergeRound(h, v3)
+		h = xxhMergeRound(h, v4)
+	} else {
+		h = xxhPrime5
+	}
+
+	h += length
+
+	for len(data) >= 8 {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxhPrime1 + xxhPrime4
+		data = data[8:]
+	}
+
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxhPrime1
+		h = bits.RotateLeft64(h, 23)*xxhPrime2 + xxhPrime3
+		data = data[4:]
+	}
+
+	for _, b := range data {
+		h ^= uint64(b) * xxhPrime5
+		h = bits.RotateLeft64(h, 11) * xxhPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+// xxhRound mixes one 8-byte lane into an accumulator
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxhPrime1
+}
+
+// xxhMergeRound folds an accumulator into the hash
+func xxhMergeRound(h, v uint64) uint64 {
+	h ^= xxhRound(0, v)
+	return h*xxhPrime1 + xxhPrime4
+}
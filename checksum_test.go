@@ -0,0 +1,89 @@
+package yfs
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// rewriteBlock replaces the payload of a data block behind the index's back,
+// keeping its block header valid
+func rewriteBlock(t *testing.T, fs *YFS, blockID uint32, payload []byte) {
+	t.Helper()
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.writeBlock(blockID, 0, payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataChecksumDetectsCorruption(t *testing.T) {
+	for _, mode := range []DataChecksumMode{DataChecksumCRC32C, DataChecksumXXH64, DataChecksumSHA256} {
+		t.Run(mode.String(), func(t *testing.T) {
+			opts := Options{DataChecksums: mode}
+			fs, dir := newTestFS(t, opts)
+			payload := fs.payloadSize()
+
+			data := testData(4*payload, 1)
+			if err := fs.WriteFile("/a", data); err != nil {
+				t.Fatal(err)
+			}
+
+			blockID := fileEntry(t, fs, "/a").DirectBlockIds[2]
+			rewriteBlock(t, fs, blockID, testData(payload, 2))
+
+			fs = reopenTestFS(t, fs, dir, opts)
+			defer fs.Close()
+
+			_, err := fs.ReadFile("/a")
+			var checksumErr *ChecksumError
+			if !errors.As(err, &checksumErr) {
+				t.Fatalf("read of a corrupted file returned %v, want a ChecksumError", err)
+			}
+			if checksumErr.Path != "/a" || checksumErr.Offset != int64(2*payload) || checksumErr.BlockID != blockID {
+				t.Fatalf("checksum error %+v, want /a at offset %d in block %d", checksumErr, 2*payload, blockID)
+			}
+
+			// Reads that stay clear of the corrupted block still succeed
+			file, err := fs.Open("/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			head := make([]byte, 2*payload)
+			if _, err := file.ReadAt(head, 0); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(head, data[:2*payload]) {
+				t.Fatal("read before the corrupted block returned wrong data")
+			}
+		})
+	}
+}
+
+func TestDataChecksumNone(t *testing.T) {
+	fs, _ := newTestFS(t, Options{DataChecksums: DataChecksumNone})
+	defer fs.Close()
+	payload := fs.payloadSize()
+
+	if err := fs.WriteFile("/a", testData(2*payload, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	replaced := testData(payload, 2)
+	rewriteBlock(t, fs, fileEntry(t, fs, "/a").DirectBlockIds[1], replaced)
+
+	got, err := fs.ReadFile("/a")
+	if err != nil {
+		t.Fatalf("read without data checksums failed: %v", err)
+	}
+	if !bytes.Equal(got[payload:], replaced) {
+		t.Fatal("read did not return the rewritten block")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 
 	"os"
@@ -14,6 +15,7 @@ type Root struct {
 	fs          *yfs.YFS
 	currentPath string
 	scanner     *bufio.Scanner
+	passphrase  string
 }
 
 func (c *Root) run() {
@@ -74,6 +76,18 @@ func (c *Root) run() {
 			c.cmdTree()
 		case "stats":
 			c.cmdStats()
+		case "defrag":
+			c.cmdDefrag()
+		case "compact":
+			c.cmdCompact()
+		case "fsck":
+			c.cmdFsck(args)
+		case "snapshot":
+			c.cmdSnapshot(args)
+		case "passwd":
+			c.cmdPasswd()
+		case "rekey":
+			c.cmdRekey()
 		default:
 			fmt.Printf("Unknown command: %s. Type 'help' for available commands.\n", command)
 		}
@@ -86,15 +100,21 @@ func (c *Root) showHelp() {
 	fmt.Println("  cd <path>                   - Change current directory")
 	fmt.Println("  pwd                         - Print current directory")
 	fmt.Println("  cat <file>                  - Display file contents")
-	fmt.Println("  cp <src> <dst>              - Copy file within YFS")
+	fmt.Println("  cp [--physical] <src> <dst> - Copy file within YFS (shares blocks unless --physical)")
 	fmt.Println("  mv <src> <dst>              - Move/rename file within YFS")
 	fmt.Println("  rm <file>                   - Delete file")
 	fmt.Println("  mkdir <dir>                 - Create directory")
 	fmt.Println("  write <file> <content>      - Write content to file")
-	fmt.Println("  push <local_file> <remote_file>  - Copy local file to YFS")
+	fmt.Println("  push [--compress <alg>] <local_file> <remote_file>  - Copy local file to YFS")
 	fmt.Println("  pull <remote_file> <local_file>  - Copy YFS file to local filesystem")
 	fmt.Println("  tree                        - Show complete directory tree")
 	fmt.Println("  stats                       - Show filesystem statistics")
+	fmt.Println("  defrag                      - Defragment files and pack blocks")
+	fmt.Println("  compact                     - Shrink blocks.glob by reclaiming free blocks")
+	fmt.Println("  fsck [--repair]             - Check every file's index against the bitmap")
+	fmt.Println("  snapshot <create|delete> <name> | snapshot list  - Manage snapshots")
+	fmt.Println("  passwd                      - Change the passphrase of an encrypted file system")
+	fmt.Println("  rekey                       - Re-encrypt all blocks with a new data key")
 	fmt.Println("  help                        - Show this help")
 	fmt.Println("  exit, quit                  - Exit the CLI")
 }
@@ -121,6 +141,13 @@ func (c *Root) cmdLs(args []string) {
 		if entry.IsDirectory {
 			fmt.Printf("d %s %s/\n",
 				entry.ModTime.Format("2006-01-02 15:04:05"), entry.Name)
+		} else if entry.Inline {
+			fmt.Printf("- %s %8d %s (inline)\n",
+				entry.ModTime.Format("2006-01-02 15:04:05"), entry.Size, entry.Name)
+		} else if entry.Compression != yfs.CompressionNone {
+			fmt.Printf("- %s %8d %s (%s, %.1fx)\n",
+				entry.ModTime.Format("2006-01-02 15:04:05"), entry.Size, entry.Name,
+				entry.Compression, entry.CompressionRatio())
 		} else {
 			fmt.Printf("- %s %8d %s\n",
 				entry.ModTime.Format("2006-01-02 15:04:05"), entry.Size, entry.Name)
@@ -172,15 +199,20 @@ func (c *Root) cmdCat(args []string) {
 }
 
 func (c *Root) cmdCp(args []string) {
+	physical := len(args) > 0 && args[0] == "--physical"
+	if physical {
+		args = args[1:]
+	}
+
 	if len(args) != 2 {
-		fmt.Println("Usage: cp <src> <dst>")
+		fmt.Println("Usage: cp [--physical] <src> <dst>")
 		return
 	}
 
 	src := c.resolvePath(args[0])
 	dst := c.resolvePath(args[1])
 
-	err := c.fs.CopyFile(src, dst)
+	err := c.fs.CopyFileWithOptions(src, dst, yfs.CopyOptions{Physical: physical})
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -254,8 +286,14 @@ func (c *Root) cmdWrite(args []string) {
 }
 
 func (c *Root) cmdPush(args []string) {
+	var opts yfs.WriteOptions
+	if len(args) > 1 && args[0] == "--compress" {
+		opts.Compression = yfs.Compression(args[1])
+		args = args[2:]
+	}
+
 	if len(args) != 2 {
-		fmt.Println("Usage: push <local_file> <remote_file>")
+		fmt.Println("Usage: push [--compress <deflate|zlib|lzw|none>] <local_file> <remote_file>")
 		return
 	}
 
@@ -270,7 +308,7 @@ func (c *Root) cmdPush(args []string) {
 	}
 
 	// Write to YFS
-	err = c.fs.WriteFile(remotePath, data)
+	err = c.fs.WriteFileWithOptions(remotePath, data, opts)
 	if err != nil {
 		fmt.Printf("Error writing to YFS: %v\n", err)
 		return
@@ -328,6 +366,157 @@ func (c *Root) cmdStats() {
 	}
 }
 
+func (c *Root) cmdDefrag() {
+	var last yfs.DefragProgress
+	err := c.fs.DefragmentContext(context.Background(), func(p yfs.DefragProgress) {
+		fmt.Printf("\r  %d/%d files", p.FilesDone, p.FilesTotal)
+		last = p
+	})
+	if last.FilesTotal > 0 {
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Defragmented: moved %d files (%d blocks)\n", last.FilesMoved, last.BlocksMoved)
+}
+
+func (c *Root) cmdCompact() {
+	result, err := c.fs.Compact()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Moved %d blocks, reclaimed %d blocks (%d bytes)\n",
+		result.BlocksMoved, result.BlocksReclaimed, result.BytesReclaimed)
+}
+
+func (c *Root) cmdFsck(args []string) {
+	opts := yfs.CheckOptions{}
+	for _, arg := range args {
+		if arg != "--repair" {
+			fmt.Println("Usage: fsck [--repair]")
+			return
+		}
+		opts.Repair = true
+	}
+
+	report, err := c.fs.Check(opts)
+	if report != nil {
+		for _, problem := range report.Problems {
+			fmt.Printf("  %v\n", problem)
+		}
+		printBlockList("Leaked blocks", report.LeakedBlocks)
+		printBlockList("In use but marked free", report.UnmarkedBlocks)
+		printBlockList("Cross-linked blocks", report.CrossLinked)
+		printBlockList("Over-counted blocks", report.OverCounted)
+		fmt.Printf("Checked %d files, %d reachable blocks\n", report.Files, report.ReachableBlocks)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	switch {
+	case opts.Repair:
+		fmt.Printf("Repaired: freed %d blocks, moved %d files to /%s\n", report.FreedBlocks, len(report.Quarantined), yfs.LostAndFound)
+		for _, path := range report.Quarantined {
+			fmt.Printf("  %s\n", path)
+		}
+	case report.Clean():
+		fmt.Println("No problems found")
+	default:
+		fmt.Println("Problems found; run 'fsck --repair' to fix them")
+	}
+}
+
+// printBlockList prints a labelled list of block IDs, if any
+func printBlockList(label string, blockIDs []uint32) {
+	if len(blockIDs) == 0 {
+		return
+	}
+
+	ids := make([]string, 0, len(blockIDs))
+	for _, blockID := range blockIDs {
+		ids = append(ids, fmt.Sprint(blockID))
+	}
+	fmt.Printf("%s (%d): %s\n", label, len(blockIDs), strings.Join(ids, " "))
+}
+
+func (c *Root) cmdSnapshot(args []string) {
+	if len(args) == 1 && args[0] == "list" {
+		for _, snapshot := range c.fs.ListSnapshots() {
+			fmt.Printf("%-20s %s  %d files\n", snapshot.Name,
+				snapshot.CreateTime.Format("2006-01-02 15:04:05"), snapshot.FileCount)
+		}
+		return
+	}
+
+	if len(args) != 2 {
+		fmt.Println("Usage: snapshot <create|delete> <name> | snapshot list")
+		return
+	}
+
+	var err error
+	switch args[0] {
+	case "create":
+		err = c.fs.CreateSnapshot(args[1])
+	case "delete":
+		err = c.fs.DeleteSnapshot(args[1])
+	default:
+		fmt.Println("Usage: snapshot <create|delete> <name> | snapshot list")
+		return
+	}
+
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Snapshot %s %sd\n", args[1], args[0])
+}
+
+func (c *Root) cmdPasswd() {
+	oldKEK := yfs.KEK{Passphrase: c.passphrase}
+	if oldKEK.Passphrase == "" {
+		oldKEK.Passphrase = readPassphrase(c.scanner, "Current passphrase: ")
+	}
+
+	newKEK := yfs.KEK{Passphrase: readPassphrase(c.scanner, "New passphrase: ")}
+	if readPassphrase(c.scanner, "Repeat passphrase: ") != newKEK.Passphrase {
+		fmt.Println("Error: passphrases do not match")
+		return
+	}
+
+	if err := c.fs.RotateKey(oldKEK, newKEK); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	c.passphrase = newKEK.Passphrase
+	fmt.Println("Passphrase changed")
+}
+
+func (c *Root) cmdRekey() {
+	var last yfs.ReencryptProgress
+	err := c.fs.RotateDataKey(context.Background(), func(p yfs.ReencryptProgress) {
+		fmt.Printf("\r  %d/%d blocks", p.BlocksDone, p.BlocksTotal)
+		last = p
+	})
+	if last.BlocksTotal > 0 {
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Re-encrypted %d blocks with a new data key\n", last.Reencrypted)
+}
+
 func (c *Root) printFile(entry *yfs.FileEntry, indent string) {
 	fmt.Printf("%s├── %s (%d bytes)\n", indent, entry.Metadata.Name, entry.Size)
 }
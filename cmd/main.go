@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 
 	"log"
 	"os"
+	"os/exec"
 
 	"github.com/sammwyy/yfs"
 )
@@ -17,6 +19,14 @@ func main() {
 		indexFile  = flag.String("index", "", "Path to index.yfs file")
 		freeFile   = flag.String("free", "", "Path to free.yfs file")
 		blocksFile = flag.String("blocks", "", "Path to blocks.glob file")
+		blockSize  = flag.Uint("block-size", 0, "Block size for a new file system (default 4096)")
+		dataSum    = flag.String("data-checksum", "", "Data checksum for a new file system: crc32c, xxh64, sha256 or none (default crc32c)")
+		maxBlocks  = flag.Uint64("max-blocks", 0, "Maximum number of blocks (0 for unlimited)")
+		readOnly   = flag.Bool("readonly", false, "Open the file system read-only")
+		dedup      = flag.Bool("dedup", false, "Share identical data blocks between written files (stays on once enabled)")
+		inlineSize = flag.Int("inline-size", 0, "Largest file kept in root.yfs instead of in blocks (default 256, -1 for none)")
+		encrypt    = flag.Bool("encrypt", false, "Create an encrypted file system (prompts for a passphrase)")
+		encryptMd  = flag.Bool("encrypt-metadata", false, "Encrypt root.yfs and bitmap.yfs of a new encrypted file system too")
 		help       = flag.Bool("h", false, "Show help")
 	)
 
@@ -25,22 +35,31 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Usage:\n")
 		fmt.Fprintf(os.Stderr, "  %s -dir <directory>                    # Use directory containing YFS files\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -index <file> -free <file> -blocks <file>  # Specify individual files\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -dir <directory> migrate [-to <version>] [-out <dir>] [-backup <dir>]  # Upgrade the on-disk format\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment:\n")
+		fmt.Fprintf(os.Stderr, "  YFS_PASSPHRASE              - Passphrase of an encrypted file system (prompted for if unset)\n")
 		fmt.Fprintf(os.Stderr, "\nCommands available in interactive mode:\n")
 		fmt.Fprintf(os.Stderr, "  ls [path]                   - List directory contents\n")
 		fmt.Fprintf(os.Stderr, "  cd <path>                   - Change current directory\n")
 		fmt.Fprintf(os.Stderr, "  pwd                         - Print current directory\n")
 		fmt.Fprintf(os.Stderr, "  cat <file>                  - Display file contents\n")
-		fmt.Fprintf(os.Stderr, "  cp <src> <dst>              - Copy file within YFS\n")
+		fmt.Fprintf(os.Stderr, "  cp [--physical] <src> <dst> - Copy file within YFS (shares blocks unless --physical)\n")
 		fmt.Fprintf(os.Stderr, "  mv <src> <dst>              - Move/rename file within YFS\n")
 		fmt.Fprintf(os.Stderr, "  rm <file>                   - Delete file\n")
 		fmt.Fprintf(os.Stderr, "  mkdir <dir>                 - Create directory (creates parent dirs if needed)\n")
 		fmt.Fprintf(os.Stderr, "  write <file> <content>      - Write content to file\n")
-		fmt.Fprintf(os.Stderr, "  push <local_file> <remote_file>  - Copy local file to YFS\n")
+		fmt.Fprintf(os.Stderr, "  push [--compress <alg>] <local_file> <remote_file>  - Copy local file to YFS\n")
 		fmt.Fprintf(os.Stderr, "  pull <remote_file> <local_file>  - Copy YFS file to local filesystem\n")
 		fmt.Fprintf(os.Stderr, "  tree                        - Show complete directory tree\n")
 		fmt.Fprintf(os.Stderr, "  stats                       - Show filesystem statistics\n")
+		fmt.Fprintf(os.Stderr, "  defrag                      - Defragment files and pack blocks\n")
+		fmt.Fprintf(os.Stderr, "  compact                     - Shrink blocks.glob by reclaiming free blocks\n")
+		fmt.Fprintf(os.Stderr, "  fsck [--repair]             - Check every file's index against the bitmap\n")
+		fmt.Fprintf(os.Stderr, "  snapshot <create|delete> <name> | snapshot list  - Manage snapshots\n")
+		fmt.Fprintf(os.Stderr, "  passwd                      - Change the passphrase of an encrypted file system\n")
+		fmt.Fprintf(os.Stderr, "  rekey                       - Re-encrypt all blocks with a new data key\n")
 		fmt.Fprintf(os.Stderr, "  help                        - Show this help\n")
 		fmt.Fprintf(os.Stderr, "  exit, quit                  - Exit the CLI\n")
 	}
@@ -52,9 +71,52 @@ func main() {
 		return
 	}
 
+	if flag.Arg(0) == "migrate" {
+		if *directory == "" {
+			fmt.Fprintf(os.Stderr, "Error: migrate requires -dir\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		runMigrate(*directory, flag.Args()[1:])
+		return
+	}
+
 	var fs *yfs.YFS
 	var err error
 
+	dataChecksum, err := parseDataChecksum(*dataSum)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	opts := yfs.Options{
+		BlockSize:       uint32(*blockSize),
+		DataChecksums:   dataChecksum,
+		MaxBlocks:       *maxBlocks,
+		ReadOnly:        *readOnly,
+		Dedup:           *dedup,
+		InlineSize:      *inlineSize,
+		Passphrase:      os.Getenv("YFS_PASSPHRASE"),
+		EncryptMetadata: *encryptMd,
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	if (*encrypt || *encryptMd) && opts.Passphrase == "" {
+		opts.Passphrase = readPassphrase(scanner, "New passphrase: ")
+		if readPassphrase(scanner, "Repeat passphrase: ") != opts.Passphrase {
+			log.Fatalf("Passphrases do not match")
+		}
+	}
+
+	open := func() (*yfs.YFS, error) {
+		if *directory != "" {
+			return yfs.NewWithOptions(*directory, opts)
+		}
+		return yfs.NewFromPathsWithOptions(*indexFile, *freeFile, *blocksFile, opts)
+	}
+
 	// Initialize YFS based on provided arguments
 	if *directory != "" {
 		if *indexFile != "" || *freeFile != "" || *blocksFile != "" {
@@ -62,15 +124,25 @@ func main() {
 			flag.Usage()
 			os.Exit(1)
 		}
-		fs, err = yfs.New(*directory)
+		fs, err = open()
 	} else if *indexFile != "" && *freeFile != "" && *blocksFile != "" {
-		fs, err = yfs.NewFromPaths(*indexFile, *freeFile, *blocksFile)
+		fs, err = open()
 	} else {
 		fmt.Fprintf(os.Stderr, "Error: Must specify either -dir or all three files (-index, -free, -blocks)\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	// Ask for the passphrase of an encrypted file system
+	if errors.Is(err, yfs.ErrKeyRequired) {
+		opts.Passphrase = readPassphrase(scanner, "Passphrase: ")
+		fs, err = open()
+	}
+
+	if errors.Is(err, yfs.ErrFormatVersion) && !*readOnly {
+		log.Fatalf("Failed to initialize YFS: %v\nOpen it with -readonly, or upgrade it with: %s -dir <directory> migrate", err, os.Args[0])
+	}
+
 	if err != nil {
 		log.Fatalf("Failed to initialize YFS: %v", err)
 	}
@@ -78,8 +150,79 @@ func main() {
 	cli := &Root{
 		fs:          fs,
 		currentPath: "/",
-		scanner:     bufio.NewScanner(os.Stdin),
+		scanner:     scanner,
+		passphrase:  opts.Passphrase,
 	}
 
 	cli.run()
 }
+
+// runMigrate upgrades the file system in dir to a newer on-disk format
+func runMigrate(dir string, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	target := flags.Uint("to", yfs.FormatVersion, "Format version to migrate to")
+	output := flags.String("out", "", "Write the migrated file system to this directory instead of replacing the original")
+	backup := flags.String("backup", "", "Directory to move the original files to (default <dir>.v<version>.bak)")
+	flags.Parse(args)
+
+	opts := yfs.MigrateOptions{
+		Output:     *output,
+		Backup:     *backup,
+		Passphrase: os.Getenv("YFS_PASSPHRASE"),
+	}
+
+	err := yfs.MigrateWithOptions(dir, uint32(*target), opts)
+	if errors.Is(err, yfs.ErrKeyRequired) {
+		opts.Passphrase = readPassphrase(bufio.NewScanner(os.Stdin), "Passphrase: ")
+		err = yfs.MigrateWithOptions(dir, uint32(*target), opts)
+	}
+
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+
+	if *output != "" {
+		fmt.Printf("Migrated %s to format v%d in %s\n", dir, *target, *output)
+		return
+	}
+	fmt.Printf("Migrated %s to format v%d\n", dir, *target)
+}
+
+// parseDataChecksum returns the data checksum mode named on the command line
+func parseDataChecksum(name string) (yfs.DataChecksumMode, error) {
+	switch name {
+	case "":
+		return yfs.DataChecksumDefault, nil
+	case "crc32c":
+		return yfs.DataChecksumCRC32C, nil
+	case "xxh64":
+		return yfs.DataChecksumXXH64, nil
+	case "sha256":
+		return yfs.DataChecksumSHA256, nil
+	case "none":
+		return yfs.DataChecksumNone, nil
+	default:
+		return yfs.DataChecksumDefault, fmt.Errorf("unknown data checksum: %s", name)
+	}
+}
+
+// readPassphrase prompts for a passphrase, hiding the input when stdin is a terminal
+func readPassphrase(scanner *bufio.Scanner, prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+
+	echoOff := exec.Command("stty", "-echo")
+	echoOff.Stdin = os.Stdin
+	if echoOff.Run() == nil {
+		defer func() {
+			echoOn := exec.Command("stty", "echo")
+			echoOn.Stdin = os.Stdin
+			echoOn.Run()
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+
+	if !scanner.Scan() {
+		log.Fatalf("No passphrase given")
+	}
+	return scanner.Text()
+}
@@ -0,0 +1,272 @@
+package yfs
+
+import (
+	"fmt"
+	"os"
+)
+
+// CompactResult describes what a Compact run changed
+type CompactResult struct {
+	BlocksMoved     uint64 // Blocks relocated into lower free slots
+	BlocksReclaimed uint64 // Blocks removed from the end of the volume
+	BytesReclaimed  int64  // Bytes blocks.glob shrank by
+}
+
+// Compact shrinks blocks.glob by moving the highest-numbered used blocks
+// into the lowest free slots, updating the index blocks and file entries
+// that reference them, and then truncating the free tail of the volume.
+// Files still indexed by a legacy chain are moved onto an index tree first.
+// Snapshots are compacted along with the live tree, so no snapshot may be
+// open.
+//
+// The relocation is committed through the journal as a single operation
+// before blocks.glob is cut, so a crash leaves every file readable.
+func (yfs *YFS) Compact() (*CompactResult, error) {
+	if err := yfs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	if len(yfs.snapshotViews) > 0 {
+		return nil, fmt.Errorf("cannot compact while snapshots are open")
+	}
+
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	// Upgrade legacy chains so every reference lives in a FileEntry or an index tree
+	var files []*FileEntry
+	err := yfs.walkAllFiles(func(path string, file *FileEntry) error {
+		if err := yfs.upgradeLegacyIndex(yfs.fileIndexFor(file)); err != nil {
+			return fmt.Errorf("failed to upgrade index of %s: %w", path, err)
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	moves := yfs.planCompaction()
+	result := &CompactResult{BlocksMoved: uint64(len(moves))}
+
+	if len(moves) > 0 {
+		if err := yfs.moveBlocks(files, moves); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every cached index refers to the old locations
+	yfs.indexes = make(map[*FileEntry]*fileIndex)
+
+	if err := yfs.commit(); err != nil {
+		return nil, err
+	}
+
+	oldSize, err := yfs.blocksFileSize()
+	if err != nil {
+		return nil, err
+	}
+
+	reclaimed, err := yfs.shrinkVolume()
+	if err != nil {
+		return nil, err
+	}
+	result.BlocksReclaimed = reclaimed
+
+	newSize, err := yfs.blocksFileSize()
+	if err != nil {
+		return nil, err
+	}
+	result.BytesReclaimed = oldSize - newSize
+
+	return result, nil
+}
+
+// planCompaction pairs the highest used blocks with the lowest free slots
+// below them and returns the new location of every block that moves
+func (yfs *YFS) planCompaction() map[uint32]uint32 {
+	yfs.bitmap.mutex.RLock()
+	defer yfs.bitmap.mutex.RUnlock()
+
+	moves := make(map[uint32]uint32)
+	if yfs.bitmap.totalBlocks == 0 {
+		return moves
+	}
+
+	low, high := uint64(0), yfs.bitmap.totalBlocks-1
+	for {
+		for low < high && !yfs.isBlockFree(low) {
+			low++
+		}
+		for high > low && yfs.isBlockFree(high) {
+			high--
+		}
+		if low >= high {
+			return moves
+		}
+
+		moves[uint32(high)+1] = uint32(low) + 1 // Block IDs are 1-based
+		low++
+		high--
+	}
+}
+
+// moveBlocks copies blocks to their new slots, points every reference at
+// the copies and frees the old slots
+func (yfs *YFS) moveBlocks(files []*FileEntry, moves map[uint32]uint32) error {
+	remap := func(blockID uint32) uint32 {
+		if newID, exists := moves[blockID]; exists {
+			return newID
+		}
+		return blockID
+	}
+
+	// Copy every moved block and reserve its new slot
+	for oldID, newID := range moves {
+		framed, err := yfs.readFramedBlock(oldID)
+		if err != nil {
+			return fmt.Errorf("failed to read block %d: %w", oldID, err)
+		}
+
+		if err := yfs.writeFramedBlock(newID, framed); err != nil {
+			return fmt.Errorf("failed to write block %d: %w", newID, err)
+		}
+	}
+
+	yfs.bitmap.mutex.Lock()
+	for _, newID := range moves {
+		yfs.markBlockUsed(uint64(newID - 1))
+	}
+	yfs.bitmap.dirty = true
+	yfs.bitmap.mutex.Unlock()
+
+	// Rewrite index blocks whose references changed, at their new location.
+	// Index blocks shared by several files are rewritten by the first one;
+	// remapping is idempotent, so the others find them already updated.
+	for _, file := range files {
+		if err := yfs.remapFileIndex(yfs.fileIndexFor(file), remap); err != nil {
+			return err
+		}
+	}
+
+	// Reference counts follow the blocks they count
+	for oldID, newID := range moves {
+		if refs, exists := yfs.header.BlockRefs[oldID]; exists {
+			delete(yfs.header.BlockRefs, oldID)
+			yfs.header.BlockRefs[newID] = refs
+		}
+	}
+
+	yfs.moveDedupBlocks(moves)
+
+	// Nothing references the old slots anymore
+	oldIDs := make([]uint32, 0, len(moves))
+	for oldID := range moves {
+		oldIDs = append(oldIDs, oldID)
+	}
+
+	return yfs.freeBlocks(oldIDs)
+}
+
+// remapFileIndex replaces every block reference of a file with remap(ref).
+// Index blocks are written at their remapped location whenever they move or
+// any of their references changes.
+func (yfs *YFS) remapFileIndex(idx *fileIndex, remap func(uint32) uint32) error {
+	file := idx.file
+
+	var remapNode func(blockID uint32, depth int) error
+	remapNode = func(blockID uint32, depth int) error {
+		entries, err := yfs.indexNode(idx, blockID)
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for i, child := range entries {
+			if child == NullBlockID {
+				continue
+			}
+
+			if depth > 1 {
+				if err := remapNode(child, depth-1); err != nil {
+					return err
+				}
+			}
+
+			if newChild := remap(child); newChild != child {
+				entries[i] = newChild
+				changed = true
+			}
+		}
+
+		if newID := remap(blockID); changed || newID != blockID {
+			return yfs.writeIndexBlock(newID, file.Inode, yfs.newIndexBlock(entries, idx.sums[blockID]))
+		}
+		return nil
+	}
+
+	for level, blockID := range file.IndirectBlockIds {
+		if blockID == NullBlockID {
+			continue
+		}
+
+		if err := remapNode(blockID, level+1); err != nil {
+			return err
+		}
+		file.IndirectBlockIds[level] = remap(blockID)
+	}
+
+	for i, blockID := range file.DirectBlockIds {
+		if blockID != NullBlockID {
+			file.DirectBlockIds[i] = remap(blockID)
+		}
+	}
+
+	return nil
+}
+
+// shrinkVolume drops the free blocks at the end of the volume from the
+// bitmap, the header and blocks.glob, and returns how many were dropped
+func (yfs *YFS) shrinkVolume() (uint64, error) {
+	yfs.bitmap.mutex.Lock()
+
+	oldTotal := yfs.bitmap.totalBlocks
+	newTotal := oldTotal
+	for newTotal > 0 && yfs.isBlockFree(newTotal-1) {
+		newTotal--
+	}
+
+	if newTotal < oldTotal {
+		yfs.resizeBitmap(newTotal)
+		yfs.bitmap.dirty = true
+		yfs.header.TotalBlocks = newTotal
+	}
+
+	yfs.bitmap.mutex.Unlock()
+
+	// Record the smaller volume before cutting the file, so a crash in
+	// between only leaves unused bytes at the end of blocks.glob
+	if err := yfs.commit(); err != nil {
+		return 0, err
+	}
+
+	size := int64(HeaderSize) + int64(newTotal)*int64(yfs.blockSize)
+	if err := os.Truncate(yfs.blocksPath, size); err != nil {
+		return 0, fmt.Errorf("failed to truncate blocks file: %w", err)
+	}
+
+	return oldTotal - newTotal, nil
+}
+
+// blocksFileSize returns the current size of blocks.glob
+func (yfs *YFS) blocksFileSize() (int64, error) {
+	info, err := os.Stat(yfs.blocksPath)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
@@ -0,0 +1,134 @@
+package yfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	opts := Options{InitialBlocks: 128}
+	fs, dir := newTestFS(t, opts)
+
+	files := map[string][]byte{
+		"/b": testData(20*fs.payloadSize(), 2),
+		"/c": testData(10*fs.payloadSize()+7, 3),
+	}
+	if err := fs.AppendFile("/a", testData(30*fs.payloadSize(), 1)); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/b", "/c"} {
+		if err := fs.AppendFile(path, files[path]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files["/legacy"] = testData(5*fs.payloadSize(), 4)
+	makeLegacyFile(t, fs, "/legacy", files["/legacy"], 2)
+
+	// Deleting the first file leaves the others far from the start
+	if err := fs.DeleteFile("/a"); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	path := filepath.Join(dir, "blocks.glob")
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := fs.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BlocksMoved == 0 || result.BlocksReclaimed == 0 {
+		t.Fatalf("Compact moved %d and reclaimed %d blocks", result.BlocksMoved, result.BlocksReclaimed)
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Size()-after.Size() != result.BytesReclaimed || result.BytesReclaimed <= 0 {
+		t.Fatalf("blocks.glob shrank from %d to %d bytes, Compact reported %d", before.Size(), after.Size(), result.BytesReclaimed)
+	}
+
+	// Only the legacy chain's index blocks are dropped
+	if fs.header.TotalBlocks != uint64(usedBlocks(fs)) || usedBlocks(fs) > used {
+		t.Fatalf("%d blocks remain for %d used, %d before", fs.header.TotalBlocks, usedBlocks(fs), used)
+	}
+	if file := fileEntry(t, fs, "/legacy"); file.FirstIndexBlockId != NullBlockID {
+		t.Fatal("the legacy file was not moved onto an index tree")
+	}
+
+	fs = reopenTestFS(t, fs, dir, opts)
+	for path, data := range files {
+		expectFile(t, fs, path, data)
+	}
+
+	result, err = fs.Compact()
+	if err != nil || result.BlocksMoved != 0 || result.BlocksReclaimed != 0 {
+		t.Fatalf("compacting a compact volume returned %+v, %v", result, err)
+	}
+
+	// The shrunk volume still grows on demand
+	more := testData(40*fs.payloadSize(), 5)
+	if err := fs.AppendFile("/d", more); err != nil {
+		t.Fatal(err)
+	}
+	fs = reopenTestFS(t, fs, dir, opts)
+	expectFile(t, fs, "/d", more)
+}
+
+func TestCompactWithSnapshots(t *testing.T) {
+	fs, dir := newTestFS(t, Options{InitialBlocks: 128})
+
+	if err := fs.WriteFile("/a", testData(30*fs.payloadSize(), 1)); err != nil {
+		t.Fatal(err)
+	}
+	b := testData(20*fs.payloadSize(), 2)
+	if err := fs.WriteFile("/b", b); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteFile("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteFile("/b"); err != nil {
+		t.Fatal(err)
+	}
+	c := testData(5*fs.payloadSize(), 3)
+	if err := fs.WriteFile("/c", c); err != nil {
+		t.Fatal(err)
+	}
+
+	view, err := fs.OpenSnapshot("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Compact(); err == nil {
+		t.Fatal("Compact ran while a snapshot was open")
+	}
+	view.Close()
+
+	// Blocks only the snapshot references move too
+	if err := fs.DeleteSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSnapshot("t"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := fs.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BlocksReclaimed == 0 {
+		t.Fatal("Compact reclaimed nothing")
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/c", c)
+	expectSnapshotFile(t, fs, "t", "/c", c)
+}
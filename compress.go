@@ -0,0 +1,382 @@
+package yfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/lzw"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Compression names the algorithm a file's data is stored with
+type Compression string
+
+const (
+	CompressionNone    Compression = "none"    // Data stored as written
+	CompressionDeflate Compression = "deflate" // Raw DEFLATE (RFC 1951)
+	CompressionZlib    Compression = "zlib"    // DEFLATE with a zlib header and Adler-32 (RFC 1950)
+	CompressionLZW     Compression = "lzw"     // LZW, LSB order with 8-bit literals
+
+	compressionChunkBlocks = 16 // Data blocks per independently compressed chunk of a new file
+)
+
+// WriteOptions configures how WriteFileWithOptions stores a file
+type WriteOptions struct {
+	Compression Compression // Algorithm for the file's data; empty keeps the one of an existing file (none for a new one)
+}
+
+// entryValue returns the FileEntry.compression value for the algorithm
+func (c Compression) entryValue() (uint32, error) {
+	switch c {
+	case CompressionNone:
+		return 0, nil
+	case CompressionDeflate:
+		return 1, nil
+	case CompressionZlib:
+		return 2, nil
+	case CompressionLZW:
+		return 3, nil
+	default:
+		return 0, fmt.Errorf("unknown compression: %q", string(c))
+	}
+}
+
+// compressionFromEntry returns the algorithm stored in a FileEntry
+func compressionFromEntry(value uint32) Compression {
+	switch value {
+	case 1:
+		return CompressionDeflate
+	case 2:
+		return CompressionZlib
+	case 3:
+		return CompressionLZW
+	default:
+		return CompressionNone
+	}
+}
+
+// compressChunk compresses one chunk of file data
+func compressChunk(value uint32, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch compressionFromEntry(value) {
+	case CompressionDeflate:
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	case CompressionZlib:
+		w = zlib.NewWriter(&buf)
+	case CompressionLZW:
+		w = lzw.NewWriter(&buf, lzw.LSB, 8)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompressChunk restores a chunk of the given logical size
+func decompressChunk(value uint32, data []byte, size int) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+
+	switch compressionFromEntry(value) {
+	case CompressionDeflate:
+		r = flate.NewReader(bytes.NewReader(data))
+	case CompressionZlib:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	case CompressionLZW:
+		r = lzw.NewReader(bytes.NewReader(data), lzw.LSB, 8)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk: %w", err)
+	}
+
+	return chunk, nil
+}
+
+// chunkBlocks returns how many logical block positions each chunk of a
+// compressed file spans. Chunk c is stored from position c*chunkBlocks on;
+// the positions its stored bytes do not need are left unallocated, so the
+// file index addresses every chunk directly.
+func (yfs *YFS) chunkBlocks(file *FileEntry) (int64, error) {
+	chunkSize := int64(file.CompressionChunkSize)
+	payloadSize := int64(yfs.payloadSize())
+	if chunkSize == 0 || chunkSize%payloadSize != 0 {
+		return 0, fmt.Errorf("invalid compression chunk size: %d", chunkSize)
+	}
+
+	return chunkSize / payloadSize, nil
+}
+
+// readChunk returns the logical contents of chunk c of a compressed file
+// The caller must hold indexMutex.
+func (yfs *YFS) readChunk(idx *fileIndex, c int64) ([]byte, error) {
+	file := idx.file
+	if c >= int64(len(file.ChunkSizes)) {
+		return nil, fmt.Errorf("chunk %d out of range", c)
+	}
+
+	chunkSize := int64(file.CompressionChunkSize)
+	size := min(chunkSize, file.Size-c*chunkSize)
+
+	stored := make([]byte, file.ChunkSizes[c])
+	if _, err := yfs.readBlocksAt(idx, stored, c*chunkSize); err != nil {
+		return nil, err
+	}
+
+	if int64(len(stored)) >= size {
+		return stored[:size], nil // Kept uncompressed
+	}
+	return decompressChunk(file.Compression, stored, int(size))
+}
+
+// writeChunk compresses data as chunk c of a file and stores it over the
+// chunk's previous contents. A chunk that does not shrink is stored as it is.
+// The caller must hold indexMutex.
+func (yfs *YFS) writeChunk(idx *fileIndex, c int64, data []byte) error {
+	file := idx.file
+
+	chunkBlocks, err := yfs.chunkBlocks(file)
+	if err != nil {
+		return err
+	}
+
+	stored, err := compressChunk(file.Compression, data)
+	if err != nil {
+		return err
+	}
+	if len(stored) >= len(data) {
+		stored = data
+	}
+
+	payloadSize := yfs.payloadSize()
+	first := c * chunkBlocks
+	used := int64(yfs.dataBlocksFor(int64(len(stored))))
+
+	for i := int64(0); i < used; i++ {
+		n := first + i
+		payload := stored[int(i)*payloadSize : min(int(i+1)*payloadSize, len(stored))]
+
+		blockID, err := yfs.lookupBlock(idx, n)
+		if err != nil {
+			return err
+		}
+
+		if blockID == NullBlockID {
+			blockIDs, err := yfs.allocateRun(idx, n, first+used)
+			if err != nil {
+				return err
+			}
+			blockID = blockIDs[0]
+		} else if blockID, err = yfs.unshareDataBlock(idx, n, blockID); err != nil {
+			return err
+		}
+
+		if err := yfs.writeBlock(blockID, file.Inode, payload); err != nil {
+			return err
+		}
+
+		if err := yfs.setBlockChecksum(idx, n, yfs.dataChecksum.sum(payload)); err != nil {
+			return err
+		}
+	}
+
+	// Release the blocks the previous contents of the chunk needed beyond these
+	for n := first + used; n < first+chunkBlocks; n++ {
+		if err := yfs.clearBlock(idx, n); err != nil {
+			return err
+		}
+	}
+
+	for int64(len(file.ChunkSizes)) <= c {
+		file.ChunkSizes = append(file.ChunkSizes, 0)
+	}
+	file.StoredSize += int64(len(stored)) - int64(file.ChunkSizes[c])
+	file.ChunkSizes[c] = uint32(len(stored))
+
+	return nil
+}
+
+// clearBlock unallocates logical block n of a file
+func (yfs *YFS) clearBlock(idx *fileIndex, n int64) error {
+	blockID, err := yfs.lookupBlock(idx, n)
+	if err != nil || blockID == NullBlockID {
+		return err
+	}
+
+	if err := yfs.setBlock(idx, n, NullBlockID); err != nil {
+		return err
+	}
+
+	if err := yfs.setBlockChecksum(idx, n, nil); err != nil {
+		return err
+	}
+
+	idx.file.DataBlockCount--
+	return yfs.releaseBlocks([]uint32{blockID})
+}
+
+// writeCompressedToBlocks writes file data as compressed chunks to fresh
+// blocks and indexes them in the given file entry, which must not reference
+// any blocks yet
+func (yfs *YFS) writeCompressedToBlocks(file *FileEntry, data []byte) error {
+	idx := newFileIndex(file)
+	chunkSize := int(file.CompressionChunkSize)
+
+	for start := 0; start < len(data); start += chunkSize {
+		if err := yfs.writeChunk(idx, int64(start/chunkSize), data[start:min(start+chunkSize, len(data))]); err != nil {
+			yfs.truncateIndex(idx, 0)
+			return err
+		}
+	}
+
+	if err := yfs.flushIndex(idx); err != nil {
+		yfs.truncateIndex(idx, 0)
+		return err
+	}
+
+	return nil
+}
+
+// readCompressedAt reads len(p) bytes of a compressed file starting at off,
+// decompressing only the chunks the range covers
+// The caller must hold indexMutex.
+func (yfs *YFS) readCompressedAt(idx *fileIndex, p []byte, off int64) (int, error) {
+	chunkSize := int64(idx.file.CompressionChunkSize)
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		chunk, err := yfs.readChunk(idx, pos/chunkSize)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], chunk[pos%chunkSize:])
+	}
+
+	return n, nil
+}
+
+// writeCompressedAtUnsafe writes data into a compressed file at offset off,
+// recompressing every chunk the write touches. A gap between the end of the
+// file and off is filled with zeros.
+func (yfs *YFS) writeCompressedAtUnsafe(file *FileEntry, data []byte, off int64) error {
+	end := off + int64(len(data))
+	size := max(file.Size, end)
+	if size == file.Size && len(data) == 0 {
+		return nil
+	}
+
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	idx := yfs.fileIndexFor(file)
+	chunkSize := int64(file.CompressionChunkSize)
+
+	for c := min(off, file.Size) / chunkSize; c*chunkSize < size; c++ {
+		start := c * chunkSize
+		chunk := make([]byte, min(chunkSize, size-start))
+
+		if start < file.Size {
+			current, err := yfs.readChunk(idx, c)
+			if err != nil {
+				return err
+			}
+			copy(chunk, current)
+		}
+
+		if start >= end && start < file.Size {
+			break // The rest of the file is untouched
+		}
+
+		if start+chunkSize > off {
+			from := max(off, start)
+			copy(chunk[from-start:], data[from-off:min(end, start+chunkSize)-off])
+		}
+
+		if err := yfs.writeChunk(idx, c, chunk); err != nil {
+			return err
+		}
+	}
+
+	if err := yfs.flushIndex(idx); err != nil {
+		return err
+	}
+
+	file.Size = size
+	file.Metadata.ModTime = time.Now().Unix()
+
+	return nil
+}
+
+// truncateCompressedUnsafe shrinks a compressed file, recompressing the chunk
+// the new end falls into and freeing the chunks past it
+func (yfs *YFS) truncateCompressedUnsafe(file *FileEntry, size int64) error {
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	idx := yfs.fileIndexFor(file)
+	chunkSize := int64(file.CompressionChunkSize)
+	chunks := (size + chunkSize - 1) / chunkSize
+
+	chunkBlocks, err := yfs.chunkBlocks(file)
+	if err != nil {
+		return err
+	}
+
+	if tail := size % chunkSize; tail != 0 {
+		chunk, err := yfs.readChunk(idx, chunks-1)
+		if err != nil {
+			return err
+		}
+
+		if err := yfs.writeChunk(idx, chunks-1, chunk[:tail]); err != nil {
+			return err
+		}
+	}
+
+	if err := yfs.truncateIndex(idx, chunks*chunkBlocks); err != nil {
+		return err
+	}
+
+	for _, stored := range file.ChunkSizes[chunks:] {
+		file.StoredSize -= int64(stored)
+	}
+	file.ChunkSizes = file.ChunkSizes[:chunks]
+
+	file.Size = size
+	file.Metadata.ModTime = time.Now().Unix()
+
+	return nil
+}
+
+// compressionRatio returns logical bytes per stored byte, 1 when nothing is stored
+func compressionRatio(logical, stored int64) float64 {
+	if stored == 0 {
+		return 1
+	}
+	return float64(logical) / float64(stored)
+}
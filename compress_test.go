@@ -0,0 +1,102 @@
+package yfs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// compressibleData returns n bytes of text that compresses well
+func compressibleData(n int) []byte {
+	line := []byte("the quick brown fox jumps over the lazy dog 0123456789\n")
+	return bytes.Repeat(line, n/len(line)+1)[:n]
+}
+
+func TestCompressedWriteAtTruncate(t *testing.T) {
+	for _, compression := range []Compression{CompressionDeflate, CompressionZlib, CompressionLZW} {
+		t.Run(string(compression), func(t *testing.T) {
+			fs, dir := newTestFS(t, Options{})
+
+			want := compressibleData(300 << 10)
+			if err := fs.WriteFileWithOptions("/a", want, WriteOptions{Compression: compression}); err != nil {
+				t.Fatal(err)
+			}
+			if file := fileEntry(t, fs, "/a"); file.StoredSize >= file.Size {
+				t.Fatalf("%d bytes stored for %d compressible bytes", file.StoredSize, file.Size)
+			}
+
+			// Across a chunk boundary, with data that does not compress
+			chunkSize := int64(fileEntry(t, fs, "/a").CompressionChunkSize)
+			patch := testData(int(chunkSize)/2, 1)
+			off := chunkSize - int64(len(patch))/2
+			if err := fs.WriteAt("/a", off, patch); err != nil {
+				t.Fatal(err)
+			}
+			copy(want[off:], patch)
+			expectFile(t, fs, "/a", want)
+
+			// Shrinking into the middle of a chunk, then growing again with zeros
+			size := int64(len(want)) - chunkSize - 1000
+			if err := fs.Truncate("/a", size); err != nil {
+				t.Fatal(err)
+			}
+			want = want[:size]
+			expectFile(t, fs, "/a", want)
+
+			if err := fs.Truncate("/a", size+5000); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, make([]byte, 5000)...)
+			expectFile(t, fs, "/a", want)
+
+			tail := compressibleData(70 << 10)
+			if err := fs.AppendFile("/a", tail); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, tail...)
+
+			fs = reopenTestFS(t, fs, dir, Options{})
+			defer fs.Close()
+
+			expectFile(t, fs, "/a", want)
+			if info, err := fs.GetFileInfo("/a"); err != nil || info.Compression != compression {
+				t.Fatalf("file info reports compression %v, want %s", info, compression)
+			}
+			expectCheckClean(t, fs)
+		})
+	}
+}
+
+func TestCompressedFileHandle(t *testing.T) {
+	fs, _ := newTestFS(t, Options{})
+	defer fs.Close()
+
+	want := compressibleData(200 << 10)
+	if err := fs.WriteFileWithOptions("/a", want, WriteOptions{Compression: CompressionZlib}); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := fs.OpenFile("/a", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := []byte("patched through a handle")
+	if _, err := file.WriteAt(patch, 100<<10); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[100<<10:], patch)
+
+	got := make([]byte, 1000)
+	if _, err := file.ReadAt(got, 100<<10-500); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[100<<10-500:100<<10+500]) {
+		t.Fatal("read through the handle does not see its write")
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectFile(t, fs, "/a", want)
+}
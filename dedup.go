@@ -0,0 +1,185 @@
+package yfs
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// With dedup on, the data blocks written by writeFileToBlocks are indexed in
+// FileSystemHeader.dedup_blocks by the XXH64 of their payload. A block whose
+// payload is already stored references the existing block instead, which
+// gains a reference in block_refs like any other shared block; writing to it
+// later unshares it. A candidate is compared byte for byte before it is
+// reused, so hash collisions and blocks rewritten in place since they were
+// indexed are never mistaken for duplicates.
+
+// dedupOwners returns the key each indexed block is stored under, the
+// reverse of the dedup index, building it on first use
+func (yfs *YFS) dedupOwners() map[uint32]uint64 {
+	if yfs.dedupKeys == nil {
+		yfs.dedupKeys = make(map[uint32]uint64, len(yfs.header.DedupBlocks))
+		for key, blockID := range yfs.header.DedupBlocks {
+			yfs.dedupKeys[blockID] = key
+		}
+	}
+	return yfs.dedupKeys
+}
+
+// findDuplicate returns a used data block holding exactly payload, or
+// NullBlockID when none is indexed under its key
+func (yfs *YFS) findDuplicate(key uint64, payload []byte) (uint32, error) {
+	blockID, exists := yfs.header.DedupBlocks[key]
+	if !exists {
+		return NullBlockID, nil
+	}
+
+	yfs.bitmap.mutex.RLock()
+	free := yfs.isBlockFree(uint64(blockID - 1))
+	yfs.bitmap.mutex.RUnlock()
+	if free {
+		yfs.forgetDedupBlocks([]uint32{blockID}) // Freed behind the index's back, e.g. by a bitmap rebuild
+		return NullBlockID, nil
+	}
+
+	stored, err := yfs.readBlock(blockID)
+	if err != nil {
+		return NullBlockID, fmt.Errorf("failed to read dedup candidate %d: %w", blockID, err)
+	}
+
+	if !bytes.Equal(stored, payload) {
+		return NullBlockID, nil
+	}
+	return blockID, nil
+}
+
+// rememberDedupBlock indexes a block holding the payload with the given key
+func (yfs *YFS) rememberDedupBlock(key uint64, blockID uint32) {
+	if yfs.header.DedupBlocks == nil {
+		yfs.header.DedupBlocks = make(map[uint64]uint32)
+	}
+
+	owners := yfs.dedupOwners()
+	if previous, exists := yfs.header.DedupBlocks[key]; exists {
+		delete(owners, previous)
+	}
+	if previous, exists := owners[blockID]; exists {
+		delete(yfs.header.DedupBlocks, previous) // Rewritten in place since it was indexed
+	}
+
+	yfs.header.DedupBlocks[key] = blockID
+	owners[blockID] = key
+}
+
+// forgetDedupBlocks drops freed blocks from the dedup index
+func (yfs *YFS) forgetDedupBlocks(blockIDs []uint32) {
+	if len(yfs.header.DedupBlocks) == 0 {
+		return
+	}
+
+	owners := yfs.dedupOwners()
+	for _, blockID := range blockIDs {
+		if key, exists := owners[blockID]; exists {
+			delete(owners, blockID)
+			delete(yfs.header.DedupBlocks, key)
+		}
+	}
+}
+
+// moveDedupBlocks points the dedup index at the new location of moved blocks
+func (yfs *YFS) moveDedupBlocks(moves map[uint32]uint32) {
+	if len(yfs.header.DedupBlocks) == 0 {
+		return
+	}
+
+	owners := yfs.dedupOwners()
+	moved := make(map[uint32]uint64)
+	for oldID, newID := range moves {
+		if key, exists := owners[oldID]; exists {
+			delete(owners, oldID)
+			yfs.header.DedupBlocks[key] = newID
+			moved[newID] = key
+		}
+	}
+
+	for blockID, key := range moved {
+		owners[blockID] = key
+	}
+}
+
+// writeDedupedToBlocks writes file data like writeFileToBlocks, referencing
+// an existing block for every payload already stored
+func (yfs *YFS) writeDedupedToBlocks(file *FileEntry, data []byte) error {
+	payloadSize := yfs.payloadSize()
+	idx := newFileIndex(file)
+
+	for i := 0; i*payloadSize < len(data); i++ {
+		payload := data[i*payloadSize : min((i+1)*payloadSize, len(data))]
+		key := xxh64(payload)
+
+		blockID, err := yfs.findDuplicate(key, payload)
+		if err != nil {
+			yfs.truncateIndex(idx, 0)
+			return err
+		}
+
+		if blockID != NullBlockID {
+			yfs.retainBlock(blockID)
+		} else {
+			blockIDs, err := yfs.allocateBlocks(1)
+			if err != nil {
+				yfs.truncateIndex(idx, 0)
+				return err
+			}
+			blockID = blockIDs[0]
+
+			if err := yfs.writeBlock(blockID, file.Inode, payload); err != nil {
+				yfs.freeBlocks(blockIDs)
+				yfs.truncateIndex(idx, 0)
+				return err
+			}
+			yfs.rememberDedupBlock(key, blockID)
+		}
+
+		if err := yfs.setBlock(idx, int64(i), blockID); err != nil {
+			yfs.releaseBlocks([]uint32{blockID})
+			yfs.truncateIndex(idx, 0)
+			return err
+		}
+		file.DataBlockCount++
+
+		if err := yfs.setBlockChecksum(idx, int64(i), yfs.dataChecksum.sum(payload)); err != nil {
+			yfs.truncateIndex(idx, 0)
+			return err
+		}
+	}
+
+	if err := yfs.flushIndex(idx); err != nil {
+		yfs.truncateIndex(idx, 0)
+		return err
+	}
+
+	return nil
+}
+
+// dedupRatio returns the data block references of the live tree per
+// distinct data block they reach, 1 when nothing is shared
+func (yfs *YFS) dedupRatio() (float64, error) {
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	references := 0
+	distinct := make(map[uint32]bool)
+
+	err := walkFiles(yfs.header.Root, "", func(path string, file *FileEntry) error {
+		return yfs.forEachBlock(yfs.fileIndexFor(file), func(_ int64, blockID uint32) error {
+			references++
+			distinct[blockID] = true
+			return nil
+		})
+	})
+	if err != nil || len(distinct) == 0 {
+		return 1, err
+	}
+
+	return float64(references) / float64(len(distinct)), nil
+}
@@ -0,0 +1,87 @@
+package yfs
+
+import (
+	"testing"
+)
+
+func TestDedupSharesIdenticalBlocks(t *testing.T) {
+	opts := Options{Dedup: true}
+	fs, dir := newTestFS(t, opts)
+	payload := fs.payloadSize()
+	empty := usedBlocks(fs)
+
+	data := testData(8*payload, 1)
+	if err := fs.WriteFile("/a", data); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	if err := fs.WriteFile("/b", data); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("identical file took %d more blocks", got-used)
+	}
+
+	a, b := fileEntry(t, fs, "/a"), fileEntry(t, fs, "/b")
+	for i, blockID := range a.DirectBlockIds {
+		if b.DirectBlockIds[i] != blockID {
+			t.Fatalf("block %d not shared: %d and %d", i, blockID, b.DirectBlockIds[i])
+		}
+		if refs := fs.blockRefs(blockID); refs != 2 {
+			t.Fatalf("block %d has %d references, want 2", blockID, refs)
+		}
+	}
+	expectIntact(t, fs, used)
+
+	// Writing to a shared block gives the writer its own copy
+	patch := []byte("only in b")
+	if err := fs.WriteAt("/b", int64(payload), patch); err != nil {
+		t.Fatal(err)
+	}
+	changed := append([]byte(nil), data...)
+	copy(changed[payload:], patch)
+
+	fs = reopenTestFS(t, fs, dir, opts)
+	defer fs.Close()
+
+	expectFile(t, fs, "/a", data)
+	expectFile(t, fs, "/b", changed)
+	expectCheckClean(t, fs)
+
+	if err := fs.DeleteFile("/a"); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, fs, "/b", changed)
+	if err := fs.DeleteFile("/b"); err != nil {
+		t.Fatal(err)
+	}
+	expectIntact(t, fs, empty)
+}
+
+func TestDedupRejectsCollisions(t *testing.T) {
+	fs, _ := newTestFS(t, Options{Dedup: true})
+	defer fs.Close()
+	payload := fs.payloadSize()
+
+	data := testData(2*payload, 1)
+	if err := fs.WriteFile("/a", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Index a different payload under the key of the first block
+	other := testData(payload, 2)
+	first := fileEntry(t, fs, "/a").DirectBlockIds[0]
+	fs.mutex.Lock()
+	fs.rememberDedupBlock(xxh64(other), first)
+	fs.mutex.Unlock()
+
+	if err := fs.WriteFile("/b", other); err != nil {
+		t.Fatal(err)
+	}
+	if fileEntry(t, fs, "/b").DirectBlockIds[0] == first {
+		t.Fatal("block with a different payload reused")
+	}
+	expectFile(t, fs, "/a", data)
+	expectFile(t, fs, "/b", other)
+}
@@ -0,0 +1,372 @@
+package yfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// errStopWalk stops forEachBlock early without reporting an error
+var errStopWalk = errors.New("stop walk")
+
+// DefragProgress describes how far a defragmentation run has come
+type DefragProgress struct {
+	Path        string // File processed last
+	FilesDone   int    // Files processed so far
+	FilesTotal  int    // Files found when the run started
+	FilesMoved  int    // Files whose blocks were relocated
+	BlocksMoved uint64 // Data and index blocks written to new locations
+}
+
+// Defragment moves the blocks of every file into contiguous runs packed
+// toward the start of blocks.glob
+func (yfs *YFS) Defragment() error {
+	return yfs.DefragmentContext(context.Background(), nil)
+}
+
+// DefragmentContext defragments the file system. Files are visited in the
+// order of their first block; each one whose data blocks are fragmented, or
+// that fits in a free run closer to the start of blocks.glob, is copied into
+// a single contiguous run followed by a fresh index tree of extents.
+//
+// Every file is committed through the journal on its own, so a crash at any
+// point leaves each file either in its old or its new location. The run
+// stops between two files when ctx is cancelled; progress, if not nil, is
+// called after each file.
+func (yfs *YFS) DefragmentContext(ctx context.Context, progress func(DefragProgress)) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
+	paths, err := yfs.filePathsByFirstBlock()
+	if err != nil {
+		return err
+	}
+
+	state := DefragProgress{FilesTotal: len(paths)}
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		moved, err := yfs.defragmentFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to defragment %s: %w", path, err)
+		}
+
+		state.Path = path
+		state.FilesDone++
+		if moved > 0 {
+			state.FilesMoved++
+			state.BlocksMoved += moved
+		}
+
+		if progress != nil {
+			progress(state)
+		}
+	}
+
+	yfs.bitmap.mutex.Lock()
+	yfs.bitmap.searchPos = 0
+	yfs.bitmap.mutex.Unlock()
+
+	return nil
+}
+
+// filePathsByFirstBlock returns the paths of all files, ordered by the
+// first data block they use
+func (yfs *YFS) filePathsByFirstBlock() ([]string, error) {
+	yfs.mutex.RLock()
+	defer yfs.mutex.RUnlock()
+
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	type fileStart struct {
+		path  string
+		first uint32
+	}
+	var files []fileStart
+
+	err := walkFiles(yfs.header.Root, "", func(path string, file *FileEntry) error {
+		first := uint32(NullBlockID)
+		err := yfs.forEachBlock(yfs.fileIndexFor(file), func(_ int64, blockID uint32) error {
+			first = blockID
+			return errStopWalk
+		})
+		if err != nil && err != errStopWalk {
+			return fmt.Errorf("failed to read index of %s: %w", path, err)
+		}
+
+		if first != NullBlockID {
+			files = append(files, fileStart{path: path, first: first})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].first < files[j].first })
+
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.path
+	}
+	return paths, nil
+}
+
+// walkFiles calls fn for every file below dir
+func walkFiles(dir *DirectoryEntry, path string, fn func(path string, file *FileEntry) error) error {
+	for name, file := range dir.Files {
+		if err := fn(path+"/"+name, file); err != nil {
+			return err
+		}
+	}
+
+	for name, subDir := range dir.Directories {
+		if err := walkFiles(subDir, path+"/"+name, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// defragmentFile relocates a file into a contiguous run when that improves
+// its layout, and returns how many blocks were written
+func (yfs *YFS) defragmentFile(path string) (uint64, error) {
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	_, file, isDir, err := yfs.findEntryUnsafe(path)
+	if err != nil || isDir || file == nil {
+		return 0, nil // Removed since the run started
+	}
+
+	// Copying a file would duplicate the blocks it shares with snapshots or clones
+	if shared, err := yfs.fileHasSharedBlocks(file); err != nil || shared {
+		return 0, err
+	}
+
+	positions, blocks, sums, err := yfs.collectFileBlocks(file)
+	if err != nil || len(blocks) == 0 {
+		return 0, err
+	}
+
+	indexBlocks, err := yfs.indexBlocksNeeded(positions)
+	if err != nil {
+		return 0, err
+	}
+
+	dataCount := uint64(len(blocks))
+	needed := dataCount + uint64(indexBlocks)
+	contiguous := file.FirstIndexBlockId == NullBlockID && isContiguousRun(blocks)
+
+	pos, found := yfs.findFreeRun(needed)
+	if contiguous && (!found || pos+1 >= uint64(blocks[0])) {
+		return 0, nil // Already as far forward as it can go
+	}
+
+	newBlocks, err := yfs.reserveRun(pos, found, needed, dataCount)
+	if err != nil {
+		return 0, nil // No room for a contiguous copy, leave the file as it is
+	}
+
+	scratch, err := yfs.copyFileBlocks(file.Inode, positions, blocks, sums, newBlocks)
+	if err != nil {
+		yfs.freeBlocks(newBlocks)
+		return 0, err
+	}
+
+	// Switch the file to the copy and free the old blocks in one operation
+	old := &FileEntry{}
+	adoptFileIndex(old, file)
+	adoptFileIndex(file, scratch)
+
+	moves := make(map[uint32]uint32, len(blocks))
+	for i, blockID := range blocks {
+		moves[blockID] = newBlocks[i]
+	}
+	yfs.moveDedupBlocks(moves)
+
+	yfs.dropFileIndex(file)
+	if err := yfs.releaseFileBlocks(old); err != nil {
+		return 0, err
+	}
+
+	return needed, yfs.commit()
+}
+
+// adoptFileIndex points a file entry at the blocks indexed by another one
+func adoptFileIndex(file, from *FileEntry) {
+	file.FirstIndexBlockId = from.FirstIndexBlockId
+	file.DirectBlockIds = from.DirectBlockIds
+	file.DirectBlockChecksums = from.DirectBlockChecksums
+	file.IndirectBlockIds = from.IndirectBlockIds
+	file.DataBlockCount = from.DataBlockCount
+	file.IndexBlockCount = from.IndexBlockCount
+}
+
+// collectFileBlocks returns the logical positions of a file's allocated
+// blocks, the data blocks holding them and their checksums
+func (yfs *YFS) collectFileBlocks(file *FileEntry) ([]int64, []uint32, [][]byte, error) {
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	var positions []int64
+	var blocks []uint32
+	var sums [][]byte
+
+	idx := yfs.fileIndexFor(file)
+	err := yfs.forEachBlock(idx, func(n int64, blockID uint32) error {
+		sum, err := yfs.blockChecksum(idx, n)
+		if err != nil {
+			return err
+		}
+
+		positions = append(positions, n)
+		blocks = append(blocks, blockID)
+		sums = append(sums, sum)
+		return nil
+	})
+
+	return positions, blocks, sums, err
+}
+
+// indexBlocksNeeded returns how many index blocks a fresh index tree needs
+// to reference the given logical positions
+func (yfs *YFS) indexBlocksNeeded(positions []int64) (int, error) {
+	type node struct {
+		level, depth int
+		prefix       [MaxIndirectLevels]int
+	}
+	nodes := make(map[node]bool)
+
+	for _, n := range positions {
+		level, path, err := yfs.indexPath(n)
+		if err != nil {
+			return 0, err
+		}
+
+		for depth := 0; depth < level; depth++ {
+			key := node{level: level, depth: depth}
+			copy(key.prefix[:], path[:depth])
+			nodes[key] = true
+		}
+	}
+
+	return len(nodes), nil
+}
+
+// isContiguousRun reports whether block IDs follow each other without gaps
+func isContiguousRun(blockIDs []uint32) bool {
+	for i := 1; i < len(blockIDs); i++ {
+		if blockIDs[i] != blockIDs[i-1]+1 {
+			return false
+		}
+	}
+	return true
+}
+
+// findFreeRun returns the lowest bitmap position starting count free blocks
+func (yfs *YFS) findFreeRun(count uint64) (uint64, bool) {
+	yfs.bitmap.mutex.RLock()
+	defer yfs.bitmap.mutex.RUnlock()
+
+	run := uint64(0)
+	for pos := uint64(0); pos < yfs.bitmap.totalBlocks; pos++ {
+		if !yfs.isBlockFree(pos) {
+			run = 0
+			continue
+		}
+
+		run++
+		if run == count {
+			return pos + 1 - count, true
+		}
+	}
+
+	return 0, false
+}
+
+// reserveRun allocates dataCount data blocks at the start of a run of needed
+// free blocks, at pos when found or at the end of a grown volume otherwise.
+// The rest of the run is left free with the search position pointing at it,
+// so the index blocks allocated next land right after the data.
+func (yfs *YFS) reserveRun(pos uint64, found bool, needed, dataCount uint64) ([]uint32, error) {
+	yfs.bitmap.mutex.Lock()
+	defer yfs.bitmap.mutex.Unlock()
+
+	if !found {
+		allocated, err := yfs.allocateBlocksAtEnd(uint32(needed))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, blockID := range allocated[dataCount:] {
+			yfs.markBlockFree(uint64(blockID - 1))
+		}
+		pos = uint64(allocated[0] - 1)
+	}
+
+	blockIDs := make([]uint32, dataCount)
+	for i := range blockIDs {
+		yfs.markBlockUsed(pos + uint64(i))
+		blockIDs[i] = uint32(pos+uint64(i)) + 1 // Block IDs are 1-based
+	}
+
+	yfs.bitmap.searchPos = pos + dataCount
+	yfs.bitmap.dirty = true
+	return blockIDs, nil
+}
+
+// copyFileBlocks copies data blocks to their new locations and builds a
+// fresh index tree for them in a scratch file entry of the owner inode. The recorded checksums
+// move with the blocks, so a block corrupted before the move still fails
+// verification after it.
+func (yfs *YFS) copyFileBlocks(owner uint64, positions []int64, oldBlocks []uint32, sums [][]byte, newBlocks []uint32) (*FileEntry, error) {
+	for i := 0; i < len(oldBlocks); {
+		// Read contiguous runs of the old layout at once
+		count := 1
+		for i+count < len(oldBlocks) && count < MaxBlocksPerRead && oldBlocks[i+count] == oldBlocks[i]+uint32(count) {
+			count++
+		}
+
+		blocks, err := yfs.readFramedRun(oldBlocks[i], uint32(count))
+		if err != nil {
+			return nil, err
+		}
+
+		for j, framed := range blocks {
+			if err := yfs.writeFramedBlock(newBlocks[i+j], framed); err != nil {
+				return nil, err
+			}
+		}
+
+		i += count
+	}
+
+	scratch := &FileEntry{Inode: owner}
+	idx := newFileIndex(scratch)
+	for i, n := range positions {
+		if err := yfs.setBlock(idx, n, newBlocks[i]); err != nil {
+			yfs.truncateIndex(idx, 0)
+			return nil, err
+		}
+		scratch.DataBlockCount++
+
+		if err := yfs.setBlockChecksum(idx, n, sums[i]); err != nil {
+			yfs.truncateIndex(idx, 0)
+			return nil, err
+		}
+	}
+
+	if err := yfs.flushIndex(idx); err != nil {
+		yfs.truncateIndex(idx, 0)
+		return nil, err
+	}
+
+	return scratch, nil
+}
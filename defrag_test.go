@@ -0,0 +1,155 @@
+package yfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// makeFragmentedFiles writes files with interleaved appends, so the data
+// blocks of each one alternate with those of the others
+func makeFragmentedFiles(t *testing.T, fs *YFS, count int) map[string][]byte {
+	t.Helper()
+
+	files := make(map[string][]byte)
+	for i := 0; i < count; i++ {
+		files[fmt.Sprintf("/f%d", i)] = testData(8*fs.payloadSize(), int64(i))
+	}
+
+	chunk := 2 * fs.payloadSize()
+	for off := 0; off < 8*fs.payloadSize(); off += chunk {
+		for path, data := range files {
+			if err := fs.AppendFile(path, data[off:off+chunk]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return files
+}
+
+// isContiguous reports whether the data blocks of a file form a single run
+func isContiguous(t *testing.T, fs *YFS, path string) bool {
+	t.Helper()
+
+	_, blockIDs, _, err := fs.collectFileBlocks(fileEntry(t, fs, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return isContiguousRun(blockIDs)
+}
+
+func TestDefragment(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	files := makeFragmentedFiles(t, fs, 3)
+	for path := range files {
+		if isContiguous(t, fs, path) {
+			t.Fatalf("%s is not fragmented", path)
+		}
+	}
+	used := usedBlocks(fs)
+
+	var updates []DefragProgress
+	if err := fs.DefragmentContext(context.Background(), func(p DefragProgress) {
+		updates = append(updates, p)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) != 3 {
+		t.Fatalf("got %d progress updates for 3 files", len(updates))
+	}
+	last := updates[len(updates)-1]
+	if last.FilesDone != 3 || last.FilesTotal != 3 || last.FilesMoved == 0 || last.BlocksMoved == 0 {
+		t.Fatalf("final progress is %+v", last)
+	}
+
+	for path := range files {
+		if !isContiguous(t, fs, path) {
+			t.Fatalf("%s is still fragmented", path)
+		}
+	}
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("defragmenting changed the used blocks from %d to %d", used, got)
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	for path, data := range files {
+		expectFile(t, fs, path, data)
+	}
+}
+
+func TestDefragmentCancel(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	files := makeFragmentedFiles(t, fs, 3)
+
+	// Cancel once the first file is done
+	ctx, cancel := context.WithCancel(context.Background())
+	done := 0
+	err := fs.DefragmentContext(ctx, func(p DefragProgress) {
+		done = p.FilesDone
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("a cancelled run returned %v", err)
+	}
+	if done != 1 {
+		t.Fatalf("the cancelled run processed %d files", done)
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	for path, data := range files {
+		expectFile(t, fs, path, data)
+	}
+
+	// A later run finishes the job
+	if err := fs.Defragment(); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range files {
+		expectFile(t, fs, path, data)
+		if !isContiguous(t, fs, path) {
+			t.Fatalf("%s is still fragmented", path)
+		}
+	}
+}
+
+func TestDefragmentSkipsSharedFiles(t *testing.T) {
+	fs, _ := newTestFS(t, Options{})
+	files := makeFragmentedFiles(t, fs, 2)
+
+	if err := fs.CreateSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	// Moving the files would copy the blocks they share with the snapshot
+	var last DefragProgress
+	if err := fs.DefragmentContext(context.Background(), func(p DefragProgress) { last = p }); err != nil {
+		t.Fatal(err)
+	}
+	if last.FilesDone != 2 || last.FilesMoved != 0 {
+		t.Fatalf("final progress is %+v", last)
+	}
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("defragmenting changed the used blocks from %d to %d", used, got)
+	}
+	for path, data := range files {
+		expectFile(t, fs, path, data)
+		expectSnapshotFile(t, fs, "s", path, data)
+	}
+
+	if err := fs.DeleteSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Defragment(); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range files {
+		expectFile(t, fs, path, data)
+		if !isContiguous(t, fs, path) {
+			t.Fatalf("%s is still fragmented", path)
+		}
+	}
+}
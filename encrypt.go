@@ -0,0 +1,474 @@
+package yfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	EncryptedMagic       = "YFSE"  // Marks an encrypted metadata file or journal record
+	KeySize              = 32      // AES-256 key size
+	DefaultKDFIterations = 600000  // PBKDF2-HMAC-SHA256 iterations for a new passphrase
+	sealOverhead         = 12 + 16 // GCM nonce and tag stored in every encrypted block
+
+	cipherAES256GCM = 1
+	kdfRawKey       = 0
+	kdfPBKDF2SHA256 = 1
+	saltSize        = 16
+	keyCheckMessage = "yfs key check"
+	dataKeyLabel    = "yfs data key"
+)
+
+var (
+	// ErrKeyRequired is returned when an encrypted file system is opened without a key or passphrase
+	ErrKeyRequired = errors.New("file system is encrypted: a key or passphrase is required")
+
+	// ErrWrongKey is returned when the key or passphrase does not open the file system
+	ErrWrongKey = errors.New("wrong encryption key or passphrase")
+)
+
+// KEK is a key encryption key: a raw 32-byte key, or a passphrase the key is
+// derived from
+type KEK struct {
+	Key        []byte
+	Passphrase string
+}
+
+// keyring holds the keys of an encrypted file system. Snapshot views share
+// the keyring of the file system they were opened from.
+type keyring struct {
+	mutex sync.RWMutex
+	kek   cipher.AEAD   // Seals metadata files and journal records, wraps the data keys
+	data  []cipher.AEAD // Data keys sealing blocks, the current one first
+}
+
+// current returns the data key new blocks are sealed with
+func (keys *keyring) current() cipher.AEAD {
+	keys.mutex.RLock()
+	defer keys.mutex.RUnlock()
+
+	return keys.data[0]
+}
+
+// all returns every data key blocks may be sealed with, the current one first
+func (keys *keyring) all() []cipher.AEAD {
+	keys.mutex.RLock()
+	defer keys.mutex.RUnlock()
+
+	return keys.data
+}
+
+// encrypted reports whether the options ask for an encrypted file system
+func (opts *Options) encrypted() bool {
+	return opts.Passphrase != "" || opts.Key != nil
+}
+
+// kek returns the key encryption key the options give
+func (opts *Options) kek() KEK {
+	return KEK{Key: opts.Key, Passphrase: opts.Passphrase}
+}
+
+// kdfIterations returns the PBKDF2 iterations to derive a new key with
+func (opts *Options) kdfIterations() uint32 {
+	if opts.KDFIterations != 0 {
+		return opts.KDFIterations
+	}
+	return DefaultKDFIterations
+}
+
+// validate checks that a KEK is either a key of the right size or a passphrase
+func (kek KEK) validate() error {
+	if kek.Key != nil && len(kek.Key) != KeySize {
+		return fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(kek.Key))
+	}
+
+	if kek.Key != nil && kek.Passphrase != "" {
+		return fmt.Errorf("set either an encryption key or a passphrase, not both")
+	}
+
+	if kek.Key == nil && kek.Passphrase == "" {
+		return ErrKeyRequired
+	}
+
+	return nil
+}
+
+// newEncryptionParams creates key derivation parameters with a fresh salt
+// for a KEK and returns the cipher of the derived key
+func newEncryptionParams(kek KEK, iterations uint32, metadata bool) (*EncryptionParams, cipher.AEAD, error) {
+	params := &EncryptionParams{
+		Cipher:   cipherAES256GCM,
+		Kdf:      kdfRawKey,
+		Salt:     make([]byte, saltSize),
+		Metadata: metadata,
+	}
+
+	if _, err := rand.Read(params.Salt); err != nil {
+		return nil, nil, err
+	}
+
+	if kek.Passphrase != "" {
+		params.Kdf = kdfPBKDF2SHA256
+		params.Iterations = iterations
+	}
+
+	key, err := deriveKey(params, kek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	params.KeyCheck = keyCheck(aead)
+	return params, aead, nil
+}
+
+// newKeyring creates the keys of a new encrypted file system: a key
+// encryption key derived from the options and a random data key it wraps
+func (yfs *YFS) newKeyring() (*EncryptionParams, *keyring, error) {
+	params, kek, err := newEncryptionParams(yfs.opts.kek(), yfs.opts.kdfIterations(), yfs.opts.EncryptMetadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	yfs.cacheCipher(params, kek)
+
+	wrapped, dataKey, err := newDataKey(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	params.DataKeys = [][]byte{wrapped}
+
+	return params, &keyring{kek: kek, data: []cipher.AEAD{dataKey}}, nil
+}
+
+// deriveKey returns the key a KEK gives for a set of parameters
+func deriveKey(params *EncryptionParams, kek KEK) ([]byte, error) {
+	switch params.Kdf {
+	case kdfRawKey:
+		if kek.Key == nil {
+			return nil, ErrKeyRequired
+		}
+		return kek.Key, nil
+	case kdfPBKDF2SHA256:
+		if kek.Passphrase == "" {
+			return nil, ErrKeyRequired
+		}
+		return pbkdf2SHA256([]byte(kek.Passphrase), params.Salt, int(params.Iterations), KeySize), nil
+	default:
+		return nil, fmt.Errorf("unknown key derivation function: %d", params.Kdf)
+	}
+}
+
+// openKEK derives the key of a set of parameters from a KEK and checks it
+func openKEK(params *EncryptionParams, kek KEK) (cipher.AEAD, []byte, error) {
+	if params.Cipher != cipherAES256GCM {
+		return nil, nil, fmt.Errorf("unknown cipher: %d", params.Cipher)
+	}
+
+	key, err := deriveKey(params, kek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if subtle.ConstantTimeCompare(keyCheck(aead), params.KeyCheck) != 1 {
+		return nil, nil, ErrWrongKey
+	}
+
+	return aead, key, nil
+}
+
+// cipherFor returns the key encryption key described by a set of
+// parameters, deriving it from the options once
+func (yfs *YFS) cipherFor(params *EncryptionParams) (cipher.AEAD, error) {
+	if aead, exists := yfs.ciphers[cipherCacheKey(params)]; exists {
+		return aead, nil
+	}
+
+	aead, _, err := openKEK(params, yfs.opts.kek())
+	if err != nil {
+		return nil, err
+	}
+
+	yfs.cacheCipher(params, aead)
+	return aead, nil
+}
+
+// cacheCipher remembers the key encryption key of a set of parameters
+func (yfs *YFS) cacheCipher(params *EncryptionParams, aead cipher.AEAD) {
+	if yfs.ciphers == nil {
+		yfs.ciphers = make(map[string]cipher.AEAD)
+	}
+	yfs.ciphers[cipherCacheKey(params)] = aead
+}
+
+// cipherCacheKey identifies the key derived from a set of parameters
+func cipherCacheKey(params *EncryptionParams) string {
+	return fmt.Sprintf("%d/%d/%x", params.Kdf, params.Iterations, params.Salt)
+}
+
+// newAEAD creates an AES-GCM cipher
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyCheck returns the value that tells a right key from a wrong one
+func keyCheck(aead cipher.AEAD) []byte {
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), nil, []byte(keyCheckMessage))
+}
+
+// newDataKey creates a random data key and returns it wrapped by a key
+// encryption key
+func newDataKey(kek cipher.AEAD) ([]byte, cipher.AEAD, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := wrapKey(kek, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return wrapped, aead, nil
+}
+
+// wrapKey seals a data key with a key encryption key
+func wrapKey(kek cipher.AEAD, key []byte) ([]byte, error) {
+	nonce := make([]byte, kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return kek.Seal(nonce, nonce, key, []byte(dataKeyLabel)), nil
+}
+
+// unwrapKey opens a data key sealed by wrapKey
+func unwrapKey(kek cipher.AEAD, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < kek.NonceSize() {
+		return nil, fmt.Errorf("truncated data key")
+	}
+
+	key, err := kek.Open(nil, wrapped[:kek.NonceSize()], wrapped[kek.NonceSize():], []byte(dataKeyLabel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	return key, nil
+}
+
+// blockOverhead returns the bytes of every block taken by encryption
+func (yfs *YFS) blockOverhead() int {
+	if yfs.keys == nil {
+		return 0
+	}
+	return sealOverhead
+}
+
+// sealBlock encrypts the plain contents of a block with the current data
+// key. The block ID is authenticated with it, so a block copied to another
+// position fails to open.
+func (yfs *YFS) sealBlock(blockID uint32, plain []byte) ([]byte, error) {
+	aead := yfs.keys.current()
+
+	nonce := make([]byte, aead.NonceSize(), int(yfs.blockSize))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plain, binary.LittleEndian.AppendUint32(nil, blockID)), nil
+}
+
+// openBlock decrypts the raw contents of a block. While a data key rotation
+// is in progress, blocks not re-encrypted yet open with an older key. Blocks
+// that were never written read back as zeros and hold an empty payload.
+func (yfs *YFS) openBlock(blockID uint32, blockData []byte) ([]byte, error) {
+	if isZero(blockData) {
+		return make([]byte, len(blockData)-sealOverhead), nil
+	}
+
+	ad := binary.LittleEndian.AppendUint32(nil, blockID)
+	var err error
+	for _, aead := range yfs.keys.all() {
+		var plain []byte
+		nonceSize := aead.NonceSize()
+		if plain, err = aead.Open(nil, blockData[:nonceSize], blockData[nonceSize:], ad); err == nil {
+			return plain, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to decrypt block %d: %w", blockID, err)
+}
+
+// sealMetadata encrypts a metadata file or journal record with the key
+// encryption key. The parameters are stored in front of the ciphertext so it
+// can be opened on its own.
+func (yfs *YFS) sealMetadata(data []byte) ([]byte, error) {
+	params, err := proto.Marshal(yfs.header.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	kek := yfs.keys.kek
+	sealed := make([]byte, 8, 8+len(params)+sealOverhead+len(data))
+	copy(sealed, EncryptedMagic)
+	binary.LittleEndian.PutUint32(sealed[4:8], uint32(len(params)))
+	sealed = append(sealed, params...)
+
+	nonce := make([]byte, kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed = append(sealed, nonce...)
+	return kek.Seal(sealed, nonce, data, sealed[:8+len(params)]), nil
+}
+
+// isSealed reports whether data was written by sealMetadata
+func isSealed(data []byte) bool {
+	return len(data) >= 8 && string(data[:4]) == EncryptedMagic
+}
+
+// openMetadata decrypts data written by sealMetadata
+func (yfs *YFS) openMetadata(data []byte) ([]byte, error) {
+	paramsLength := binary.LittleEndian.Uint32(data[4:8])
+	if uint64(len(data)-8) < uint64(paramsLength)+sealOverhead {
+		return nil, fmt.Errorf("truncated encrypted data")
+	}
+
+	params := &EncryptionParams{}
+	if err := proto.Unmarshal(data[8:8+paramsLength], params); err != nil {
+		return nil, fmt.Errorf("invalid encryption parameters: %w", err)
+	}
+
+	aead, err := yfs.cipherFor(params)
+	if err != nil {
+		return nil, err
+	}
+
+	ad := data[:8+paramsLength]
+	nonce := data[8+paramsLength : 8+int(paramsLength)+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[8+int(paramsLength)+aead.NonceSize():], ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	return plain, nil
+}
+
+// sealMetadataFile encrypts a root copy or bitmap when metadata encryption is on
+func (yfs *YFS) sealMetadataFile(data []byte) ([]byte, error) {
+	if yfs.keys == nil || !yfs.header.Encryption.GetMetadata() {
+		return data, nil
+	}
+	return yfs.sealMetadata(data)
+}
+
+// loadKeys sets up the keyring of a loaded file system from its header.
+// File systems without wrapped data keys seal blocks with the derived key.
+func (yfs *YFS) loadKeys() error {
+	params := yfs.header.Encryption
+	if params == nil {
+		if yfs.opts.encrypted() {
+			return fmt.Errorf("file system is not encrypted")
+		}
+		return nil
+	}
+
+	if yfs.opts.EncryptMetadata && !params.Metadata {
+		return fmt.Errorf("metadata encryption mismatch: requested, file system does not encrypt metadata")
+	}
+
+	kek, err := yfs.cipherFor(params)
+	if err != nil {
+		return err
+	}
+
+	keys := &keyring{kek: kek}
+	if len(params.DataKeys) == 0 {
+		keys.data = []cipher.AEAD{kek}
+	}
+
+	for _, wrapped := range params.DataKeys {
+		key, err := unwrapKey(kek, wrapped)
+		if err != nil {
+			return err
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		keys.data = append(keys.data, aead)
+	}
+
+	yfs.keys = keys
+	return nil
+}
+
+// isKeyError reports whether an error means the key or passphrase is missing or wrong
+func isKeyError(err error) bool {
+	return errors.Is(err, ErrKeyRequired) || errors.Is(err, ErrWrongKey)
+}
+
+// isZero reports whether every byte of data is zero
+func isZero(data []byte) bool {
+	return len(bytes.Trim(data, "\x00")) == 0
+}
+
+// pbkdf2SHA256 derives a key from a password with PBKDF2-HMAC-SHA256 (RFC 8018)
+func pbkdf2SHA256(password, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLength := prf.Size()
+	blocks := (keyLength + hashLength - 1) / hashLength
+
+	key := make([]byte, 0, blocks*hashLength)
+	u := make([]byte, hashLength)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, uint32(block)))
+		u = prf.Sum(u[:0])
+
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLength]
+}
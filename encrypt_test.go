@@ -0,0 +1,105 @@
+package yfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encryptedOptions keeps key derivation cheap so tests stay fast
+func encryptedOptions(passphrase string) Options {
+	return Options{Passphrase: passphrase, KDFIterations: 1000, EncryptMetadata: true}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	keyed := Options{Key: bytes.Repeat([]byte{7}, KeySize)}
+	for name, opts := range map[string]Options{"passphrase": encryptedOptions("correct horse"), "key": keyed} {
+		t.Run(name, func(t *testing.T) {
+			fs, dir := newTestFS(t, opts)
+			data := testData(3*int(fs.GetBlockSize())+17, 1)
+			if err := fs.WriteFile("/secret", data); err != nil {
+				t.Fatal(err)
+			}
+
+			fs = reopenTestFS(t, fs, dir, opts)
+			defer fs.Close()
+			expectFile(t, fs, "/secret", data)
+			if err := fs.VerifyIntegrity(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	opts := encryptedOptions("correct horse")
+	fs, dir := newTestFS(t, opts)
+	if err := fs.WriteFile("/secret", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewWithOptions(dir, encryptedOptions("battery staple")); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("wrong passphrase opened the file system: %v", err)
+	}
+	if _, err := NewWithOptions(dir, Options{Key: make([]byte, KeySize)}); err == nil {
+		t.Fatal("a raw key opened a passphrase-encrypted file system")
+	}
+	if _, err := NewWithOptions(dir, Options{}); !errors.Is(err, ErrKeyRequired) {
+		t.Fatalf("opened without a passphrase: %v", err)
+	}
+
+	// A failed open must leave the file system intact for the right passphrase
+	fs = openTestFS(t, dir, opts)
+	defer fs.Close()
+	expectFile(t, fs, "/secret", []byte("hello"))
+}
+
+func TestEncryptedBlocksUnreadable(t *testing.T) {
+	fs, dir := newTestFS(t, encryptedOptions("correct horse"))
+	marker := bytes.Repeat([]byte("plaintext marker "), 200)
+	if err := fs.WriteFile("/visible-name", marker); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"blocks.glob", "root.yfs", "bitmap.yfs", "journal.yfs"} {
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("plaintext marker")) || bytes.Contains(raw, []byte("visible-name")) {
+			t.Fatalf("%s holds plaintext", name)
+		}
+	}
+}
+
+func TestEncryptionOptionsMismatch(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWithOptions(dir, encryptedOptions("correct horse")); err == nil {
+		t.Fatal("a passphrase opened an unencrypted file system")
+	}
+
+	invalid := []Options{
+		{Key: make([]byte, KeySize-1)},
+		{Key: make([]byte, KeySize), Passphrase: "both"},
+		{EncryptMetadata: true},
+	}
+	for _, opts := range invalid {
+		if _, err := NewWithOptions(t.TempDir(), opts); err == nil {
+			t.Fatalf("%+v was accepted", opts)
+		}
+	}
+}
@@ -0,0 +1,920 @@
+package yfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File is an open handle to a file stored in YFS. It implements io.Reader,
+// io.Writer, io.Seeker, io.ReaderAt, io.WriterAt and io.Closer, so large
+// files can be streamed without holding their whole contents in memory.
+//
+// Data blocks are resolved lazily through the file's index and new blocks
+// are allocated as bytes are written to positions that have none yet.
+// Positions without a block are holes: they read as zeros and take no space,
+// and SeekData and SeekHole find where they start and end. Metadata changes
+// made through a File are persisted by Sync and Close.
+type File struct {
+	fs     *YFS
+	path   string
+	flag   int
+	offset int64
+	dirty  bool // Whether the file entry changed since the last sync
+	closed bool
+	mutex  sync.Mutex
+}
+
+const maxAllocationRun = 1 << 16 // Maximum blocks requested by a single allocation
+
+// ErrNoData is returned by SeekData and SeekHole for an offset at or past the
+// end of the file, and by SeekData when only holes follow the offset
+var ErrNoData = errors.New("no data at or past offset")
+
+// Open opens a file for reading
+func (yfs *YFS) Open(path string) (*File, error) {
+	return yfs.OpenFile(path, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates a file and opens it for reading and writing
+func (yfs *YFS) Create(path string) (*File, error) {
+	return yfs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// OpenFile opens a file with the given os.O_* flags. If the file does not
+// exist and os.O_CREATE is set, it is created with permissions perm.
+func (yfs *YFS) OpenFile(path string, flag int, perm os.FileMode) (*File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable || flag&os.O_CREATE != 0 {
+		if err := yfs.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	_, file, isDir, err := yfs.findEntryUnsafe(path)
+	if err != nil && flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+
+	if isDir && file == nil {
+		return nil, fmt.Errorf("path is a directory: %s", path)
+	}
+
+	changed := false
+
+	if file == nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, fmt.Errorf("file not found: %s", path)
+		}
+
+		saved := yfs.save()
+		if _, err := yfs.createFileEntryUnsafe(path, uint32(perm.Perm())); err != nil {
+			yfs.restore(saved)
+			return nil, err
+		}
+		changed = true
+	} else {
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, fmt.Errorf("file already exists: %s", path)
+		}
+
+		if flag&os.O_TRUNC != 0 && writable && file.Size > 0 {
+			saved := yfs.save()
+			if err := yfs.truncateFileUnsafe(file); err != nil {
+				yfs.restore(saved)
+				return nil, err
+			}
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := yfs.commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &File{
+		fs:   yfs,
+		path: path,
+		flag: flag,
+	}, nil
+}
+
+// createFileEntryUnsafe creates an empty file entry, creating missing parent directories
+func (yfs *YFS) createFileEntryUnsafe(path string, permissions uint32) (*FileEntry, error) {
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	fileName := pathParts[len(pathParts)-1]
+	if fileName == "" {
+		return nil, fmt.Errorf("invalid file path: %s", path)
+	}
+
+	parentPath := strings.Join(pathParts[:len(pathParts)-1], "/")
+	if err := yfs.createDirectoryChain(parentPath); err != nil {
+		return nil, err
+	}
+
+	parentDir, _, _, err := yfs.findEntryUnsafe(parentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	file := &FileEntry{
+		Metadata: &FileMetadata{
+			Name:        fileName,
+			ModTime:     now,
+			CreateTime:  now,
+			Permissions: permissions,
+		},
+		Inode: yfs.newInode(),
+	}
+	yfs.updateMetadataChecksum(file.Metadata)
+
+	if parentDir.Files == nil {
+		parentDir.Files = make(map[string]*FileEntry)
+	}
+	parentDir.Files[fileName] = file
+
+	return file, nil
+}
+
+// truncateFileUnsafe frees all blocks of a file and resets its size to zero
+func (yfs *YFS) truncateFileUnsafe(file *FileEntry) error {
+	if err := yfs.releaseFileBlocks(file); err != nil {
+		return err
+	}
+
+	file.Size = 0
+	file.Metadata.ModTime = time.Now().Unix()
+	yfs.updateMetadataChecksum(file.Metadata)
+
+	return nil
+}
+
+// truncateUnsafe changes the size of a file. Shrinking frees the trailing data
+// and index blocks, including blocks reserved by Fallocate, and growing
+// leaves a hole.
+func (yfs *YFS) truncateUnsafe(file *FileEntry, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative size: %d", size)
+	}
+
+	if size > file.Size {
+		return yfs.writeAtUnsafe(file, nil, size)
+	}
+
+	if size == 0 {
+		return yfs.truncateFileUnsafe(file)
+	}
+
+	if isInline(file) {
+		file.InlineData = file.InlineData[:size]
+		file.Size = size
+		file.Metadata.ModTime = time.Now().Unix()
+		return nil
+	}
+
+	if file.Compression != 0 {
+		return yfs.truncateCompressedUnsafe(file, size)
+	}
+
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	idx := yfs.fileIndexFor(file)
+	keep := int64(yfs.dataBlocksFor(size))
+	if err := yfs.truncateIndex(idx, keep); err != nil {
+		return err
+	}
+
+	// Drop the bytes past the new end from the tail block
+	if size < file.Size {
+		tailBlockID, err := yfs.lookupBlock(idx, keep-1)
+		if err != nil {
+			return err
+		}
+
+		if tailBlockID != NullBlockID {
+			tail, err := yfs.readBlock(tailBlockID)
+			if err != nil {
+				return err
+			}
+
+			if err := yfs.verifyBlock(idx, keep-1, tailBlockID, tail); err != nil {
+				return err
+			}
+
+			tailSize := size - (keep-1)*int64(yfs.payloadSize())
+			if int64(len(tail)) > tailSize {
+				if tailBlockID, err = yfs.unshareDataBlock(idx, keep-1, tailBlockID); err != nil {
+					return err
+				}
+
+				if err := yfs.writeBlock(tailBlockID, idx.file.Inode, tail[:tailSize]); err != nil {
+					return err
+				}
+
+				if err := yfs.setBlockChecksum(idx, keep-1, yfs.dataChecksum.sum(tail[:tailSize])); err != nil {
+					return err
+				}
+
+				if err := yfs.flushIndex(idx); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	file.Size = size
+	file.Metadata.ModTime = time.Now().Unix()
+
+	return nil
+}
+
+// fallocateUnsafe reserves data blocks for the first size bytes of a file
+// without changing its size. Each run of missing blocks is allocated with a
+// single request so it is contiguous whenever the bitmap allows it.
+func (yfs *YFS) fallocateUnsafe(file *FileEntry, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative size: %d", size)
+	}
+
+	if file.Compression != 0 {
+		return fmt.Errorf("cannot preallocate a compressed file")
+	}
+
+	if err := yfs.moveInlineToBlocks(file); err != nil {
+		return err
+	}
+
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	idx := yfs.fileIndexFor(file)
+	if err := yfs.upgradeLegacyIndex(idx); err != nil {
+		return err
+	}
+
+	blocks := int64(yfs.dataBlocksFor(size))
+	for n := int64(0); n < blocks; {
+		blockID, err := yfs.lookupBlock(idx, n)
+		if err != nil {
+			return err
+		}
+
+		if blockID != NullBlockID {
+			n++
+			continue
+		}
+
+		blockIDs, err := yfs.allocateRun(idx, n, blocks)
+		if err != nil {
+			return err
+		}
+
+		// Reused blocks still hold the payload of their previous owner; an
+		// empty one reads as zeros once the file grows over the block
+		for _, blockID := range blockIDs {
+			if err := yfs.writeBlock(blockID, idx.file.Inode, nil); err != nil {
+				return err
+			}
+		}
+		n += int64(len(blockIDs))
+	}
+
+	return yfs.flushIndex(idx)
+}
+
+// Name returns the path the file was opened with
+func (f *File) Name() string {
+	return f.path
+}
+
+// Read reads up to len(p) bytes from the current offset
+func (f *File) Read(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.checkReadable(); err != nil {
+		return 0, err
+	}
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at offset off. It does not move the
+// file offset.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.checkReadable(); err != nil {
+		return 0, err
+	}
+
+	return f.readAt(p, off)
+}
+
+// Write writes len(p) bytes at the current offset. Files opened with
+// os.O_APPEND always write at the end of the file.
+func (f *File) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		end, err := f.appendData(p)
+		if err != nil {
+			return 0, err
+		}
+		f.offset = end
+		return len(p), nil
+	}
+
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes len(p) bytes starting at offset off. It does not move the
+// file offset and is not allowed on files opened with os.O_APPEND.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		return 0, fmt.Errorf("invalid use of WriteAt on file opened with O_APPEND: %s", f.path)
+	}
+
+	return f.writeAt(p, off)
+}
+
+// Seek sets the offset for the next Read or Write
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = f.offset
+	case io.SeekEnd:
+		f.fs.mutex.RLock()
+		file, err := f.entry()
+		f.fs.mutex.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+		base = file.Size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+
+	if base+offset < 0 {
+		return 0, fmt.Errorf("negative seek offset: %d", base+offset)
+	}
+
+	f.offset = base + offset
+	return f.offset, nil
+}
+
+// SeekData sets the offset for the next Read or Write to the start of the
+// first region holding data at or after offset, and returns it. Holes are
+// tracked per block, so the result is offset itself or the start of a block.
+func (f *File) SeekData(offset int64) (int64, error) {
+	return f.seekRegion(offset, true)
+}
+
+// SeekHole sets the offset for the next Read or Write to the start of the
+// first hole at or after offset, and returns it. The end of the file counts
+// as a hole, so a file without holes returns its size.
+func (f *File) SeekHole(offset int64) (int64, error) {
+	return f.seekRegion(offset, false)
+}
+
+// seekRegion moves the offset to the next data region or hole
+func (f *File) seekRegion(offset int64, data bool) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative seek offset: %d", offset)
+	}
+
+	f.fs.mutex.RLock()
+	defer f.fs.mutex.RUnlock()
+
+	file, err := f.entry()
+	if err != nil {
+		return 0, err
+	}
+
+	pos, err := f.fs.nextRegion(file, offset, data)
+	if err != nil {
+		return 0, err
+	}
+
+	f.offset = pos
+	return pos, nil
+}
+
+// Truncate changes the size of the file
+func (f *File) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	file, err := f.entry()
+	if err != nil {
+		return err
+	}
+
+	saved := f.fs.save()
+	if err := f.fs.truncateUnsafe(file, size); err != nil {
+		f.fs.restore(saved)
+		return withPath(err, f.path)
+	}
+
+	f.dirty = true
+	return nil
+}
+
+// Stat returns information about the file
+func (f *File) Stat() (*FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+
+	return f.fs.GetFileInfo(f.path)
+}
+
+// Sync persists the file's metadata and the block bitmap
+func (f *File) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	return f.sync()
+}
+
+// Close syncs pending changes and releases the handle
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	err := f.sync()
+	f.closed = true
+
+	f.fs.mutex.RLock()
+	if file, entryErr := f.entry(); entryErr == nil {
+		f.fs.dropFileIndex(file)
+	}
+	f.fs.mutex.RUnlock()
+
+	return err
+}
+
+// sync persists the file entry if it changed
+func (f *File) sync() error {
+	if !f.dirty {
+		return nil
+	}
+
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if file, err := f.entry(); err == nil {
+		f.fs.updateMetadataChecksum(file.Metadata)
+	}
+
+	if err := f.fs.commit(); err != nil {
+		return err
+	}
+
+	f.dirty = false
+	return nil
+}
+
+// checkReadable verifies the handle is open for reading
+func (f *File) checkReadable() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	if f.flag&os.O_WRONLY != 0 {
+		return fmt.Errorf("file not open for reading: %s", f.path)
+	}
+
+	return nil
+}
+
+// checkWritable verifies the handle is open for writing
+func (f *File) checkWritable() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fmt.Errorf("file not open for writing: %s", f.path)
+	}
+
+	return nil
+}
+
+// entry looks up the file entry behind the handle. The caller must hold the
+// file system lock.
+func (f *File) entry() (*FileEntry, error) {
+	_, file, isDir, err := f.fs.findEntryUnsafe(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if isDir || file == nil {
+		return nil, fmt.Errorf("file not found: %s", f.path)
+	}
+
+	return file, nil
+}
+
+// readAt reads from the file without touching the handle offset
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	f.fs.mutex.RLock()
+	defer f.fs.mutex.RUnlock()
+
+	file, err := f.entry()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := f.fs.readAtUnsafe(file, p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, withPath(err, f.path)
+}
+
+// writeAt writes to the file without touching the handle offset
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	file, err := f.entry()
+	if err != nil {
+		return 0, err
+	}
+
+	saved := f.fs.save()
+	if err := f.fs.writeAtUnsafe(file, p, off); err != nil {
+		f.fs.restore(saved)
+		return 0, withPath(err, f.path)
+	}
+
+	f.dirty = true
+	return len(p), nil
+}
+
+// appendData writes to the end of the file and returns the new file size
+func (f *File) appendData(p []byte) (int64, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	file, err := f.entry()
+	if err != nil {
+		return 0, err
+	}
+
+	saved := f.fs.save()
+	if err := f.fs.writeAtUnsafe(file, p, file.Size); err != nil {
+		f.fs.restore(saved)
+		return 0, withPath(err, f.path)
+	}
+
+	f.dirty = true
+	return file.Size, nil
+}
+
+// readAtUnsafe reads up to len(p) bytes of a file starting at off
+func (yfs *YFS) readAtUnsafe(file *FileEntry, p []byte, off int64) (int, error) {
+	if off >= file.Size {
+		return 0, nil
+	}
+
+	want := int64(len(p))
+	if want > file.Size-off {
+		want = file.Size - off
+	}
+
+	if isInline(file) {
+		return copy(p[:want], file.InlineData[off:]), nil
+	}
+
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	idx := yfs.fileIndexFor(file)
+	if file.Compression != 0 {
+		return yfs.readCompressedAt(idx, p[:want], off)
+	}
+	return yfs.readBlocksAt(idx, p[:want], off)
+}
+
+// readBlocksAt reads len(p) bytes stored in a file's data blocks starting at
+// off. Runs of physically contiguous blocks are fetched with a single
+// sequential read. The caller must hold indexMutex.
+func (yfs *YFS) readBlocksAt(idx *fileIndex, p []byte, off int64) (int, error) {
+	payloadSize := int64(yfs.payloadSize())
+	want := int64(len(p))
+
+	n := int64(0)
+	for n < want {
+		pos := off + n
+		first := pos / payloadSize
+		last := (off + want - 1) / payloadSize
+
+		startBlockID, err := yfs.lookupBlock(idx, first)
+		if err != nil {
+			return int(n), err
+		}
+
+		// Unallocated positions read as zeros
+		if startBlockID == NullBlockID {
+			end := min((first+1)*payloadSize-off, want)
+			clear(p[n:end])
+			n = end
+			continue
+		}
+
+		// Collect the run of physically contiguous blocks starting here
+		count := int64(1)
+		for first+count <= last && count < MaxBlocksPerRead {
+			blockID, err := yfs.lookupBlock(idx, first+count)
+			if err != nil {
+				return int(n), err
+			}
+			if blockID != startBlockID+uint32(count) {
+				break
+			}
+			count++
+		}
+
+		blocks, err := yfs.readBlockRun(startBlockID, uint32(count))
+		if err != nil {
+			return int(n), err
+		}
+
+		for i, data := range blocks {
+			if err := yfs.verifyBlock(idx, first+int64(i), startBlockID+uint32(i), data); err != nil {
+				return int(n), err
+			}
+
+			blockStart := (first + int64(i)) * payloadSize
+			blockEnd := min(blockStart+payloadSize-off, want)
+			if blockOffset := off + n - blockStart; blockOffset < int64(len(data)) {
+				n += int64(copy(p[n:blockEnd], data[blockOffset:]))
+			}
+
+			// Bytes past the payload were never written, like blocks reserved
+			// by Fallocate or the tail of a file grown past its last block
+			clear(p[n:blockEnd])
+			n = blockEnd
+		}
+	}
+
+	return int(n), nil
+}
+
+// writeAtUnsafe writes data into a file at offset off. Allocated data blocks
+// are rewritten in place and blocks are allocated for positions that have
+// none yet. A gap between the end of the file and off is left as a hole.
+func (yfs *YFS) writeAtUnsafe(file *FileEntry, data []byte, off int64) error {
+	if written, err := yfs.writeInlineUnsafe(file, data, off); written || err != nil {
+		return err
+	}
+
+	if file.Compression != 0 {
+		return yfs.writeCompressedAtUnsafe(file, data, off)
+	}
+
+	if len(data) == 0 {
+		if off > file.Size {
+			file.Size = off
+			file.Metadata.ModTime = time.Now().Unix()
+		}
+		return nil
+	}
+
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	idx := yfs.fileIndexFor(file)
+	if err := yfs.upgradeLegacyIndex(idx); err != nil {
+		return err
+	}
+
+	payloadSize := int64(yfs.payloadSize())
+	end := off + int64(len(data))
+	lastBlock := (end - 1) / payloadSize
+	fresh := int64(0) // Positions before fresh were allocated by this write and hold nothing yet
+
+	for pos := off; pos < end; {
+		n := pos / payloadSize
+		blockStart := n * payloadSize
+		blockOffset := pos - blockStart
+		count := min(payloadSize-blockOffset, end-pos)
+		chunk := data[pos-off : pos-off+count]
+
+		blockID, err := yfs.lookupBlock(idx, n)
+		if err != nil {
+			return err
+		}
+
+		if blockID == NullBlockID {
+			blockIDs, err := yfs.allocateRun(idx, n, lastBlock+1)
+			if err != nil {
+				return err
+			}
+			blockID = blockIDs[0]
+			fresh = n + int64(len(blockIDs))
+		} else if n >= fresh && (blockOffset != 0 || count != payloadSize) && blockStart < file.Size {
+			// Merge a partial write with the bytes already in the block
+			current, err := yfs.readBlock(blockID)
+			if err != nil {
+				return err
+			}
+
+			if err := yfs.verifyBlock(idx, n, blockID, current); err != nil {
+				return err
+			}
+			current = current[:min(int64(len(current)), file.Size-blockStart)]
+
+			merged := make([]byte, max(int64(len(current)), blockOffset+count))
+			copy(merged, current)
+			copy(merged[blockOffset:], chunk)
+			chunk = merged
+			blockOffset = 0
+		}
+
+		if blockOffset != 0 {
+			chunk = append(make([]byte, blockOffset), chunk...)
+		}
+
+		// Blocks shared with a snapshot or a clone are copied on write
+		if blockID, err = yfs.unshareDataBlock(idx, n, blockID); err != nil {
+			return err
+		}
+
+		if err := yfs.writeBlock(blockID, idx.file.Inode, chunk); err != nil {
+			return err
+		}
+
+		if err := yfs.setBlockChecksum(idx, n, yfs.dataChecksum.sum(chunk)); err != nil {
+			return err
+		}
+
+		pos += count
+	}
+
+	if err := yfs.flushIndex(idx); err != nil {
+		return err
+	}
+
+	if end > file.Size {
+		file.Size = end
+	}
+	file.Metadata.ModTime = time.Now().Unix()
+
+	return nil
+}
+
+// allocateRun allocates data blocks for the unallocated positions starting at
+// logical block n and ending before limit or at the next allocated position.
+// The blocks are requested at once so they are contiguous whenever possible.
+// It returns the blocks allocated, starting with the one for position n.
+func (yfs *YFS) allocateRun(idx *fileIndex, n, limit int64) ([]uint32, error) {
+	count := int64(1)
+	for n+count < limit && count < maxAllocationRun {
+		blockID, err := yfs.lookupBlock(idx, n+count)
+		if err != nil {
+			return nil, err
+		}
+		if blockID != NullBlockID {
+			break
+		}
+		count++
+	}
+
+	blockIDs, err := yfs.allocateBlocks(uint32(count))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, blockID := range blockIDs {
+		if err := yfs.setBlock(idx, n+int64(i), blockID); err != nil {
+			yfs.freeBlocks(blockIDs[i:])
+			return nil, err
+		}
+		idx.file.DataBlockCount++
+	}
+
+	return blockIDs, nil
+}
+
+// nextRegion returns the first offset at or after off that holds data, or
+// with data false the first offset of a hole. Inline files, and compressed
+// files stored in chunks that do not line up with file offsets, have no holes.
+func (yfs *YFS) nextRegion(file *FileEntry, off int64, data bool) (int64, error) {
+	if off >= file.Size {
+		return 0, ErrNoData
+	}
+
+	if isInline(file) || file.Compression != 0 {
+		if data {
+			return off, nil
+		}
+		return file.Size, nil
+	}
+
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	payloadSize := int64(yfs.payloadSize())
+	next := off / payloadSize // First position not known to be allocated
+	found := false
+
+	err := yfs.forEachBlock(yfs.fileIndexFor(file), func(n int64, _ uint32) error {
+		switch {
+		case n < next:
+			return nil
+		case data:
+			next, found = n, true
+			return errStopWalk
+		case n == next:
+			next++
+			return nil
+		default:
+			return errStopWalk // The hole starts at next
+		}
+	})
+	if err != nil && err != errStopWalk {
+		return 0, err
+	}
+
+	pos := max(off, next*payloadSize)
+	if data && (!found || pos >= file.Size) {
+		return 0, ErrNoData
+	}
+	return min(pos, file.Size), nil
+}
@@ -0,0 +1,344 @@
+package yfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestFileSeekReadWrite(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	f, err := fs.Create("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := testData(10000, 1)
+	if n, err := f.Write(want); err != nil || n != len(want) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+
+	if pos, err := f.Seek(0, io.SeekStart); err != nil || pos != 0 {
+		t.Fatalf("Seek(0, SeekStart) = %d, %v", pos, err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("ReadAll returned %d bytes, %v", len(got), err)
+	}
+
+	// Overwrite a range crossing a block boundary
+	patch := testData(3000, 2)
+	if _, err := f.WriteAt(patch, 3000); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[3000:], patch)
+
+	if pos, err := f.Seek(-100, io.SeekEnd); err != nil || pos != 9900 {
+		t.Fatalf("Seek(-100, SeekEnd) = %d, %v", pos, err)
+	}
+	if pos, err := f.Seek(-900, io.SeekCurrent); err != nil || pos != 9000 {
+		t.Fatalf("Seek(-900, SeekCurrent) = %d, %v", pos, err)
+	}
+	tail := make([]byte, 2000)
+	if n, err := f.Read(tail); err != nil || n != 1000 || !bytes.Equal(tail[:n], want[9000:]) {
+		t.Fatalf("Read at 9000 = %d, %v", n, err)
+	}
+	if _, err := f.Read(tail); err != io.EOF {
+		t.Fatalf("Read at EOF returned %v, want io.EOF", err)
+	}
+
+	buf := make([]byte, 4000)
+	if n, err := f.ReadAt(buf, 2500); err != nil || !bytes.Equal(buf[:n], want[2500:6500]) {
+		t.Fatalf("ReadAt(2500) = %d, %v", n, err)
+	}
+
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("seeking before the start succeeded")
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(want); err != os.ErrClosed {
+		t.Fatalf("Write after Close returned %v, want os.ErrClosed", err)
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/f", want)
+}
+
+func TestFileOpenFlags(t *testing.T) {
+	fs, _ := newTestFS(t, Options{})
+
+	if _, err := fs.Open("/missing"); err == nil {
+		t.Fatal("opening a missing file succeeded")
+	}
+
+	f, err := fs.Create("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.OpenFile("/f", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+		t.Fatal("O_EXCL opened an existing file")
+	}
+
+	r, err := fs.Open("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("x")); err == nil {
+		t.Fatal("a read-only handle accepted a write")
+	}
+	r.Close()
+
+	w, err := fs.OpenFile("/f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Read(make([]byte, 1)); err == nil {
+		t.Fatal("a write-only handle allowed a read")
+	}
+	w.Close()
+
+	// O_TRUNC drops the contents
+	f, err = fs.Create("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	expectFile(t, fs, "/f", []byte{})
+}
+
+func TestFileWritesInvisibleBeforeSync(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	f, err := fs.Create("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := testData(6000, 1)
+	if _, err := f.Write(want); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance only sees what was saved when the file was created
+	expectFile(t, openTestFS(t, dir, Options{}), "/f", []byte{})
+
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, openTestFS(t, dir, Options{}), "/f", want)
+
+	if _, err := f.WriteAt([]byte("changed"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	copy(want, "changed")
+	expectFile(t, openTestFS(t, dir, Options{}), "/f", want)
+}
+
+func TestFileAppend(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	want := testData(3000, 1)
+	if err := fs.AppendFile("/log", want); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile("/log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seeking does not move where an append handle writes
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	more := testData(5000, 2)
+	if _, err := f.Write(more); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, more...)
+	if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != int64(len(want)) {
+		t.Fatalf("offset after an append is %d, %v, want %d", pos, err, len(want))
+	}
+
+	if _, err := f.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatal("WriteAt succeeded on an O_APPEND handle")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	more = testData(200, 3)
+	if err := fs.AppendFile("/log", more); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, more...)
+
+	if err := fs.CreateDirectory("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.AppendFile("/dir", []byte("x")); err == nil {
+		t.Fatal("appending to a directory succeeded")
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/log", want)
+}
+
+func TestFileTruncate(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	f, err := fs.Create("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testData(9000, 1)
+	if _, err := f.Write(want); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(100); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := f.Stat(); err != nil || info.Size != 100 {
+		t.Fatalf("Stat after Truncate = %v, %v", info, err)
+	}
+
+	// The offset is left past the end, so the next write leaves a zero gap
+	if _, err := f.Write([]byte("end")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want = append(append(want[:100], make([]byte, 8900)...), "end"...)
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/f", want)
+}
+
+func TestSparseFile(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	payload := int64(fs.payloadSize())
+	if err := fs.WriteFile("/s", nil); err != nil {
+		t.Fatal(err)
+	}
+	empty := usedBlocks(fs)
+
+	// Writing far past the end allocates only the blocks written to
+	if err := fs.WriteAt("/s", 1000*payload+5, []byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs) - empty; got > 3 {
+		t.Fatalf("a write after a 1000 block gap took %d blocks", got)
+	}
+	used := usedBlocks(fs)
+
+	// Growing leaves a hole as well
+	size := 4000 * payload
+	if err := fs.Truncate("/s", size); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("growing the file changed the used blocks from %d to %d", used, got)
+	}
+
+	want := make([]byte, size)
+	copy(want[1000*payload+5:], "tail")
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	defer fs.Close()
+	expectFile(t, fs, "/s", want)
+	if err := fs.VerifyIntegrity(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeekDataHole(t *testing.T) {
+	fs, _ := newTestFS(t, Options{})
+	defer fs.Close()
+	payload := int64(fs.payloadSize())
+
+	// Data in blocks 0 and 5, holes in blocks 1-4 and from block 6 to the end
+	if err := fs.WriteFile("/s", testData(int(payload), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteAt("/s", 5*payload, testData(int(payload), 2)); err != nil {
+		t.Fatal(err)
+	}
+	size := 9*payload + 7
+	if err := fs.Truncate("/s", size); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open("/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tests := []struct {
+		offset int64
+		data   bool
+		want   int64
+	}{
+		{0, true, 0},
+		{10, true, 10},
+		{0, false, payload},
+		{payload + 3, false, payload + 3},
+		{payload + 3, true, 5 * payload},
+		{5 * payload, false, 6 * payload},
+		{size - 1, false, size - 1},
+	}
+	for _, tt := range tests {
+		seek, name := f.SeekHole, "SeekHole"
+		if tt.data {
+			seek, name = f.SeekData, "SeekData"
+		}
+
+		got, err := seek(tt.offset)
+		if err != nil || got != tt.want {
+			t.Fatalf("%s(%d) = %d, %v, want %d", name, tt.offset, got, err, tt.want)
+		}
+		if pos, _ := f.Seek(0, io.SeekCurrent); pos != tt.want {
+			t.Fatalf("%s(%d) left the offset at %d, want %d", name, tt.offset, pos, tt.want)
+		}
+	}
+
+	// Only holes follow block 6, and nothing follows the end of the file
+	for _, offset := range []int64{6 * payload, size, size + 1} {
+		if _, err := f.SeekData(offset); err != ErrNoData {
+			t.Fatalf("SeekData(%d) returned %v, want ErrNoData", offset, err)
+		}
+	}
+	if _, err := f.SeekHole(size); err != ErrNoData {
+		t.Fatalf("SeekHole at the end returned %v, want ErrNoData", err)
+	}
+
+	// The end of a file without holes counts as its only hole
+	if err := fs.WriteFile("/full", testData(3*int(payload)+1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	full, err := fs.Open("/full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer full.Close()
+	if got, err := full.SeekHole(0); err != nil || got != 3*payload+1 {
+		t.Fatalf("SeekHole on a file without holes = %d, %v, want its size", got, err)
+	}
+}
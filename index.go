@@ -0,0 +1,811 @@
+package yfs
+
+import (
+	"fmt"
+)
+
+const (
+	NumDirectBlocks   = 12 // Data block IDs stored directly in a FileEntry
+	MaxIndirectLevels = 4  // Depth of the deepest indirect tree of a FileEntry
+
+	maxReferenceSize   = 5  // Worst-case varint size of a block reference
+	indexBlockOverhead = 22 // Worst-case size of the IndexBlock fields around the references
+	checksumsOverhead  = 4  // Tag and length of IndexBlock.data_checksums
+)
+
+// fileIndex is the in-memory view of a file's block index. Files written by
+// this version use an ext-style tree: the first NumDirectBlocks data blocks
+// are referenced from the FileEntry itself and the following ones through
+// single, double, triple and quadruple indirect index blocks, so locating any
+// logical block takes at most MaxIndirectLevels index block reads. Files
+// written by older versions keep their linked IndexBlock chain until they are
+// modified.
+//
+// Index blocks are loaded lazily and cached; modified ones are written back
+// by flushIndex.
+type fileIndex struct {
+	file  *FileEntry
+	nodes map[uint32][]uint32 // Decoded references of loaded index blocks
+	sums  map[uint32][]byte   // Packed data checksums of loaded index blocks
+	dirty map[uint32]bool     // Index blocks modified since the last flush
+	chain *indexChain         // Legacy chain view, loaded on first access
+}
+
+// indexChain is a lazily loaded view of a legacy IndexBlock chain
+type indexChain struct {
+	indexIDs []uint32 // Index block IDs loaded so far
+	dataIDs  []uint32 // Data block IDs referenced by the loaded index blocks
+	next     uint32   // Next index block to load, NullBlockID once fully loaded
+}
+
+// indexCapacity returns how many block references fit in one index block.
+// Every reference is assumed to take its worst-case varint size, plus the
+// size of its data checksum, so a full index block always fits whatever
+// block IDs it holds.
+func (yfs *YFS) indexCapacity() int {
+	size := yfs.dataChecksum.size()
+	if size == 0 {
+		return (yfs.payloadSize() - indexBlockOverhead) / maxReferenceSize
+	}
+	return (yfs.payloadSize() - indexBlockOverhead - checksumsOverhead) / (maxReferenceSize + size)
+}
+
+// newFileIndex creates an empty index view for a file
+func newFileIndex(file *FileEntry) *fileIndex {
+	return &fileIndex{
+		file:  file,
+		nodes: make(map[uint32][]uint32),
+		sums:  make(map[uint32][]byte),
+		dirty: make(map[uint32]bool),
+	}
+}
+
+// fileIndexFor returns the cached index of a file. The caller must hold indexMutex.
+func (yfs *YFS) fileIndexFor(file *FileEntry) *fileIndex {
+	idx, exists := yfs.indexes[file]
+	if !exists {
+		idx = newFileIndex(file)
+		yfs.indexes[file] = idx
+	}
+
+	return idx
+}
+
+// dropFileIndex forgets the cached index of a file
+func (yfs *YFS) dropFileIndex(file *FileEntry) {
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	delete(yfs.indexes, file)
+}
+
+// indexNode returns the decoded references of an index block
+func (yfs *YFS) indexNode(idx *fileIndex, blockID uint32) ([]uint32, error) {
+	if entries, exists := idx.nodes[blockID]; exists {
+		return entries, nil
+	}
+
+	indexBlock, err := yfs.readIndexBlock(blockID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := expandIndexBlock(indexBlock)
+	if len(entries) > yfs.indexCapacity() {
+		return nil, fmt.Errorf("index block %d holds %d references, max: %d", blockID, len(entries), yfs.indexCapacity())
+	}
+
+	idx.nodes[blockID] = entries
+	idx.sums[blockID] = indexBlock.DataChecksums
+	return entries, nil
+}
+
+// expandIndexBlock returns the references of an index block one block at a time
+func expandIndexBlock(indexBlock *IndexBlock) []uint32 {
+	entries := append([]uint32(nil), indexBlock.BlockIds...)
+	for _, extent := range indexBlock.Extents {
+		for i := uint32(0); i < extent.BlockCount; i++ {
+			if extent.StartBlockId == NullBlockID {
+				entries = append(entries, NullBlockID)
+			} else {
+				entries = append(entries, extent.StartBlockId+i)
+			}
+		}
+	}
+
+	return entries
+}
+
+// indexPath locates logical block n in the index tree. It returns the
+// indirect level holding the block (0 for direct blocks) and the reference
+// to follow at each index block from the top of that tree down to the leaf.
+func (yfs *YFS) indexPath(n int64) (int, []int, error) {
+	if n < NumDirectBlocks {
+		return 0, []int{int(n)}, nil
+	}
+	n -= NumDirectBlocks
+
+	capacity := int64(yfs.indexCapacity())
+	span := int64(1)
+	for level := 1; level <= MaxIndirectLevels; level++ {
+		span *= capacity
+		if n < span {
+			path := make([]int, level)
+			for i := level - 1; i >= 0; i-- {
+				path[i] = int(n % capacity)
+				n /= capacity
+			}
+			return level, path, nil
+		}
+		n -= span
+	}
+
+	return 0, nil, fmt.Errorf("file too large: block position exceeds the index capacity")
+}
+
+// lookupBlock returns the data block holding logical block n, or NullBlockID
+// when that position is not allocated
+func (yfs *YFS) lookupBlock(idx *fileIndex, n int64) (uint32, error) {
+	file := idx.file
+
+	if file.FirstIndexBlockId != NullBlockID {
+		return yfs.legacyBlockAt(idx, n)
+	}
+
+	level, path, err := yfs.indexPath(n)
+	if err != nil {
+		return NullBlockID, err
+	}
+
+	if level == 0 {
+		if path[0] < len(file.DirectBlockIds) {
+			return file.DirectBlockIds[path[0]], nil
+		}
+		return NullBlockID, nil
+	}
+
+	if level > len(file.IndirectBlockIds) {
+		return NullBlockID, nil
+	}
+
+	blockID := file.IndirectBlockIds[level-1]
+	for _, slot := range path {
+		if blockID == NullBlockID {
+			return NullBlockID, nil
+		}
+
+		entries, err := yfs.indexNode(idx, blockID)
+		if err != nil {
+			return NullBlockID, err
+		}
+
+		if slot >= len(entries) {
+			return NullBlockID, nil
+		}
+		blockID = entries[slot]
+	}
+
+	return blockID, nil
+}
+
+// setBlock points logical block n at a data block, allocating the index
+// blocks on the way down when they do not exist yet
+func (yfs *YFS) setBlock(idx *fileIndex, n int64, blockID uint32) error {
+	file := idx.file
+
+	level, path, err := yfs.indexPath(n)
+	if err != nil {
+		return err
+	}
+
+	if level == 0 {
+		for len(file.DirectBlockIds) <= path[0] {
+			file.DirectBlockIds = append(file.DirectBlockIds, NullBlockID)
+		}
+		file.DirectBlockIds[path[0]] = blockID
+		return nil
+	}
+
+	for len(file.IndirectBlockIds) < level {
+		file.IndirectBlockIds = append(file.IndirectBlockIds, NullBlockID)
+	}
+
+	parent, parentSlot := uint32(NullBlockID), 0
+	current := file.IndirectBlockIds[level-1]
+
+	// link points the parent reference at a new index block
+	link := func(blockID uint32) {
+		if parent == NullBlockID {
+			file.IndirectBlockIds[level-1] = blockID
+		} else {
+			idx.nodes[parent][parentSlot] = blockID
+			idx.dirty[parent] = true
+		}
+	}
+
+	for depth, slot := range path {
+		if current == NullBlockID {
+			indexBlockIDs, err := yfs.allocateBlocks(1)
+			if err != nil {
+				return err
+			}
+			current = indexBlockIDs[0]
+
+			idx.nodes[current] = nil
+			idx.dirty[current] = true
+			file.IndexBlockCount++
+			link(current)
+		} else if yfs.isSharedBlock(current) {
+			if current, err = yfs.unshareIndexBlock(idx, current); err != nil {
+				return err
+			}
+			link(current)
+		}
+
+		entries, err := yfs.indexNode(idx, current)
+		if err != nil {
+			return err
+		}
+
+		if slot >= len(entries) {
+			entries = append(entries, make([]uint32, slot+1-len(entries))...)
+			idx.nodes[current] = entries
+		}
+
+		if depth == len(path)-1 {
+			entries[slot] = blockID
+			idx.dirty[current] = true
+			return nil
+		}
+
+		parent, parentSlot = current, slot
+		current = entries[slot]
+	}
+
+	return nil
+}
+
+// leafSlot locates the reference to logical block n: the index block holding
+// it (NullBlockID for direct blocks or unallocated positions) and its slot
+func (yfs *YFS) leafSlot(idx *fileIndex, n int64) (uint32, int, error) {
+	level, path, err := yfs.indexPath(n)
+	if err != nil {
+		return NullBlockID, 0, err
+	}
+
+	if level == 0 {
+		return NullBlockID, path[0], nil
+	}
+
+	if level > len(idx.file.IndirectBlockIds) {
+		return NullBlockID, 0, nil
+	}
+
+	blockID := idx.file.IndirectBlockIds[level-1]
+	for _, slot := range path[:len(path)-1] {
+		if blockID == NullBlockID {
+			return NullBlockID, 0, nil
+		}
+
+		entries, err := yfs.indexNode(idx, blockID)
+		if err != nil {
+			return NullBlockID, 0, err
+		}
+
+		if slot >= len(entries) {
+			return NullBlockID, 0, nil
+		}
+		blockID = entries[slot]
+	}
+
+	return blockID, path[len(path)-1], nil
+}
+
+// setBlockChecksum records the data checksum of logical block n, which must
+// already be set in the index. A nil checksum leaves the position unchecked.
+func (yfs *YFS) setBlockChecksum(idx *fileIndex, n int64, sum []byte) error {
+	if yfs.dataChecksum.size() == 0 || idx.file.FirstIndexBlockId != NullBlockID {
+		return nil
+	}
+
+	if sum == nil {
+		sum = make([]byte, yfs.dataChecksum.size())
+	}
+
+	if n < NumDirectBlocks {
+		idx.file.DirectBlockChecksums = yfs.putChecksum(idx.file.DirectBlockChecksums, int(n), sum)
+		return nil
+	}
+
+	leaf, slot, err := yfs.leafSlot(idx, n)
+	if err != nil {
+		return err
+	}
+	if leaf == NullBlockID {
+		return fmt.Errorf("logical block %d is not indexed", n)
+	}
+
+	idx.sums[leaf] = yfs.putChecksum(idx.sums[leaf], slot, sum)
+	idx.dirty[leaf] = true
+	return nil
+}
+
+// blockChecksum returns the checksum recorded for logical block n, or nil
+// when none was recorded
+func (yfs *YFS) blockChecksum(idx *fileIndex, n int64) ([]byte, error) {
+	if yfs.dataChecksum.size() == 0 || idx.file.FirstIndexBlockId != NullBlockID {
+		return nil, nil
+	}
+
+	if n < NumDirectBlocks {
+		return yfs.checksumAt(idx.file.DirectBlockChecksums, int(n)), nil
+	}
+
+	leaf, slot, err := yfs.leafSlot(idx, n)
+	if err != nil || leaf == NullBlockID {
+		return nil, err
+	}
+
+	if _, err := yfs.indexNode(idx, leaf); err != nil {
+		return nil, err
+	}
+	return yfs.checksumAt(idx.sums[leaf], slot), nil
+}
+
+// flushIndex writes the modified index blocks of a file back to disk
+func (yfs *YFS) flushIndex(idx *fileIndex) error {
+	for blockID := range idx.dirty {
+		if err := yfs.writeIndexBlock(blockID, idx.file.Inode, yfs.newIndexBlock(idx.nodes[blockID], idx.sums[blockID])); err != nil {
+			return err
+		}
+		delete(idx.dirty, blockID)
+	}
+
+	return nil
+}
+
+// truncateIndex frees every data block at logical position keep or later,
+// together with the index blocks that no longer reference anything
+func (yfs *YFS) truncateIndex(idx *fileIndex, keep int64) error {
+	file := idx.file
+	var freed []uint32
+
+	if file.FirstIndexBlockId != NullBlockID {
+		if err := yfs.upgradeLegacyIndex(idx); err != nil {
+			return err
+		}
+	}
+
+	// Direct blocks
+	for i := keep; i < int64(len(file.DirectBlockIds)); i++ {
+		if file.DirectBlockIds[i] != NullBlockID {
+			freed = append(freed, file.DirectBlockIds[i])
+		}
+	}
+	if keep < int64(len(file.DirectBlockIds)) {
+		file.DirectBlockIds = file.DirectBlockIds[:keep]
+	}
+	file.DirectBlockChecksums = yfs.trimChecksums(file.DirectBlockChecksums, len(file.DirectBlockIds))
+
+	// Indirect trees
+	capacity := int64(yfs.indexCapacity())
+	base, span := int64(NumDirectBlocks), int64(1)
+	for level := 1; level <= len(file.IndirectBlockIds); level++ {
+		span *= capacity
+		root := file.IndirectBlockIds[level-1]
+
+		if root != NullBlockID {
+			if keep <= base {
+				freed = yfs.freeIndexSubtree(idx, root, level, freed)
+				file.IndirectBlockIds[level-1] = NullBlockID
+			} else if keep < base+span {
+				var err error
+				if file.IndirectBlockIds[level-1], freed, err = yfs.trimIndexSubtree(idx, root, level, keep-base, freed); err != nil {
+					return err
+				}
+			}
+		}
+
+		base += span
+	}
+
+	for len(file.IndirectBlockIds) > 0 && file.IndirectBlockIds[len(file.IndirectBlockIds)-1] == NullBlockID {
+		file.IndirectBlockIds = file.IndirectBlockIds[:len(file.IndirectBlockIds)-1]
+	}
+
+	if err := yfs.flushIndex(idx); err != nil {
+		return err
+	}
+
+	file.DataBlockCount -= uint32(len(freed))
+	return yfs.releaseBlocks(freed)
+}
+
+// trimIndexSubtree frees the references at relative position keep or later
+// below an index block of the given depth. Freed data block IDs are appended
+// to freed. A shared index block is copied first; the block that now holds
+// the trimmed references is returned.
+func (yfs *YFS) trimIndexSubtree(idx *fileIndex, blockID uint32, depth int, keep int64, freed []uint32) (uint32, []uint32, error) {
+	blockID, err := yfs.unshareIndexBlock(idx, blockID)
+	if err != nil {
+		return blockID, freed, err
+	}
+
+	entries, err := yfs.indexNode(idx, blockID)
+	if err != nil {
+		return blockID, freed, err
+	}
+
+	childSpan := int64(1)
+	for i := 1; i < depth; i++ {
+		childSpan *= int64(yfs.indexCapacity())
+	}
+
+	for i, child := range entries {
+		childBase := int64(i) * childSpan
+		if child == NullBlockID || childBase+childSpan <= keep {
+			continue
+		}
+
+		switch {
+		case depth == 1:
+			freed = append(freed, child)
+			entries[i] = NullBlockID
+		case childBase >= keep:
+			freed = yfs.freeIndexSubtree(idx, child, depth-1, freed)
+			entries[i] = NullBlockID
+		default:
+			if entries[i], freed, err = yfs.trimIndexSubtree(idx, child, depth-1, keep-childBase, freed); err != nil {
+				return blockID, freed, err
+			}
+		}
+	}
+
+	for len(entries) > 0 && entries[len(entries)-1] == NullBlockID {
+		entries = entries[:len(entries)-1]
+	}
+	idx.nodes[blockID] = entries
+	idx.dirty[blockID] = true
+	if depth == 1 {
+		idx.sums[blockID] = yfs.trimChecksums(idx.sums[blockID], len(entries))
+	}
+
+	return blockID, freed, nil
+}
+
+// freeIndexSubtree releases an index block and everything below it. Data
+// block IDs are appended to freed, index blocks are released right away.
+// Unreadable index blocks are skipped so a damaged file can still be deleted.
+func (yfs *YFS) freeIndexSubtree(idx *fileIndex, blockID uint32, depth int, freed []uint32) []uint32 {
+	entries, err := yfs.indexNode(idx, blockID)
+	if err == nil {
+		for _, child := range entries {
+			if child == NullBlockID {
+				continue
+			}
+
+			if depth == 1 {
+				freed = append(freed, child)
+			} else {
+				freed = yfs.freeIndexSubtree(idx, child, depth-1, freed)
+			}
+		}
+	}
+
+	delete(idx.nodes, blockID)
+	delete(idx.sums, blockID)
+	delete(idx.dirty, blockID)
+	idx.file.IndexBlockCount--
+	yfs.releaseBlocks([]uint32{blockID})
+
+	return freed
+}
+
+// forEachBlock calls fn for every allocated logical block of a file, in
+// position order
+func (yfs *YFS) forEachBlock(idx *fileIndex, fn func(n int64, blockID uint32) error) error {
+	file := idx.file
+
+	if file.FirstIndexBlockId != NullBlockID {
+		for n := int64(0); ; n++ {
+			blockID, err := yfs.legacyBlockAt(idx, n)
+			if err != nil || blockID == NullBlockID {
+				return err
+			}
+
+			if err := fn(n, blockID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, blockID := range file.DirectBlockIds {
+		if blockID == NullBlockID {
+			continue
+		}
+
+		if err := fn(int64(i), blockID); err != nil {
+			return err
+		}
+	}
+
+	var walk func(blockID uint32, depth int, base, span int64) error
+	walk = func(blockID uint32, depth int, base, span int64) error {
+		entries, err := yfs.indexNode(idx, blockID)
+		if err != nil {
+			return err
+		}
+
+		childSpan := span / int64(yfs.indexCapacity())
+		for i, child := range entries {
+			if child == NullBlockID {
+				continue
+			}
+
+			if depth == 1 {
+				err = fn(base+int64(i), child)
+			} else {
+				err = walk(child, depth-1, base+int64(i)*childSpan, childSpan)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	capacity := int64(yfs.indexCapacity())
+	base, span := int64(NumDirectBlocks), int64(1)
+	for level, blockID := range file.IndirectBlockIds {
+		span *= capacity
+		if blockID != NullBlockID {
+			if err := walk(blockID, level+1, base, span); err != nil {
+				return err
+			}
+		}
+		base += span
+	}
+
+	return nil
+}
+
+// forEachFileBlock calls fn for every data and index block a file uses
+func (yfs *YFS) forEachFileBlock(file *FileEntry, fn func(blockID uint32) error) error {
+	if file.FirstIndexBlockId != NullBlockID {
+		chain := &indexChain{next: file.FirstIndexBlockId}
+		for chain.next != NullBlockID {
+			if err := yfs.loadNextIndexBlock(chain); err != nil {
+				return err
+			}
+		}
+
+		for _, blockID := range append(chain.indexIDs, chain.dataIDs...) {
+			if err := fn(blockID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	idx := newFileIndex(file)
+
+	var walk func(blockID uint32, depth int) error
+	walk = func(blockID uint32, depth int) error {
+		if err := fn(blockID); err != nil {
+			return err
+		}
+
+		entries, err := yfs.indexNode(idx, blockID)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range entries {
+			if child == NullBlockID {
+				continue
+			}
+
+			if depth == 1 {
+				err = fn(child)
+			} else {
+				err = walk(child, depth-1)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, blockID := range file.DirectBlockIds {
+		if blockID == NullBlockID {
+			continue
+		}
+
+		if err := fn(blockID); err != nil {
+			return err
+		}
+	}
+
+	for level, blockID := range file.IndirectBlockIds {
+		if blockID == NullBlockID {
+			continue
+		}
+
+		if err := walk(blockID, level+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseFileBlocks releases every data and index block of a file. Blocks
+// shared with other file trees are only freed once nothing references them.
+func (yfs *YFS) releaseFileBlocks(file *FileEntry) error {
+	yfs.indexMutex.Lock()
+	defer yfs.indexMutex.Unlock()
+
+	if file.FirstIndexBlockId != NullBlockID {
+		if err := yfs.freeFileBlocks(file.FirstIndexBlockId); err != nil {
+			return err
+		}
+		file.FirstIndexBlockId = NullBlockID
+	}
+
+	if err := yfs.truncateIndex(yfs.fileIndexFor(file), 0); err != nil {
+		return err
+	}
+
+	delete(yfs.indexes, file)
+	file.DirectBlockIds = nil
+	file.DirectBlockChecksums = nil
+	file.IndirectBlockIds = nil
+	file.DataBlockCount = 0
+	file.IndexBlockCount = 0
+	file.ChunkSizes = nil
+	file.StoredSize = 0
+	file.InlineData = nil
+
+	return nil
+}
+
+// upgradeLegacyIndex moves a file indexed by a linked IndexBlock chain onto
+// the index tree. Data blocks stay where they are; only the index blocks of
+// the old chain are freed.
+func (yfs *YFS) upgradeLegacyIndex(idx *fileIndex) error {
+	file := idx.file
+	if file.FirstIndexBlockId == NullBlockID {
+		return nil
+	}
+
+	chain := &indexChain{next: file.FirstIndexBlockId}
+	for chain.next != NullBlockID {
+		if err := yfs.loadNextIndexBlock(chain); err != nil {
+			return err
+		}
+	}
+
+	file.FirstIndexBlockId = NullBlockID
+	file.IndexBlockCount = 0
+	file.DataBlockCount = uint32(len(chain.dataIDs))
+	idx.chain = nil
+
+	for i, blockID := range chain.dataIDs {
+		if err := yfs.setBlock(idx, int64(i), blockID); err != nil {
+			return err
+		}
+	}
+
+	if err := yfs.flushIndex(idx); err != nil {
+		return err
+	}
+
+	return yfs.releaseBlocks(chain.indexIDs)
+}
+
+// legacyBlockAt returns the n-th data block of a file indexed by a legacy chain
+func (yfs *YFS) legacyBlockAt(idx *fileIndex, n int64) (uint32, error) {
+	if idx.chain == nil {
+		idx.chain = &indexChain{next: idx.file.FirstIndexBlockId}
+	}
+
+	chain := idx.chain
+	for n >= int64(len(chain.dataIDs)) {
+		if chain.next == NullBlockID {
+			return NullBlockID, nil
+		}
+
+		if err := yfs.loadNextIndexBlock(chain); err != nil {
+			return NullBlockID, err
+		}
+	}
+
+	return chain.dataIDs[n], nil
+}
+
+// loadNextIndexBlock loads the next index block of a legacy chain
+func (yfs *YFS) loadNextIndexBlock(chain *indexChain) error {
+	indexBlock, err := yfs.readIndexBlock(chain.next)
+	if err != nil {
+		return err
+	}
+
+	chain.indexIDs = append(chain.indexIDs, chain.next)
+	chain.dataIDs = append(chain.dataIDs, expandIndexBlock(indexBlock)...)
+	chain.next = indexBlock.NextIndexBlockId
+
+	return nil
+}
+
+// verifyFileIndex verifies the integrity of a file's index blocks
+func (yfs *YFS) verifyFileIndex(file *FileEntry) error {
+	if file.FirstIndexBlockId != NullBlockID {
+		return yfs.verifyFileIndexBlocks(file.FirstIndexBlockId)
+	}
+
+	visitedBlocks := make(map[uint32]bool)
+
+	var verifyNode func(blockID uint32, depth int) error
+	verifyNode = func(blockID uint32, depth int) error {
+		if blockID > uint32(yfs.bitmap.totalBlocks) {
+			return fmt.Errorf("invalid index block ID %d", blockID)
+		}
+
+		// Check for circular references
+		if visitedBlocks[blockID] {
+			return fmt.Errorf("index block %d referenced more than once", blockID)
+		}
+		visitedBlocks[blockID] = true
+
+		indexBlock, err := yfs.readIndexBlock(blockID)
+		if err != nil {
+			return fmt.Errorf("failed to read index block %d: %w", blockID, err)
+		}
+
+		entries := expandIndexBlock(indexBlock)
+		if len(entries) > yfs.indexCapacity() {
+			return fmt.Errorf("index block %d holds %d references, max: %d", blockID, len(entries), yfs.indexCapacity())
+		}
+
+		for _, child := range entries {
+			if child == NullBlockID {
+				continue
+			}
+
+			if depth > 1 {
+				if err := verifyNode(child, depth-1); err != nil {
+					return err
+				}
+			} else if child > uint32(yfs.bitmap.totalBlocks) {
+				return fmt.Errorf("invalid data block ID %d in index block %d", child, blockID)
+			}
+		}
+
+		return nil
+	}
+
+	for _, blockID := range file.DirectBlockIds {
+		if blockID > uint32(yfs.bitmap.totalBlocks) {
+			return fmt.Errorf("invalid direct data block ID %d", blockID)
+		}
+	}
+
+	if len(file.IndirectBlockIds) > MaxIndirectLevels {
+		return fmt.Errorf("too many indirect index levels: %d", len(file.IndirectBlockIds))
+	}
+
+	for level, blockID := range file.IndirectBlockIds {
+		if blockID == NullBlockID {
+			continue
+		}
+
+		if err := verifyNode(blockID, level+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
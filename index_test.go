@@ -0,0 +1,164 @@
+package yfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// makeLegacyFile stores data as a file indexed by a linked IndexBlock chain,
+// the way versions before the index tree wrote files, with perIndex data
+// blocks referenced from each index block
+func makeLegacyFile(t *testing.T, fs *YFS, path string, data []byte, perIndex int) {
+	t.Helper()
+
+	payloadSize := fs.payloadSize()
+	dataIDs, err := fs.allocateBlocks(fs.dataBlocksFor(int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, blockID := range dataIDs {
+		if err := fs.writeBlock(blockID, 0, data[i*payloadSize:min((i+1)*payloadSize, len(data))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexIDs, err := fs.allocateBlocks(uint32((len(dataIDs) + perIndex - 1) / perIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, blockID := range indexIDs {
+		indexBlock := &IndexBlock{BlockIds: dataIDs[i*perIndex : min((i+1)*perIndex, len(dataIDs))]}
+		if i+1 < len(indexIDs) {
+			indexBlock.NextIndexBlockId = indexIDs[i+1]
+		}
+		if err := fs.writeIndexBlock(blockID, 0, indexBlock); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := fs.createFileEntryUnsafe(path, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.FirstIndexBlockId = indexIDs[0]
+	file.Size = int64(len(data))
+	file.DataBlockCount = uint32(len(dataIDs))
+	file.IndexBlockCount = uint32(len(indexIDs))
+
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexPath(t *testing.T) {
+	fs := &YFS{blockSize: 128, header: &FileSystemHeader{Version: FormatVersion}}
+	capacity := int64(fs.indexCapacity())
+
+	tests := []struct {
+		n     int64
+		level int
+		path  []int
+	}{
+		{0, 0, []int{0}},
+		{NumDirectBlocks - 1, 0, []int{NumDirectBlocks - 1}},
+		{NumDirectBlocks, 1, []int{0}},
+		{NumDirectBlocks + capacity - 1, 1, []int{int(capacity - 1)}},
+		{NumDirectBlocks + capacity, 2, []int{0, 0}},
+		{NumDirectBlocks + capacity + capacity + 3, 2, []int{1, 3}},
+		{NumDirectBlocks + capacity + capacity*capacity, 3, []int{0, 0, 0}},
+	}
+	for _, test := range tests {
+		level, path, err := fs.indexPath(test.n)
+		if err != nil || level != test.level || len(path) != len(test.path) {
+			t.Fatalf("indexPath(%d) = %d, %v, %v", test.n, level, path, err)
+		}
+		for i := range path {
+			if path[i] != test.path[i] {
+				t.Fatalf("indexPath(%d) = %v, want %v", test.n, path, test.path)
+			}
+		}
+	}
+
+	limit := int64(NumDirectBlocks)
+	for level, span := 1, int64(1); level <= MaxIndirectLevels; level++ {
+		span *= capacity
+		limit += span
+	}
+	if _, _, err := fs.indexPath(limit); err == nil {
+		t.Fatal("a position past the quadruple indirect tree was accepted")
+	}
+}
+
+func TestIndexTreeLevels(t *testing.T) {
+	opts := Options{BlockSize: MinBlockSize, InitialBlocks: 16384}
+	fs, dir := newTestFS(t, opts)
+	empty := usedBlocks(fs)
+
+	// Enough blocks to reach into the triple indirect tree
+	capacity := fs.indexCapacity()
+	blocks := NumDirectBlocks + capacity + capacity*capacity + 10
+	want := testData(blocks*fs.payloadSize(), 1)
+	if err := fs.AppendFile("/f", want); err != nil {
+		t.Fatal(err)
+	}
+
+	file := fileEntry(t, fs, "/f")
+	if len(file.IndirectBlockIds) < 3 || file.IndirectBlockIds[2] == NullBlockID {
+		t.Fatalf("a %d-block file has indirect roots %v", blocks, file.IndirectBlockIds)
+	}
+
+	fs = reopenTestFS(t, fs, dir, opts)
+	expectFile(t, fs, "/f", want)
+
+	// Reads crossing from each level into the next
+	f, err := fs.Open("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{NumDirectBlocks, NumDirectBlocks + capacity, NumDirectBlocks + capacity + capacity*capacity} {
+		off := int64(n*fs.payloadSize() - 50)
+		buf := make([]byte, 100)
+		if _, err := f.ReadAt(buf, off); err != nil || !bytes.Equal(buf, want[off:off+100]) {
+			t.Fatalf("ReadAt(%d) = %v", off, err)
+		}
+	}
+	f.Close()
+
+	// Shrinking into the direct blocks frees every index block
+	if err := fs.Truncate("/f", 100); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, fs, "/f", want[:100])
+	if got := usedBlocks(fs); got != empty+1 {
+		t.Fatalf("a one-block file holds %d blocks", got-empty)
+	}
+}
+
+func TestLegacyChainUpgrade(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	want := testData(5*fs.payloadSize()+100, 1)
+	makeLegacyFile(t, fs, "/legacy", want, 2)
+	used := usedBlocks(fs)
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/legacy", want)
+
+	// The first write moves the file onto the tree and frees the chain
+	patch := testData(300, 2)
+	if err := fs.WriteAt("/legacy", 4000, patch); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[4000:], patch)
+
+	file := fileEntry(t, fs, "/legacy")
+	if file.FirstIndexBlockId != NullBlockID || len(file.DirectBlockIds) != 6 {
+		t.Fatalf("the upgraded file keeps chain %d and %d direct blocks", file.FirstIndexBlockId, len(file.DirectBlockIds))
+	}
+	if got := usedBlocks(fs); got != used-3 {
+		t.Fatalf("the upgrade left %d blocks used, want %d", got, used-3)
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/legacy", want)
+}
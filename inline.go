@@ -0,0 +1,76 @@
+package yfs
+
+import "time"
+
+// Files no larger than the inline size keep their contents in
+// FileEntry.inline_data and use no blocks at all. Writes that grow an inline
+// file past the inline size move its contents into data blocks first; the
+// file then stays in blocks, even if it shrinks again.
+
+// inlineSize returns the largest file kept inline, 0 when no file is. When
+// only blocks are encrypted the root is stored in plain text, so every file
+// is kept in blocks.
+func (yfs *YFS) inlineSize() int64 {
+	if yfs.opts.InlineSize < 0 || (yfs.keys != nil && !yfs.header.Encryption.GetMetadata()) {
+		return 0
+	}
+
+	if yfs.opts.InlineSize == 0 {
+		return DefaultInlineSize
+	}
+	return int64(yfs.opts.InlineSize)
+}
+
+// isInline reports whether a file's contents are kept in its entry
+func isInline(file *FileEntry) bool {
+	return len(file.InlineData) > 0
+}
+
+// hasBlocks reports whether a file references any data or index block
+func hasBlocks(file *FileEntry) bool {
+	return file.FirstIndexBlockId != NullBlockID || file.DataBlockCount > 0 || file.IndexBlockCount > 0
+}
+
+// writeInlineUnsafe writes into a file that has no blocks and reports
+// whether it did. The file is kept inline if it fits in the inline size;
+// otherwise an inline file is moved to blocks and the caller writes it there.
+func (yfs *YFS) writeInlineUnsafe(file *FileEntry, data []byte, off int64) (bool, error) {
+	if hasBlocks(file) {
+		return false, nil
+	}
+
+	end := max(file.Size, off+int64(len(data)))
+	if end > yfs.inlineSize() {
+		return false, yfs.moveInlineToBlocks(file)
+	}
+
+	contents := make([]byte, end)
+	copy(contents, file.InlineData)
+	copy(contents[off:], data)
+
+	file.InlineData = contents
+	file.Size = end
+	file.Metadata.ModTime = time.Now().Unix()
+
+	return true, nil
+}
+
+// moveInlineToBlocks stores the contents of an inline file in data blocks
+func (yfs *YFS) moveInlineToBlocks(file *FileEntry) error {
+	if !isInline(file) {
+		return nil
+	}
+
+	written := &FileEntry{Compression: file.Compression, CompressionChunkSize: file.CompressionChunkSize, Inode: file.Inode}
+	if err := yfs.writeDataToBlocks(written, file.InlineData); err != nil {
+		return err
+	}
+
+	adoptFileIndex(file, written)
+	file.ChunkSizes = written.ChunkSizes
+	file.StoredSize = written.StoredSize
+	file.InlineData = nil
+
+	yfs.dropFileIndex(file)
+	return nil
+}
@@ -0,0 +1,135 @@
+package yfs
+
+import (
+	"testing"
+)
+
+// expectInline fails the test unless a file's inline state is want
+func expectInline(t *testing.T, fs *YFS, path string, want bool) {
+	t.Helper()
+
+	info, err := fs.GetFileInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Inline != want {
+		t.Fatalf("%s inline = %v, want %v", path, info.Inline, want)
+	}
+}
+
+func TestInlineFiles(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	empty := usedBlocks(fs)
+
+	want := testData(100, 1)
+	if err := fs.WriteFile("/small", want); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteAt("/small", 150, []byte("patch")); err != nil {
+		t.Fatal(err)
+	}
+	want = append(append(want, make([]byte, 50)...), "patch"...)
+	expectInline(t, fs, "/small", true)
+	expectFile(t, fs, "/small", want)
+	expectIntact(t, fs, empty)
+
+	// Growing past the inline size moves the contents to blocks
+	more := testData(DefaultInlineSize, 2)
+	if err := fs.AppendFile("/small", more); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, more...)
+	expectInline(t, fs, "/small", false)
+	expectFile(t, fs, "/small", want)
+
+	// Shrinking keeps the file in blocks
+	if err := fs.Truncate("/small", 10); err != nil {
+		t.Fatal(err)
+	}
+	expectInline(t, fs, "/small", false)
+	expectFile(t, fs, "/small", want[:10])
+
+	// Rewriting it whole with small contents frees its blocks
+	want = testData(64, 3)
+	if err := fs.WriteFile("/small", want); err != nil {
+		t.Fatal(err)
+	}
+	expectInline(t, fs, "/small", true)
+	expectIntact(t, fs, empty)
+
+	// A copy gets contents of its own
+	if err := fs.CopyFile("/small", "/copy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteAt("/copy", 0, []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	copied := append([]byte("changed"), want[7:]...)
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	defer fs.Close()
+
+	expectInline(t, fs, "/small", true)
+	expectFile(t, fs, "/small", want)
+	expectFile(t, fs, "/copy", copied)
+	expectIntact(t, fs, empty)
+}
+
+func TestInlineFileHandle(t *testing.T) {
+	fs, _ := newTestFS(t, Options{InlineSize: 128})
+	defer fs.Close()
+
+	f, err := fs.Create("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testData(100, 1)
+	if _, err := f.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	expectInline(t, fs, "/f", true)
+
+	more := testData(100, 2)
+	if _, err := f.Write(more); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectInline(t, fs, "/f", false)
+	expectFile(t, fs, "/f", append(want, more...))
+}
+
+func TestInlineDisabled(t *testing.T) {
+	tests := map[string]Options{
+		"negative size":    {InlineSize: -1},
+		"blocks encrypted": {Passphrase: "secret", KDFIterations: 1000},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			fs, _ := newTestFS(t, opts)
+			defer fs.Close()
+
+			if err := fs.WriteFile("/small", []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			expectInline(t, fs, "/small", false)
+			expectFile(t, fs, "/small", []byte("hello"))
+		})
+	}
+
+	// Inline files are encrypted along with the rest of the root
+	fs, _ := newTestFS(t, Options{Passphrase: "secret", KDFIterations: 1000, EncryptMetadata: true})
+	defer fs.Close()
+	if err := fs.WriteFile("/small", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expectInline(t, fs, "/small", true)
+
+	if _, err := NewWithOptions(t.TempDir(), Options{InlineSize: MaxInlineSize + 1}); err == nil {
+		t.Fatal("an inline size past the maximum was accepted")
+	}
+}
@@ -0,0 +1,434 @@
+package yfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	JournalMagic      = "YJNL" // Marks the start of every journal record
+	journalFrameSize  = 12     // Magic, record length and CRC32C in front of each record
+	journalPermission = 0644
+)
+
+var journalCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// journalOp collects the changes of the operation in progress. Blocks that
+// were free when the operation started are written straight to blocks.glob,
+// since nothing on disk references them yet; overwrites of blocks in use are
+// held back until the journal record describing them is durable.
+type journalOp struct {
+	initial     map[uint64]bool   // Used state at the start of the operation of every bitmap position touched
+	saved       map[uint64]bool   // Used state at the last savepoint of every bitmap position touched since, if one was taken
+	writes      map[uint32][]byte // Pending payloads of blocks that were in use
+	freshWrites bool              // Whether blocks.glob has unsynced writes to fresh blocks
+}
+
+// newJournalOp creates an empty operation
+func newJournalOp() *journalOp {
+	return &journalOp{
+		initial: make(map[uint64]bool),
+		writes:  make(map[uint32][]byte),
+	}
+}
+
+// pendingOp returns the operation in progress, starting one if needed.
+// The caller must hold the write lock.
+func (yfs *YFS) pendingOp() *journalOp {
+	if yfs.op == nil {
+		yfs.op = newJournalOp()
+	}
+	return yfs.op
+}
+
+// trackBitmapChange remembers the state a bitmap position had when the
+// operation started. The caller must hold the bitmap lock.
+func (yfs *YFS) trackBitmapChange(blockPos uint64) {
+	op := yfs.pendingOp()
+	if _, exists := op.initial[blockPos]; !exists {
+		op.initial[blockPos] = !yfs.isBlockFree(blockPos)
+	}
+	if _, exists := op.saved[blockPos]; op.saved != nil && !exists {
+		op.saved[blockPos] = !yfs.isBlockFree(blockPos)
+	}
+}
+
+// isFreshBlock reports whether a block was free when the operation started
+// and, once a savepoint was taken, at the savepoint too, so a failed call
+// never overwrites blocks its savepoint still references
+func (yfs *YFS) isFreshBlock(op *journalOp, blockID uint32) bool {
+	pos := uint64(blockID - 1)
+
+	yfs.bitmap.mutex.RLock()
+	defer yfs.bitmap.mutex.RUnlock()
+
+	free := pos >= yfs.bitmap.totalBlocks || yfs.isBlockFree(pos)
+	if used, exists := op.initial[pos]; exists {
+		if saved, exists := op.saved[pos]; exists {
+			return !used && !saved
+		}
+		return !used && (op.saved == nil || free)
+	}
+
+	return free
+}
+
+// pendingWrite returns the payload of a block overwritten by the operation in progress
+func (yfs *YFS) pendingWrite(blockID uint32) ([]byte, bool) {
+	if yfs.op == nil {
+		return nil, false
+	}
+
+	data, exists := yfs.op.writes[blockID]
+	return data, exists
+}
+
+// savepoint is the state a failed call returns to. File handles leave their
+// writes uncommitted until Sync or Close, so a call can start while an
+// operation is already in progress; its changes must survive the failure.
+type savepoint struct {
+	header *FileSystemHeader // Root as it was before the call
+	op     *journalOp        // Copy of the operation in progress, nil if there was none
+}
+
+// save records the state to return to if the call about to modify the file
+// system fails. The caller must hold the write lock.
+func (yfs *YFS) save() *savepoint {
+	sp := &savepoint{header: proto.Clone(yfs.header).(*FileSystemHeader)}
+
+	if op := yfs.op; op != nil {
+		sp.op = &journalOp{
+			initial:     make(map[uint64]bool, len(op.initial)),
+			writes:      make(map[uint32][]byte, len(op.writes)),
+			freshWrites: op.freshWrites,
+		}
+		for pos, used := range op.initial {
+			sp.op.initial[pos] = used
+		}
+		for blockID, data := range op.writes {
+			sp.op.writes[blockID] = data
+		}
+
+		op.saved = make(map[uint64]bool)
+	}
+
+	return sp
+}
+
+// restore undoes everything a failed call changed since its savepoint
+func (yfs *YFS) restore(sp *savepoint) {
+	op := yfs.op
+	if sp.op == nil || op == nil {
+		yfs.rollback(sp.header)
+		return
+	}
+
+	yfs.op = nil
+	yfs.rollback(sp.header)
+	yfs.resetBitmap(op.saved, sp.header.TotalBlocks)
+
+	// Fresh blocks written since the savepoint are free again, but may still need syncing
+	sp.op.freshWrites = sp.op.freshWrites || op.freshWrites
+	yfs.op = sp.op
+}
+
+// rollback restores the root and undoes the bitmap changes and pending block
+// writes of the operation in progress
+func (yfs *YFS) rollback(header *FileSystemHeader) {
+	initDirectoryMaps(header.Root) // Cloning the header drops empty maps
+	yfs.header = header
+	yfs.dedupKeys = nil
+
+	yfs.indexMutex.Lock()
+	yfs.indexes = make(map[*FileEntry]*fileIndex)
+	yfs.indexMutex.Unlock()
+
+	op := yfs.op
+	yfs.op = nil
+	if op != nil {
+		yfs.resetBitmap(op.initial, header.TotalBlocks)
+	}
+}
+
+// resetBitmap sets bitmap positions back to the used states recorded for
+// them and resizes the bitmap to totalBlocks
+func (yfs *YFS) resetBitmap(states map[uint64]bool, totalBlocks uint64) {
+	yfs.bitmap.mutex.Lock()
+	defer yfs.bitmap.mutex.Unlock()
+
+	// Set the bits directly, there is no operation to track the changes in anymore
+	for pos, used := range states {
+		if pos >= yfs.bitmap.totalBlocks {
+			continue
+		}
+
+		mask := byte(1) << (pos % 8)
+		if used {
+			yfs.bitmap.data[pos/8] |= mask
+		} else {
+			yfs.bitmap.data[pos/8] &^= mask
+		}
+	}
+
+	yfs.resizeBitmap(totalBlocks)
+	yfs.bitmap.searchPos = 0
+	yfs.bitmap.dirty = true
+}
+
+// commit makes the operation in progress durable: the journal record is
+// written and synced first, then the block overwrites, the root and the
+// bitmap are applied and the journal is cleared. A crash before the record
+// is complete leaves the previous state; a crash after it is repaired by
+// replaying the journal on load.
+func (yfs *YFS) commit() error {
+	op := yfs.pendingOp()
+	yfs.header.Generation++
+
+	record, err := yfs.buildJournalRecord(op)
+	if err != nil {
+		return err
+	}
+
+	// Fresh blocks must be on disk before a record references them
+	if op.freshWrites {
+		if err := yfs.syncBlocksFile(); err != nil {
+			return err
+		}
+		op.freshWrites = false
+	}
+
+	if err := yfs.appendJournal(record); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	if err := yfs.applyOp(op); err != nil {
+		return err
+	}
+
+	yfs.op = nil
+	return yfs.clearJournal()
+}
+
+// buildJournalRecord describes an operation as a journal record
+func (yfs *YFS) buildJournalRecord(op *journalOp) (*JournalRecord, error) {
+	header, err := yfs.marshalRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	yfs.journalSequence++
+	record := &JournalRecord{
+		Sequence:    yfs.journalSequence,
+		TotalBlocks: yfs.bitmap.totalBlocks,
+		Header:      header,
+	}
+
+	yfs.bitmap.mutex.RLock()
+	for pos, used := range op.initial {
+		nowUsed := pos < yfs.bitmap.totalBlocks && !yfs.isBlockFree(pos)
+		switch {
+		case nowUsed && !used:
+			record.AllocatedBlockIds = append(record.AllocatedBlockIds, uint32(pos)+1)
+		case !nowUsed && used:
+			record.FreedBlockIds = append(record.FreedBlockIds, uint32(pos)+1)
+		}
+	}
+	yfs.bitmap.mutex.RUnlock()
+
+	sortBlockIDs(record.AllocatedBlockIds)
+	sortBlockIDs(record.FreedBlockIds)
+
+	for blockID, data := range op.writes {
+		record.Writes = append(record.Writes, &BlockWrite{BlockId: blockID, Data: data})
+	}
+	sort.Slice(record.Writes, func(i, j int) bool { return record.Writes[i].BlockId < record.Writes[j].BlockId })
+
+	return record, nil
+}
+
+// sortBlockIDs sorts block IDs in ascending order
+func sortBlockIDs(blockIDs []uint32) {
+	sort.Slice(blockIDs, func(i, j int) bool { return blockIDs[i] < blockIDs[j] })
+}
+
+// applyOp writes the pending block overwrites of an operation and saves the
+// root and the bitmap
+func (yfs *YFS) applyOp(op *journalOp) error {
+	if len(op.writes) > 0 {
+		for blockID, data := range op.writes {
+			if err := yfs.writeBlockDirect(blockID, data); err != nil {
+				return err
+			}
+		}
+
+		if err := yfs.syncBlocksFile(); err != nil {
+			return err
+		}
+	}
+
+	if err := yfs.saveRoot(); err != nil {
+		return err
+	}
+
+	yfs.bitmap.mutex.Lock()
+	yfs.bitmap.dirty = true
+	yfs.bitmap.mutex.Unlock()
+
+	return yfs.saveBitmap()
+}
+
+// appendJournal appends a record to the journal and syncs it
+func (yfs *YFS) appendJournal(record *JournalRecord) error {
+	data, err := proto.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// Records hold block contents, they are encrypted whenever blocks are
+	if yfs.keys != nil {
+		if data, err = yfs.sealMetadata(data); err != nil {
+			return err
+		}
+	}
+
+	frame := make([]byte, journalFrameSize, journalFrameSize+len(data))
+	copy(frame, JournalMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(data)))
+	binary.LittleEndian.PutUint32(frame[8:12], crc32.Checksum(data, journalCRCTable))
+	frame = append(frame, data...)
+
+	file, err := os.OpenFile(yfs.journalPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, journalPermission)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(frame); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// clearJournal empties the journal once its records have been applied
+func (yfs *YFS) clearJournal() error {
+	err := os.Truncate(yfs.journalPath, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// readJournal returns the complete records of the journal. Reading stops at
+// the first torn or corrupt record, which belongs to an operation that never
+// committed.
+func (yfs *YFS) readJournal() ([]*JournalRecord, error) {
+	data, err := os.ReadFile(yfs.journalPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	var records []*JournalRecord
+	for len(data) >= journalFrameSize && string(data[:4]) == JournalMagic {
+		length := binary.LittleEndian.Uint32(data[4:8])
+		checksum := binary.LittleEndian.Uint32(data[8:12])
+		if uint64(len(data)-journalFrameSize) < uint64(length) {
+			break
+		}
+
+		body := data[journalFrameSize : journalFrameSize+int(length)]
+		if crc32.Checksum(body, journalCRCTable) != checksum {
+			break
+		}
+
+		if isSealed(body) {
+			if body, err = yfs.openMetadata(body); isKeyError(err) {
+				return nil, err
+			} else if err != nil {
+				break
+			}
+		}
+
+		record := &JournalRecord{}
+		if err := proto.Unmarshal(body, record); err != nil {
+			break
+		}
+
+		records = append(records, record)
+		data = data[journalFrameSize+int(length):]
+	}
+
+	return records, nil
+}
+
+// journaledHeader returns the root recorded by the last journal record
+func journaledHeader(records []*JournalRecord) (*FileSystemHeader, error) {
+	header := &FileSystemHeader{}
+	if err := proto.Unmarshal(records[len(records)-1].Header, header); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal journaled root: %w", err)
+	}
+
+	if header.Root == nil {
+		return nil, fmt.Errorf("journaled root is incomplete")
+	}
+
+	initDirectoryMaps(header.Root)
+	return header, nil
+}
+
+// replayJournal applies the bitmap changes and block writes of the records
+// left in the journal by operations that were interrupted after committing.
+// The root of the last record must already be loaded. The replayed block
+// writes become the operation in progress; a read-only file system keeps
+// them in memory, otherwise they are committed once loading completes.
+func (yfs *YFS) replayJournal(records []*JournalRecord) {
+	yfs.journalSequence = records[len(records)-1].Sequence
+
+	op := newJournalOp()
+	for _, record := range records {
+		yfs.resizeBitmap(record.TotalBlocks)
+
+		for _, blockID := range record.AllocatedBlockIds {
+			yfs.markBlockUsed(uint64(blockID - 1))
+		}
+		for _, blockID := range record.FreedBlockIds {
+			yfs.markBlockFree(uint64(blockID - 1))
+		}
+
+		for _, write := range record.Writes {
+			data := write.Data
+			if yfs.header.Version < FormatVersion {
+				data = frameLegacyBlock(data) // Records of format v2 hold bare payloads
+			}
+			op.writes[write.BlockId] = data
+		}
+	}
+	yfs.bitmap.dirty = true
+	yfs.op = op
+}
+
+// resizeBitmap sets the number of blocks tracked by the bitmap
+func (yfs *YFS) resizeBitmap(totalBlocks uint64) {
+	size := (totalBlocks + 7) / 8
+	if size > uint64(len(yfs.bitmap.data)) {
+		yfs.bitmap.data = append(yfs.bitmap.data, make([]byte, size-uint64(len(yfs.bitmap.data)))...)
+	} else {
+		yfs.bitmap.data = yfs.bitmap.data[:size]
+		if totalBlocks%8 != 0 {
+			yfs.bitmap.data[totalBlocks/8] &= byte(1)<<(totalBlocks%8) - 1
+		}
+	}
+
+	yfs.bitmap.totalBlocks = totalBlocks
+	if yfs.bitmap.searchPos >= totalBlocks {
+		yfs.bitmap.searchPos = 0
+	}
+}
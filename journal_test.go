@@ -0,0 +1,193 @@
+package yfs
+
+import (
+	"os"
+	"testing"
+)
+
+// crashAfterJournal runs fn as one operation and writes its journal record,
+// then stops as if the process died before applying it
+func crashAfterJournal(t *testing.T, fs *YFS, fn func() error) {
+	t.Helper()
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fn(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.header.Generation++
+	record, err := fs.buildJournalRecord(fs.pendingOp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.syncBlocksFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.appendJournal(record); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectIntact fails the test unless the metadata verifies, Check finds
+// nothing wrong and exactly used blocks are marked used
+func expectIntact(t *testing.T, fs *YFS, used int) {
+	t.Helper()
+
+	if err := fs.VerifyIntegrity(); err != nil {
+		t.Fatal(err)
+	}
+	expectCheckClean(t, fs)
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("%d blocks used, want %d", got, used)
+	}
+}
+
+func TestFailedWriteLeavesNoTrace(t *testing.T) {
+	opts := Options{InitialBlocks: 64, MaxBlocks: 64}
+	fs, dir := newTestFS(t, opts)
+	payload := fs.payloadSize()
+
+	a := testData(20*payload, 1)
+	if err := fs.WriteFile("/a", a); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	if err := fs.WriteAt("/a", int64(payload), testData(100*payload, 2)); err == nil {
+		t.Fatal("write past the volume size succeeded")
+	}
+	if err := fs.AppendFile("/a", testData(100*payload, 3)); err == nil {
+		t.Fatal("append past the volume size succeeded")
+	}
+	if err := fs.WriteFile("/big", testData(100*payload, 4)); err == nil {
+		t.Fatal("write of a file larger than the volume succeeded")
+	}
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("%d blocks used after failed writes, want %d", got, used)
+	}
+
+	b := testData(5*payload, 5)
+	if err := fs.WriteFile("/b", b); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = reopenTestFS(t, fs, dir, opts)
+	defer fs.Close()
+
+	expectFile(t, fs, "/a", a)
+	expectFile(t, fs, "/b", b)
+	for _, path := range []string{"/big", "/new"} {
+		if _, err := fs.GetFileInfo(path); err == nil {
+			t.Fatalf("failed write left %s behind", path)
+		}
+	}
+	expectIntact(t, fs, used+5)
+}
+
+func TestFailedHandleWriteKeepsEarlierWrites(t *testing.T) {
+	opts := Options{InitialBlocks: 64, MaxBlocks: 64}
+	fs, dir := newTestFS(t, opts)
+	payload := fs.payloadSize()
+	empty := usedBlocks(fs)
+
+	file, err := fs.Create("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first write stays uncommitted until Close; the second one rewrites
+	// its blocks before running out of space
+	first := testData(20*payload, 1)
+	if _, err := file.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt(testData(100*payload, 2), 0); err == nil {
+		t.Fatal("write past the volume size succeeded")
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = reopenTestFS(t, fs, dir, opts)
+	defer fs.Close()
+
+	expectFile(t, fs, "/a", first)
+	expectIntact(t, fs, empty+20+1)
+}
+
+func TestJournalReplay(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	payload := fs.payloadSize()
+
+	a := testData(10*payload, 1)
+	if err := fs.WriteFile("/a", a); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	// Overwrites of blocks in use only reach blocks.glob through the journal
+	patch := testData(2*payload, 2)
+	b := testData(3*payload, 3)
+	crashAfterJournal(t, fs, func() error {
+		_, file, _, err := fs.findEntryUnsafe("/a")
+		if err != nil {
+			return err
+		}
+		if err := fs.writeAtUnsafe(file, patch, int64(payload)); err != nil {
+			return err
+		}
+		fs.updateMetadataChecksum(file.Metadata)
+
+		if file, err = fs.createFileEntryUnsafe("/b", 0644); err != nil {
+			return err
+		}
+		return fs.writeAtUnsafe(file, b, 0)
+	})
+
+	fs = openTestFS(t, dir, Options{})
+	defer fs.Close()
+
+	copy(a[payload:], patch)
+	expectFile(t, fs, "/a", a)
+	expectFile(t, fs, "/b", b)
+	expectIntact(t, fs, used+3)
+
+	if info, err := os.Stat(fs.journalPath); err != nil || info.Size() != 0 {
+		t.Fatalf("journal not cleared after replay: %v", err)
+	}
+}
+
+func TestJournalTornRecordIgnored(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	payload := fs.payloadSize()
+
+	a := testData(10*payload, 1)
+	if err := fs.WriteFile("/a", a); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	crashAfterJournal(t, fs, func() error {
+		if err := fs.writeAtUnsafe(fs.header.Root.Files["a"], testData(payload, 2), 0); err != nil {
+			return err
+		}
+		return fs.writeAtUnsafe(fs.header.Root.Files["a"], testData(payload, 3), int64(len(a)))
+	})
+
+	// A crash while appending leaves the record incomplete
+	info, err := os.Stat(fs.journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(fs.journalPath, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = openTestFS(t, dir, Options{})
+	defer fs.Close()
+
+	expectFile(t, fs, "/a", a)
+	expectIntact(t, fs, used)
+}
@@ -0,0 +1,415 @@
+package yfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const migrateChunkSize = 1 << 20 // Bytes of file data copied at once by Migrate
+
+// imageFiles are the files NewWithOptions keeps a file system in
+var imageFiles = []string{"root.yfs", "root.alt.yfs", "bitmap.yfs", "blocks.glob", "journal.yfs"}
+
+// MigrateOptions configures MigrateWithOptions
+type MigrateOptions struct {
+	Output     string // Directory to write the migrated file system to, leaving dir as it is; empty migrates in place
+	Backup     string // Directory the original files are moved to by an in-place migration (dir.v<version>.bak if empty)
+	Key        []byte // Key of an encrypted file system
+	Passphrase string // Passphrase of an encrypted file system
+}
+
+// migration copies the trees of a file system into a new image
+type migration struct {
+	src    *YFS
+	dst    *YFS
+	copies map[string]*FileEntry // Copied files by the source blocks they were read from
+	inodes map[string]uint64     // Inodes of the new image by source inode, or by path for files without one
+}
+
+// Migrate upgrades the file system in dir to the given format version in
+// place, moving the original files to dir.v<version>.bak
+func Migrate(dir string, targetVersion uint32) error {
+	return MigrateWithOptions(dir, targetVersion, MigrateOptions{})
+}
+
+// MigrateWithOptions upgrades the file system in dir, which must not be open,
+// to the given format version. Its directories, files and snapshots are
+// copied into a new image with the same settings, built in a work directory
+// next to the destination. The copy is checked with VerifyIntegrity before
+// it replaces the original, or is moved to opts.Output. A file system already
+// in the target format is left as it is unless opts.Output is set.
+func MigrateWithOptions(dir string, targetVersion uint32, opts MigrateOptions) error {
+	if targetVersion != FormatVersion {
+		return fmt.Errorf("%w: cannot migrate to format v%d, only v%d can be written", ErrFormatVersion, targetVersion, FormatVersion)
+	}
+
+	dest := dir
+	if opts.Output != "" {
+		dest = opts.Output
+		if err := checkNoImage(dest); err != nil {
+			return err
+		}
+	}
+
+	src, err := NewWithOptions(dir, Options{ReadOnly: true, Key: opts.Key, Passphrase: opts.Passphrase})
+	if err != nil {
+		return err
+	}
+
+	version := src.header.Version
+	if version == targetVersion && opts.Output == "" {
+		return src.Close()
+	}
+
+	// A work directory left by an interrupted migration is started over
+	work := filepath.Clean(dest) + ".migrate"
+	if err := os.RemoveAll(work); err != nil {
+		src.Close()
+		return err
+	}
+	if err := os.MkdirAll(work, 0755); err != nil {
+		src.Close()
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	err = src.migrateTo(work)
+	if err == nil {
+		err = verifyMigration(src, work, opts)
+	}
+	src.Close()
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s to format v%d: %w", dir, targetVersion, err)
+	}
+
+	if opts.Output != "" {
+		return moveImage(work, opts.Output)
+	}
+
+	backup := opts.Backup
+	if backup == "" {
+		backup = fmt.Sprintf("%s.v%d.bak", filepath.Clean(dir), version)
+	}
+	if err := checkNoImage(backup); err != nil {
+		return err
+	}
+
+	if err := moveImage(dir, backup); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", dir, err)
+	}
+
+	if err := moveImage(work, dir); err != nil {
+		if restoreErr := moveImage(backup, dir); restoreErr != nil {
+			return fmt.Errorf("failed to replace %s: %v; the original files are in %s", dir, err, backup)
+		}
+		return fmt.Errorf("failed to replace %s: %w", dir, err)
+	}
+
+	return nil
+}
+
+// checkNoImage fails if dir already holds any file of a file system
+func checkNoImage(dir string) error {
+	for _, name := range imageFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return fmt.Errorf("%s already holds a file system", dir)
+		}
+	}
+	return nil
+}
+
+// moveImage moves the files of a file system from one directory to another
+func moveImage(from, to string) error {
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return err
+	}
+
+	for _, name := range imageFiles {
+		err := os.Rename(filepath.Join(from, name), filepath.Join(to, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateTo copies the file system into a new image in dir, created in the
+// current format with the same settings. Snapshots are copied oldest first;
+// files whose blocks a snapshot shares with a later tree share the copied
+// blocks the same way.
+func (yfs *YFS) migrateTo(dir string) error {
+	snapshots := yfs.ListSnapshots()
+
+	yfs.mutex.RLock()
+	defer yfs.mutex.RUnlock()
+
+	dst, err := NewWithOptions(dir, yfs.migrationOptions())
+	if err != nil {
+		return err
+	}
+
+	m := &migration{
+		src:    yfs,
+		dst:    dst,
+		copies: make(map[string]*FileEntry),
+		inodes: make(map[string]uint64),
+	}
+
+	err = m.run(snapshots)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// migrationOptions returns the options to create a copy of the file system with
+func (yfs *YFS) migrationOptions() Options {
+	header := yfs.header
+	opts := Options{
+		BlockSize:       header.BlockSize,
+		Checksums:       ChecksumNone,
+		DataChecksums:   yfs.dataChecksum,
+		Dedup:           header.Dedup,
+		Key:             yfs.opts.Key,
+		Passphrase:      yfs.opts.Passphrase,
+		KDFIterations:   header.Encryption.GetIterations(),
+		EncryptMetadata: header.Encryption.GetMetadata(),
+	}
+
+	if header.ChecksumEnabled > 0 {
+		opts.Checksums = ChecksumCRC32
+	}
+
+	return opts
+}
+
+// run copies the snapshots and the live tree. Nothing is journaled while
+// copying; the new image is discarded if the copy fails.
+func (m *migration) run(snapshots []SnapshotInfo) error {
+	dst := m.dst
+	dst.mutex.Lock()
+	defer dst.mutex.Unlock()
+
+	dst.ready = false
+	defer func() { dst.ready = true }()
+
+	for _, info := range snapshots {
+		snapshot := m.src.header.Snapshots[info.Name]
+
+		root, err := m.copyDirectory(snapshot.Root, "")
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", snapshot.Name, err)
+		}
+
+		if dst.header.Snapshots == nil {
+			dst.header.Snapshots = make(map[string]*Snapshot)
+		}
+		dst.header.Snapshots[snapshot.Name] = &Snapshot{
+			Name:       snapshot.Name,
+			CreateTime: snapshot.CreateTime,
+			Root:       root,
+		}
+	}
+
+	root, err := m.copyDirectory(m.src.header.Root, "")
+	if err != nil {
+		return err
+	}
+	dst.header.Root = root
+
+	if err := dst.syncBlocksFile(); err != nil {
+		return err
+	}
+
+	// Save changes
+	dst.ready = true
+	return dst.commit()
+}
+
+// copyDirectory copies a directory of the source and everything below it.
+// Paths are relative to the root of the tree being copied.
+func (m *migration) copyDirectory(dir *DirectoryEntry, path string) (*DirectoryEntry, error) {
+	copied := &DirectoryEntry{
+		Metadata:    proto.Clone(dir.Metadata).(*FileMetadata),
+		Files:       make(map[string]*FileEntry, len(dir.Files)),
+		Directories: make(map[string]*DirectoryEntry, len(dir.Directories)),
+	}
+
+	// Copy in name order, so the new image is laid out the same every time
+	names := make([]string, 0, len(dir.Files))
+	for name := range dir.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		file, err := m.copyFile(dir.Files[name], path+"/"+name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy %s/%s: %w", path, name, err)
+		}
+		copied.Files[name] = file
+	}
+
+	names = names[:0]
+	for name := range dir.Directories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		subDir, err := m.copyDirectory(dir.Directories[name], path+"/"+name)
+		if err != nil {
+			return nil, err
+		}
+		copied.Directories[name] = subDir
+	}
+
+	return copied, nil
+}
+
+// copyFile copies a file of the source, or references the blocks of an
+// earlier copy of the same source blocks
+func (m *migration) copyFile(file *FileEntry, path string) (*FileEntry, error) {
+	key, err := migrationKey(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if earlier, exists := m.copies[key]; exists && key != "" {
+		if err := m.dst.retainFileBlocks(earlier); err != nil {
+			return nil, err
+		}
+
+		copied := proto.Clone(earlier).(*FileEntry)
+		copied.Metadata = proto.Clone(file.Metadata).(*FileMetadata)
+		copied.Inode = m.inodeFor(file, path)
+		return copied, nil
+	}
+
+	copied := &FileEntry{
+		Metadata:    proto.Clone(file.Metadata).(*FileMetadata),
+		Compression: file.Compression,
+		Inode:       m.inodeFor(file, path),
+	}
+	if file.Compression != 0 {
+		copied.CompressionChunkSize = uint32(m.dst.payloadSize() * compressionChunkBlocks)
+	}
+
+	if err := m.copyData(file, copied); err != nil {
+		m.dst.releaseFileBlocks(copied)
+		return nil, err
+	}
+
+	// Writes stamp the modification time; keep the source's
+	copied.Metadata = proto.Clone(file.Metadata).(*FileMetadata)
+
+	if key != "" {
+		m.copies[key] = copied
+	}
+	return copied, nil
+}
+
+// copyData copies the contents of a source file into a new file, leaving
+// the holes of the source unallocated
+func (m *migration) copyData(file, copied *FileEntry) error {
+	buf := make([]byte, migrateChunkSize)
+
+	for off := int64(0); off < file.Size; {
+		start, err := m.src.nextRegion(file, off, true)
+		if errors.Is(err, ErrNoData) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		end, err := m.src.nextRegion(file, start, false)
+		if err != nil {
+			return err
+		}
+
+		for pos := start; pos < end; {
+			n, err := m.src.readAtUnsafe(file, buf[:min(end-pos, migrateChunkSize)], pos)
+			if err != nil {
+				return err
+			}
+
+			if err := m.dst.writeAtUnsafe(copied, buf[:n], pos); err != nil {
+				return err
+			}
+			pos += int64(n)
+		}
+
+		off = end
+	}
+
+	// A trailing hole only sets the size
+	if copied.Size < file.Size {
+		return m.dst.truncateUnsafe(copied, file.Size)
+	}
+	return nil
+}
+
+// inodeFor returns the inode a source file is given in the new image. Files
+// of a snapshot keep the inode of the same file in other trees; source files
+// without an inode are matched by path.
+func (m *migration) inodeFor(file *FileEntry, path string) uint64 {
+	key := fmt.Sprintf("#%d", file.Inode)
+	if file.Inode == 0 {
+		key = path
+	}
+
+	inode, exists := m.inodes[key]
+	if !exists {
+		inode = m.dst.newInode()
+		m.inodes[key] = inode
+	}
+	return inode
+}
+
+// migrationKey identifies the blocks a source file is stored in, "" for a
+// file without blocks. Files with the same key hold the same contents.
+func migrationKey(file *FileEntry) (string, error) {
+	if !hasBlocks(file) {
+		return "", nil
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(&FileEntry{
+		FirstIndexBlockId: file.FirstIndexBlockId,
+		Size:              file.Size,
+		DirectBlockIds:    file.DirectBlockIds,
+		IndirectBlockIds:  file.IndirectBlockIds,
+		Compression:       file.Compression,
+		ChunkSizes:        file.ChunkSizes,
+	})
+	return string(data), err
+}
+
+// verifyMigration opens a migrated image and checks it with VerifyIntegrity
+// and against the number of files of the source
+func verifyMigration(src *YFS, dir string, opts MigrateOptions) error {
+	migrated, err := NewWithOptions(dir, Options{ReadOnly: true, Key: opts.Key, Passphrase: opts.Passphrase})
+	if err != nil {
+		return err
+	}
+	defer migrated.Close()
+
+	if err := migrated.VerifyIntegrity(); err != nil {
+		return fmt.Errorf("migrated file system failed verification: %w", err)
+	}
+
+	want, got := 0, 0
+	src.walkAllFiles(func(string, *FileEntry) error { want++; return nil })
+	migrated.walkAllFiles(func(string, *FileEntry) error { got++; return nil })
+	if got != want {
+		return fmt.Errorf("migrated file system has %d files, the original %d", got, want)
+	}
+
+	return nil
+}
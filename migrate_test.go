@@ -0,0 +1,78 @@
+package yfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateBaselineImage(t *testing.T) {
+	dir := copyBaselineImage(t)
+
+	if err := Migrate(dir, FormatVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	// The original stays next to the migrated image, untouched
+	backup := dir + ".v2.bak"
+	for _, name := range []string{"root.yfs", "bitmap.yfs", "blocks.glob"} {
+		want, _ := os.ReadFile(filepath.Join("testdata", "baseline-v2", name))
+		got, err := os.ReadFile(filepath.Join(backup, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("backup of %s differs from the original: %v", name, err)
+		}
+	}
+
+	fs := openTestFS(t, dir, Options{})
+	if fs.header.Version != FormatVersion {
+		t.Fatalf("migrated image is format v%d, want v%d", fs.header.Version, FormatVersion)
+	}
+	expectBaselineFiles(t, fs)
+	expectCheckClean(t, fs)
+
+	// The migrated image is fully writable
+	if err := fs.CreateDirectory("/docs/empty/sub"); err != nil {
+		t.Fatal(err)
+	}
+	data := testData(10*fs.payloadSize(), 1)
+	if err := fs.WriteFile("/docs/empty/sub/new", data); err != nil {
+		t.Fatal(err)
+	}
+	fs = reopenTestFS(t, fs, dir, Options{})
+	defer fs.Close()
+
+	expectFile(t, fs, "/docs/empty/sub/new", data)
+	expectCheckClean(t, fs)
+}
+
+func TestMigrateToOutput(t *testing.T) {
+	dir := copyBaselineImage(t)
+	out := filepath.Join(t.TempDir(), "migrated")
+
+	if err := MigrateWithOptions(dir, FormatVersion, MigrateOptions{Output: out}); err != nil {
+		t.Fatal(err)
+	}
+
+	src := openTestFS(t, dir, Options{ReadOnly: true})
+	if src.header.Version != legacyFormatVersion {
+		t.Fatalf("source was changed to format v%d", src.header.Version)
+	}
+
+	// Migrating an image already in the current format changes nothing
+	if err := Migrate(out, FormatVersion); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(out + fmt.Sprintf(".v%d.bak", FormatVersion)); !os.IsNotExist(err) {
+		t.Fatalf("no-op migration left a backup: %v", err)
+	}
+
+	if err := Migrate(dir, FormatVersion+1); err == nil {
+		t.Fatal("migration to an unknown format succeeded")
+	}
+
+	fs := openTestFS(t, out, Options{})
+	defer fs.Close()
+	expectBaselineFiles(t, fs)
+}
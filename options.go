@@ -0,0 +1,269 @@
+package yfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	MinBlockSize         = 512     // Smallest supported block size
+	MaxBlockSize         = 1 << 20 // Largest supported block size
+	DefaultInitialBlocks = 8192    // Bitmap capacity of a new file system
+	DefaultGrowthBlocks  = 8192    // Minimum blocks added when the volume grows
+	DefaultInlineSize    = 256     // Largest file kept in root.yfs by default
+	MaxInlineSize        = 4096    // Largest accepted Options.InlineSize
+)
+
+// ErrReadOnly is returned by operations that would modify a file system
+// opened with Options.ReadOnly
+var ErrReadOnly = errors.New("read-only file system")
+
+// ChecksumMode selects whether metadata checksums are kept
+type ChecksumMode int
+
+const (
+	ChecksumDefault ChecksumMode = iota // CRC32 for new file systems, the stored mode for existing ones
+	ChecksumCRC32                       // CRC32 of file and directory metadata
+	ChecksumNone                        // No checksums
+)
+
+// String returns the name of the checksum mode
+func (m ChecksumMode) String() string {
+	switch m {
+	case ChecksumDefault:
+		return "default"
+	case ChecksumCRC32:
+		return "crc32"
+	case ChecksumNone:
+		return "none"
+	default:
+		return fmt.Sprintf("ChecksumMode(%d)", int(m))
+	}
+}
+
+// headerValue returns the FileSystemHeader.checksum_enabled value for the mode
+func (m ChecksumMode) headerValue() uint32 {
+	if m == ChecksumNone {
+		return 0
+	}
+	return 1
+}
+
+// Options configures how a file system is created or opened. Zero values
+// select the defaults. When opening an existing file system, options that
+// are recorded in its header must match it.
+type Options struct {
+	BlockSize     uint32           // Block size of a new file system (DefaultBlockSize if 0)
+	Checksums     ChecksumMode     // Metadata checksum mode
+	DataChecksums DataChecksumMode // Checksum kept for every data block
+	InitialBlocks uint64           // Bitmap capacity of a new file system (DefaultInitialBlocks if 0)
+	MaxBlocks     uint64           // Upper bound on the number of blocks (unlimited if 0)
+	GrowthBlocks  uint64           // Blocks added when the volume is full (a quarter of its size, at least DefaultGrowthBlocks, if 0)
+	ReadOnly      bool             // Reject every operation that modifies the file system
+	JournalPath   string           // Write-ahead journal (journal.yfs next to the root file if empty)
+	Dedup         bool             // Share identical data blocks between whole-file writes (stays on once enabled)
+	InlineSize    int              // Largest file kept in root.yfs instead of in blocks (DefaultInlineSize if 0, none if negative)
+
+	// Encryption. A new file system is encrypted when Key or Passphrase is
+	// set; an encrypted one cannot be opened without the same key.
+	Key             []byte // Raw 32-byte AES-256 key
+	Passphrase      string // Passphrase the key is derived from with PBKDF2-HMAC-SHA256
+	KDFIterations   uint32 // PBKDF2 iterations for a new file system (DefaultKDFIterations if 0)
+	EncryptMetadata bool   // Encrypt root.yfs and bitmap.yfs too, hiding names and sizes
+}
+
+// NewWithOptions creates a new YFS instance from a directory using the given options
+func NewWithOptions(dir string, opts Options) (*YFS, error) {
+	return NewFromPathsWithOptions(
+		filepath.Join(dir, "root.yfs"),
+		filepath.Join(dir, "bitmap.yfs"),
+		filepath.Join(dir, "blocks.glob"),
+		opts,
+	)
+}
+
+// validate checks options that do not depend on an existing file system
+func (opts *Options) validate() error {
+	if opts.BlockSize != 0 && (opts.BlockSize < MinBlockSize || opts.BlockSize > MaxBlockSize) {
+		return fmt.Errorf("block size %d out of range [%d, %d]", opts.BlockSize, MinBlockSize, MaxBlockSize)
+	}
+
+	if opts.Checksums < ChecksumDefault || opts.Checksums > ChecksumNone {
+		return fmt.Errorf("invalid checksum mode: %v", opts.Checksums)
+	}
+
+	if opts.DataChecksums < DataChecksumDefault || opts.DataChecksums > DataChecksumSHA256 {
+		return fmt.Errorf("invalid data checksum mode: %v", opts.DataChecksums)
+	}
+
+	if opts.MaxBlocks > math.MaxUint32 {
+		return fmt.Errorf("max blocks %d exceed the %d addressable blocks", opts.MaxBlocks, uint64(math.MaxUint32))
+	}
+
+	if opts.MaxBlocks != 0 && opts.InitialBlocks > opts.MaxBlocks {
+		return fmt.Errorf("initial blocks %d exceed max blocks %d", opts.InitialBlocks, opts.MaxBlocks)
+	}
+
+	if opts.InlineSize > MaxInlineSize {
+		return fmt.Errorf("inline size %d exceeds %d", opts.InlineSize, MaxInlineSize)
+	}
+
+	if opts.encrypted() {
+		if err := opts.kek().validate(); err != nil {
+			return err
+		}
+	}
+
+	if opts.EncryptMetadata && !opts.encrypted() {
+		return fmt.Errorf("metadata encryption requires a key or passphrase")
+	}
+
+	return nil
+}
+
+// blockSize returns the block size to create a file system with
+func (opts *Options) blockSize() uint32 {
+	if opts.BlockSize == 0 {
+		return DefaultBlockSize
+	}
+	return opts.BlockSize
+}
+
+// dataChecksum returns the data checksum to create a file system with
+func (opts *Options) dataChecksum() DataChecksumMode {
+	if opts.DataChecksums != DataChecksumDefault {
+		return opts.DataChecksums
+	}
+
+	if opts.Checksums == ChecksumNone {
+		return DataChecksumNone
+	}
+	return DataChecksumCRC32C
+}
+
+// initialBlocks returns the bitmap capacity to create a file system with
+func (opts *Options) initialBlocks() uint64 {
+	if opts.InitialBlocks != 0 {
+		return opts.InitialBlocks
+	}
+
+	if opts.MaxBlocks != 0 && opts.MaxBlocks < DefaultInitialBlocks {
+		return opts.MaxBlocks
+	}
+	return DefaultInitialBlocks
+}
+
+// journalPath returns the journal file to use for a root file
+func (opts *Options) journalPath(rootPath string) string {
+	if opts.JournalPath != "" {
+		return opts.JournalPath
+	}
+	return filepath.Join(filepath.Dir(rootPath), "journal.yfs")
+}
+
+// maxBlocks returns the number of blocks the volume may grow to
+func (opts *Options) maxBlocks() uint64 {
+	if opts.MaxBlocks == 0 {
+		return math.MaxUint32 // Block IDs are uint32
+	}
+	return opts.MaxBlocks
+}
+
+// growthBlocks returns how many blocks to add to a volume of total blocks
+func (opts *Options) growthBlocks(total uint64) uint64 {
+	if opts.GrowthBlocks != 0 {
+		return opts.GrowthBlocks
+	}
+	return max(DefaultGrowthBlocks, total/4)
+}
+
+// validateHeader checks the options against the header of an existing file system
+func (yfs *YFS) validateHeader() error {
+	header := yfs.header
+
+	if err := yfs.checkFormatVersion(); err != nil {
+		return err
+	}
+
+	overhead := uint32(0)
+	if header.Encryption != nil {
+		overhead = sealOverhead
+	}
+
+	if header.BlockSize < uint32(yfs.blockHeaderSize())+overhead+indexBlockOverhead+maxReferenceSize {
+		return fmt.Errorf("invalid block size in header: %d", header.BlockSize)
+	}
+
+	if yfs.opts.BlockSize != 0 && yfs.opts.BlockSize != header.BlockSize {
+		return fmt.Errorf("block size mismatch: requested %d, file system uses %d",
+			yfs.opts.BlockSize, header.BlockSize)
+	}
+
+	if yfs.opts.Checksums != ChecksumDefault && yfs.opts.Checksums.headerValue() != header.ChecksumEnabled {
+		stored := ChecksumNone
+		if header.ChecksumEnabled > 0 {
+			stored = ChecksumCRC32
+		}
+		return fmt.Errorf("checksum mode mismatch: requested %v, file system uses %v",
+			yfs.opts.Checksums, stored)
+	}
+
+	if yfs.opts.DataChecksums != DataChecksumDefault && yfs.opts.DataChecksums.headerValue() != header.DataChecksum {
+		stored, err := dataChecksumFromHeader(header.DataChecksum)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("data checksum mismatch: requested %v, file system uses %v",
+			yfs.opts.DataChecksums, stored)
+	}
+
+	return yfs.validateBlocksHeader()
+}
+
+// validateBlocksHeader checks that blocks.glob was written with the header's block size
+func (yfs *YFS) validateBlocksHeader() error {
+	file, err := os.Open(yfs.blocksPath)
+	if err != nil {
+		return fmt.Errorf("failed to open blocks file: %w", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return fmt.Errorf("failed to read blocks file header: %w", err)
+	}
+
+	if blockSize := binary.LittleEndian.Uint32(header); blockSize != yfs.header.BlockSize {
+		return fmt.Errorf("blocks file uses block size %d, header says %d", blockSize, yfs.header.BlockSize)
+	}
+
+	return nil
+}
+
+// validateCapacity checks the loaded bitmap against MaxBlocks
+func (yfs *YFS) validateCapacity() error {
+	if yfs.opts.MaxBlocks != 0 && yfs.bitmap.totalBlocks > yfs.opts.MaxBlocks {
+		return fmt.Errorf("file system has %d blocks, more than max blocks %d",
+			yfs.bitmap.totalBlocks, yfs.opts.MaxBlocks)
+	}
+
+	return nil
+}
+
+// checkWritable returns ErrReadOnly if the file system was opened read-only
+func (yfs *YFS) checkWritable() error {
+	if yfs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// IsReadOnly reports whether the file system was opened read-only
+func (yfs *YFS) IsReadOnly() bool {
+	return yfs.opts.ReadOnly
+}
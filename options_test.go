@@ -0,0 +1,87 @@
+package yfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	invalid := []Options{
+		{BlockSize: MinBlockSize - 1},
+		{BlockSize: MaxBlockSize + 1},
+		{Checksums: ChecksumNone + 1},
+		{InitialBlocks: 200, MaxBlocks: 100},
+	}
+	for _, opts := range invalid {
+		if _, err := NewWithOptions(t.TempDir(), opts); err == nil {
+			t.Fatalf("%+v was accepted", opts)
+		}
+	}
+}
+
+func TestOptionsMismatch(t *testing.T) {
+	opts := Options{BlockSize: 1024, Checksums: ChecksumNone, InitialBlocks: 256}
+	fs, dir := newTestFS(t, opts)
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatched := []Options{
+		{BlockSize: 2048},
+		{Checksums: ChecksumCRC32},
+		{MaxBlocks: 128},
+	}
+	for _, opts := range mismatched {
+		if _, err := NewWithOptions(dir, opts); err == nil {
+			t.Fatalf("%+v opened a file system created with different options", opts)
+		}
+	}
+
+	// Matching and unset options both open the file system with its stored settings
+	for _, opts := range []Options{opts, {}} {
+		fs := openTestFS(t, dir, opts)
+		if fs.GetBlockSize() != 1024 || fs.checksumEnabled {
+			t.Fatalf("%+v opened with block size %d and checksums %v", opts, fs.GetBlockSize(), fs.checksumEnabled)
+		}
+	}
+
+	// blocks.glob must have been written with the header's block size
+	if err := os.WriteFile(filepath.Join(dir, "blocks.glob"), make([]byte, HeaderSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWithOptions(dir, Options{}); err == nil {
+		t.Fatal("a blocks file with another block size was accepted")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	if _, err := NewWithOptions(t.TempDir(), Options{ReadOnly: true}); err == nil {
+		t.Fatal("a missing file system was opened read-only")
+	}
+
+	fs, dir := newTestFS(t, Options{})
+	if err := fs.AppendFile("/f", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{ReadOnly: true})
+	expectFile(t, fs, "/f", []byte("data"))
+
+	if err := fs.AppendFile("/f", []byte("more")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("AppendFile returned %v, want ErrReadOnly", err)
+	}
+	if err := fs.DeleteFile("/f"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("DeleteFile returned %v, want ErrReadOnly", err)
+	}
+	if _, err := fs.Create("/g"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Create returned %v, want ErrReadOnly", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = openTestFS(t, dir, Options{})
+	expectFile(t, fs, "/f", []byte("data"))
+}
@@ -0,0 +1,122 @@
+package yfs
+
+// Blocks referenced by more than one file tree (the live tree, snapshots or
+// cloned files) are counted in FileSystemHeader.block_refs; every other used
+// block has a single owner. A count is the number of file trees that reach a
+// block, so copying a shared index block leaves the counts of its children
+// unchanged: they are still reached by the same trees. A deduplicated write
+// adds one more for every position that references an existing block.
+
+// blockRefs returns the number of file trees referencing a block
+func (yfs *YFS) blockRefs(blockID uint32) uint32 {
+	if refs, exists := yfs.header.BlockRefs[blockID]; exists {
+		return refs
+	}
+	return 1
+}
+
+// isSharedBlock reports whether more than one file tree references a block
+func (yfs *YFS) isSharedBlock(blockID uint32) bool {
+	return yfs.header.BlockRefs[blockID] > 1
+}
+
+// retainBlock adds a reference to a block
+func (yfs *YFS) retainBlock(blockID uint32) {
+	if yfs.header.BlockRefs == nil {
+		yfs.header.BlockRefs = make(map[uint32]uint32)
+	}
+	yfs.header.BlockRefs[blockID] = yfs.blockRefs(blockID) + 1
+}
+
+// releaseBlocks drops a reference to each block and frees the blocks that
+// nothing references anymore
+func (yfs *YFS) releaseBlocks(blockIDs []uint32) error {
+	var unused []uint32
+	for _, blockID := range blockIDs {
+		switch refs := yfs.header.BlockRefs[blockID]; {
+		case refs > 2:
+			yfs.header.BlockRefs[blockID] = refs - 1
+		case refs == 2:
+			delete(yfs.header.BlockRefs, blockID)
+		default:
+			unused = append(unused, blockID)
+		}
+	}
+
+	return yfs.freeBlocks(unused)
+}
+
+// retainFileBlocks adds a reference to every data and index block of a file
+func (yfs *YFS) retainFileBlocks(file *FileEntry) error {
+	return yfs.forEachFileBlock(file, func(blockID uint32) error {
+		yfs.retainBlock(blockID)
+		return nil
+	})
+}
+
+// unshareIndexBlock returns an index block only this file references,
+// copying a shared one. The caller must point the parent reference at the
+// returned block.
+func (yfs *YFS) unshareIndexBlock(idx *fileIndex, blockID uint32) (uint32, error) {
+	if !yfs.isSharedBlock(blockID) {
+		return blockID, nil
+	}
+
+	entries, err := yfs.indexNode(idx, blockID)
+	if err != nil {
+		return blockID, err
+	}
+
+	copyIDs, err := yfs.allocateBlocks(1)
+	if err != nil {
+		return blockID, err
+	}
+
+	idx.nodes[copyIDs[0]] = append([]uint32(nil), entries...)
+	idx.sums[copyIDs[0]] = append([]byte(nil), idx.sums[blockID]...)
+	idx.dirty[copyIDs[0]] = true
+	delete(idx.nodes, blockID)
+	delete(idx.sums, blockID)
+
+	return copyIDs[0], yfs.releaseBlocks([]uint32{blockID})
+}
+
+// unshareDataBlock points logical block n of a file at a block of its own
+// when its current data block is shared, and returns the block to write to.
+// The payload is not copied; callers write the whole block.
+func (yfs *YFS) unshareDataBlock(idx *fileIndex, n int64, blockID uint32) (uint32, error) {
+	if !yfs.isSharedBlock(blockID) {
+		return blockID, nil
+	}
+
+	copyIDs, err := yfs.allocateBlocks(1)
+	if err != nil {
+		return blockID, err
+	}
+
+	if err := yfs.setBlock(idx, n, copyIDs[0]); err != nil {
+		yfs.freeBlocks(copyIDs)
+		return blockID, err
+	}
+
+	return copyIDs[0], yfs.releaseBlocks([]uint32{blockID})
+}
+
+// fileHasSharedBlocks reports whether any block of a file is shared
+func (yfs *YFS) fileHasSharedBlocks(file *FileEntry) (bool, error) {
+	if len(yfs.header.BlockRefs) == 0 {
+		return false, nil
+	}
+
+	err := yfs.forEachFileBlock(file, func(blockID uint32) error {
+		if yfs.isSharedBlock(blockID) {
+			return errStopWalk
+		}
+		return nil
+	})
+	if err == errStopWalk {
+		return true, nil
+	}
+
+	return false, err
+}
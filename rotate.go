@@ -0,0 +1,238 @@
+package yfs
+
+import (
+	"context"
+	"crypto/cipher"
+	"fmt"
+)
+
+const reencryptBatchBlocks = 256 // Blocks re-encrypted per commit by RotateDataKey
+
+// ReencryptProgress describes how far a data key rotation has come
+type ReencryptProgress struct {
+	BlocksDone  uint64 // Block positions visited so far
+	BlocksTotal uint64 // Blocks of the volume
+	Reencrypted uint64 // Used blocks rewritten with the new data key
+}
+
+// RotateKey replaces the key encryption key. The data keys are unwrapped
+// with oldKEK and wrapped again with newKEK under a fresh salt; no block is
+// rewritten, so rotating a passphrase takes the same time on any volume.
+// The file system stays open with newKEK.
+func (yfs *YFS) RotateKey(oldKEK, newKEK KEK) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := newKEK.validate(); err != nil {
+		return err
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	if yfs.keys == nil {
+		return fmt.Errorf("file system is not encrypted")
+	}
+
+	params := yfs.header.Encryption
+	oldAEAD, oldKey, err := openKEK(params, oldKEK)
+	if err != nil {
+		return err
+	}
+
+	// File systems created without wrapped data keys seal blocks with the
+	// derived key itself; it becomes their first wrapped data key
+	dataKeys := [][]byte{oldKey}
+	if len(params.DataKeys) > 0 {
+		dataKeys = nil
+		for _, wrapped := range params.DataKeys {
+			key, err := unwrapKey(oldAEAD, wrapped)
+			if err != nil {
+				return err
+			}
+			dataKeys = append(dataKeys, key)
+		}
+	}
+
+	iterations := params.Iterations
+	if iterations == 0 {
+		iterations = yfs.opts.kdfIterations()
+	}
+
+	newParams, newAEAD, err := newEncryptionParams(newKEK, iterations, params.Metadata)
+	if err != nil {
+		return err
+	}
+	newParams.ReencryptNext = params.ReencryptNext
+
+	for _, key := range dataKeys {
+		wrapped, err := wrapKey(newAEAD, key)
+		if err != nil {
+			return err
+		}
+		newParams.DataKeys = append(newParams.DataKeys, wrapped)
+	}
+
+	yfs.cacheCipher(newParams, newAEAD)
+	yfs.header.Encryption = newParams
+	yfs.opts.Key, yfs.opts.Passphrase = newKEK.Key, newKEK.Passphrase
+
+	yfs.keys.mutex.Lock()
+	yfs.keys.kek = newAEAD
+	yfs.keys.mutex.Unlock()
+
+	// Save changes to both root copies, so the older one no longer holds
+	// the data keys wrapped by the old key
+	if err := yfs.commit(); err != nil {
+		return err
+	}
+	return yfs.commit()
+}
+
+// RotateDataKey replaces the data key blocks are sealed with. A new data key
+// is generated and every used block is read and written again with it, in
+// batches that are each committed on their own; the file system stays
+// usable between batches, and blocks written meanwhile are sealed with the
+// new key. Blocks not visited yet still open with the old keys, which are
+// dropped once the last batch commits.
+//
+// The rotation stops between two batches when ctx is cancelled; the next
+// call, also after reopening the file system, resumes it where it stopped.
+// progress, if not nil, is called after each batch.
+func (yfs *YFS) RotateDataKey(ctx context.Context, progress func(ReencryptProgress)) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := yfs.startDataKeyRotation(); err != nil {
+		return err
+	}
+
+	var state ReencryptProgress
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		done, err := yfs.reencryptBatch(&state)
+		if err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(state)
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// startDataKeyRotation adds a new current data key, unless a rotation is
+// already in progress
+func (yfs *YFS) startDataKeyRotation() error {
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	if yfs.keys == nil {
+		return fmt.Errorf("file system is not encrypted")
+	}
+
+	params := yfs.header.Encryption
+	if params.ReencryptNext != 0 {
+		return nil // Resume the rotation in progress
+	}
+
+	// Blocks of a file system without wrapped data keys are sealed with the
+	// derived key, which is kept as a wrapped data key until they are rewritten
+	if len(params.DataKeys) == 0 {
+		_, key, err := openKEK(params, yfs.opts.kek())
+		if err != nil {
+			return err
+		}
+
+		wrapped, err := wrapKey(yfs.keys.kek, key)
+		if err != nil {
+			return err
+		}
+		params.DataKeys = [][]byte{wrapped}
+	}
+
+	wrapped, dataKey, err := newDataKey(yfs.keys.kek)
+	if err != nil {
+		return err
+	}
+
+	params.DataKeys = append([][]byte{wrapped}, params.DataKeys...)
+	params.ReencryptNext = 1
+
+	yfs.keys.mutex.Lock()
+	yfs.keys.data = append([]cipher.AEAD{dataKey}, yfs.keys.data...)
+	yfs.keys.mutex.Unlock()
+
+	// Save changes
+	return yfs.commit()
+}
+
+// reencryptBatch rewrites the next batch of used blocks with the current
+// data key and reports whether the rotation is complete
+func (yfs *YFS) reencryptBatch(state *ReencryptProgress) (bool, error) {
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	params := yfs.header.Encryption
+	if params.ReencryptNext == 0 {
+		return true, nil // Completed by a concurrent call
+	}
+
+	total := yfs.bitmap.totalBlocks
+	start := params.ReencryptNext
+	end := min(start+reencryptBatchBlocks, total+1)
+
+	for blockID := start; blockID < end; {
+		if yfs.isBlockFree(blockID - 1) {
+			blockID++
+			continue // Never read again before being written
+		}
+
+		// Read contiguous runs of used blocks at once
+		count := uint64(1)
+		for blockID+count < end && !yfs.isBlockFree(blockID+count-1) {
+			count++
+		}
+
+		blocks, err := yfs.readFramedRun(uint32(blockID), uint32(count))
+		if err != nil {
+			return false, err
+		}
+
+		for i, framed := range blocks {
+			if err := yfs.writeFramedBlock(uint32(blockID)+uint32(i), framed); err != nil {
+				return false, err
+			}
+		}
+
+		state.Reencrypted += count
+		blockID += count
+	}
+
+	done := end > total
+	if done {
+		params.DataKeys = params.DataKeys[:1]
+		params.ReencryptNext = 0
+
+		yfs.keys.mutex.Lock()
+		yfs.keys.data = yfs.keys.data[:1]
+		yfs.keys.mutex.Unlock()
+	} else {
+		params.ReencryptNext = end
+	}
+
+	state.BlocksDone = end - 1
+	state.BlocksTotal = total
+
+	// Save changes
+	return done, yfs.commit()
+}
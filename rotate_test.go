@@ -0,0 +1,78 @@
+package yfs
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRotateKey(t *testing.T) {
+	for _, metadata := range []bool{false, true} {
+		name := "blocks"
+		if metadata {
+			name = "metadata"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			opts := Options{Passphrase: "old", KDFIterations: 1000, EncryptMetadata: metadata}
+			fs, dir := newTestFS(t, opts)
+
+			data := testData(10*fs.payloadSize(), 1)
+			if err := fs.WriteFile("/a", data); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fs.RotateKey(KEK{Passphrase: "wrong"}, KEK{Passphrase: "new"}); !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("rotation with the wrong old passphrase returned %v, want ErrWrongKey", err)
+			}
+			if err := fs.RotateKey(KEK{Passphrase: "old"}, KEK{Passphrase: "new"}); err != nil {
+				t.Fatal(err)
+			}
+
+			more := testData(3*fs.payloadSize(), 2)
+			if err := fs.WriteFile("/b", more); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := NewWithOptions(dir, Options{Passphrase: "old"}); !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("open with the old passphrase returned %v, want ErrWrongKey", err)
+			}
+
+			fs = openTestFS(t, dir, Options{Passphrase: "new"})
+			defer fs.Close()
+
+			expectFile(t, fs, "/a", data)
+			expectFile(t, fs, "/b", more)
+		})
+	}
+}
+
+func TestRotateDataKey(t *testing.T) {
+	opts := Options{Passphrase: "secret", KDFIterations: 1000}
+	fs, dir := newTestFS(t, opts)
+
+	data := testData(40*fs.payloadSize(), 1)
+	if err := fs.WriteFile("/a", data); err != nil {
+		t.Fatal(err)
+	}
+
+	var last ReencryptProgress
+	if err := fs.RotateDataKey(context.Background(), func(p ReencryptProgress) { last = p }); err != nil {
+		t.Fatal(err)
+	}
+	if last.Reencrypted == 0 {
+		t.Fatal("no block was re-encrypted")
+	}
+	if n := len(fs.keys.data); n != 1 {
+		t.Fatalf("%d data keys kept after the rotation, want 1", n)
+	}
+
+	fs = reopenTestFS(t, fs, dir, opts)
+	defer fs.Close()
+
+	expectFile(t, fs, "/a", data)
+	expectCheckClean(t, fs)
+}
@@ -0,0 +1,226 @@
+package yfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// SnapshotInfo describes a snapshot
+type SnapshotInfo struct {
+	Name       string
+	CreateTime time.Time
+	FileCount  int
+}
+
+// CreateSnapshot records the current directory tree under a name. The
+// snapshot shares every block with the live tree; blocks are copied when
+// the live tree modifies them, so creating a snapshot only writes the root.
+func (yfs *YFS) CreateSnapshot(name string) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	if _, exists := yfs.header.Snapshots[name]; exists {
+		return fmt.Errorf("snapshot already exists: %s", name)
+	}
+
+	err := walkFiles(yfs.header.Root, "", func(path string, file *FileEntry) error {
+		if err := yfs.retainFileBlocks(file); err != nil {
+			return fmt.Errorf("failed to read index of %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if yfs.header.Snapshots == nil {
+		yfs.header.Snapshots = make(map[string]*Snapshot)
+	}
+	yfs.header.Snapshots[name] = &Snapshot{
+		Name:       name,
+		CreateTime: time.Now().Unix(),
+		Root:       proto.Clone(yfs.header.Root).(*DirectoryEntry),
+	}
+
+	// Save changes
+	return yfs.commit()
+}
+
+// ListSnapshots returns the snapshots ordered by creation time
+func (yfs *YFS) ListSnapshots() []SnapshotInfo {
+	yfs.mutex.RLock()
+	defer yfs.mutex.RUnlock()
+
+	snapshots := make([]SnapshotInfo, 0, len(yfs.header.Snapshots))
+	for _, snapshot := range yfs.header.Snapshots {
+		count := 0
+		walkFiles(snapshot.Root, "", func(string, *FileEntry) error {
+			count++
+			return nil
+		})
+
+		snapshots = append(snapshots, SnapshotInfo{
+			Name:       snapshot.Name,
+			CreateTime: time.Unix(snapshot.CreateTime, 0),
+			FileCount:  count,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].CreateTime.Equal(snapshots[j].CreateTime) {
+			return snapshots[i].Name < snapshots[j].Name
+		}
+		return snapshots[i].CreateTime.Before(snapshots[j].CreateTime)
+	})
+
+	return snapshots
+}
+
+// DeleteSnapshot removes a snapshot and frees the blocks only it referenced
+func (yfs *YFS) DeleteSnapshot(name string) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	snapshot, exists := yfs.header.Snapshots[name]
+	if !exists {
+		return fmt.Errorf("snapshot not found: %s", name)
+	}
+
+	if yfs.snapshotViews[name] > 0 {
+		return fmt.Errorf("snapshot %s is open", name)
+	}
+
+	err := walkFiles(snapshot.Root, "", func(path string, file *FileEntry) error {
+		var blockIDs []uint32
+		err := yfs.forEachFileBlock(file, func(blockID uint32) error {
+			blockIDs = append(blockIDs, blockID)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read index of %s: %w", path, err)
+		}
+
+		return yfs.releaseBlocks(blockIDs)
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(yfs.header.Snapshots, name)
+
+	// Save changes
+	return yfs.commit()
+}
+
+// OpenSnapshot returns a read-only view of the file system as it was when
+// the snapshot was taken. The snapshot cannot be deleted and the volume
+// cannot be compacted until the view is closed.
+func (yfs *YFS) OpenSnapshot(name string) (*YFS, error) {
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	snapshot, exists := yfs.header.Snapshots[name]
+	if !exists {
+		return nil, fmt.Errorf("snapshot not found: %s", name)
+	}
+
+	opts := yfs.opts
+	opts.ReadOnly = true
+
+	view := &YFS{
+		rootPath:    yfs.rootPath,
+		altRootPath: yfs.altRootPath,
+		bitmapPath:  yfs.bitmapPath,
+		blocksPath:  yfs.blocksPath,
+		blockSize:   yfs.blockSize,
+		header: &FileSystemHeader{
+			Version:         yfs.header.Version,
+			BlockSize:       yfs.header.BlockSize,
+			Root:            proto.Clone(snapshot.Root).(*DirectoryEntry),
+			TotalBlocks:     yfs.header.TotalBlocks,
+			ChecksumEnabled: yfs.header.ChecksumEnabled,
+			Generation:      yfs.header.Generation,
+			Encryption:      yfs.header.Encryption,
+		},
+		bitmap:          yfs.bitmap,
+		checksumEnabled: yfs.checksumEnabled,
+		dataChecksum:    yfs.dataChecksum,
+		keys:            yfs.keys,
+		opts:            opts,
+		indexes:         make(map[*FileEntry]*fileIndex),
+		snapshotOf:      yfs,
+		snapshotName:    name,
+		ready:           true,
+	}
+
+	if yfs.snapshotViews == nil {
+		yfs.snapshotViews = make(map[string]int)
+	}
+	yfs.snapshotViews[name]++
+
+	return view, nil
+}
+
+// closeSnapshotView releases a view returned by OpenSnapshot
+func (yfs *YFS) closeSnapshotView() {
+	parent := yfs.snapshotOf
+	yfs.snapshotOf = nil
+
+	parent.mutex.Lock()
+	defer parent.mutex.Unlock()
+
+	if parent.snapshotViews[yfs.snapshotName]--; parent.snapshotViews[yfs.snapshotName] <= 0 {
+		delete(parent.snapshotViews, yfs.snapshotName)
+	}
+}
+
+// validateSnapshotName checks that a snapshot name can be stored and shown
+func validateSnapshotName(name string) error {
+	if name == "" {
+		return fmt.Errorf("snapshot name cannot be empty")
+	}
+
+	if strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid snapshot name: %q", name)
+	}
+
+	return nil
+}
+
+// walkAllFiles calls fn for every file of the live tree and of every
+// snapshot. Snapshot paths are prefixed with @name.
+func (yfs *YFS) walkAllFiles(fn func(path string, file *FileEntry) error) error {
+	if err := walkFiles(yfs.header.Root, "", fn); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(yfs.header.Snapshots))
+	for name := range yfs.header.Snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := walkFiles(yfs.header.Snapshots[name].Root, "@"+name, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
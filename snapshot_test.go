@@ -0,0 +1,154 @@
+package yfs
+
+import (
+	"testing"
+)
+
+// expectSnapshotFile fails the test unless a file of a snapshot holds want
+func expectSnapshotFile(t *testing.T, fs *YFS, name, path string, want []byte) {
+	t.Helper()
+
+	view, err := fs.OpenSnapshot(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+
+	expectFile(t, view, path, want)
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	payload := fs.payloadSize()
+
+	a := testData(20*payload, 1)
+	b := testData(5*payload, 2)
+	if err := fs.WriteFile("/a", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateDirectory("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/dir/b", b); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSnapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSnapshot("before"); err == nil {
+		t.Fatal("a second snapshot with the same name was created")
+	}
+
+	// Overwrite, patch, truncate and delete the live files
+	a2 := testData(20*payload, 3)
+	if err := fs.WriteFile("/a", a2); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteAt("/a", int64(3*payload+10), []byte("patched")); err != nil {
+		t.Fatal(err)
+	}
+	copy(a2[3*payload+10:], "patched")
+	if err := fs.DeleteFile("/dir/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectFile(t, fs, "/a", a2)
+	expectSnapshotFile(t, fs, "before", "/a", a)
+	expectSnapshotFile(t, fs, "before", "/dir/b", b)
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/a", a2)
+	if _, err := fs.GetFileInfo("/dir/b"); err == nil {
+		t.Fatal("the deleted file is back in the live tree")
+	}
+	expectSnapshotFile(t, fs, "before", "/a", a)
+	expectSnapshotFile(t, fs, "before", "/dir/b", b)
+
+	snapshots := fs.ListSnapshots()
+	if len(snapshots) != 1 || snapshots[0].Name != "before" || snapshots[0].FileCount != 2 {
+		t.Fatalf("ListSnapshots returned %+v", snapshots)
+	}
+
+	view, err := fs.OpenSnapshot("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := view.WriteFile("/a", b); err == nil {
+		t.Fatal("a snapshot view accepted a write")
+	}
+	view.Close()
+}
+
+func TestDeleteSnapshotRefcounts(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	payload := fs.payloadSize()
+	empty := usedBlocks(fs)
+
+	a := testData(30*payload, 1)
+	if err := fs.AppendFile("/a", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/b", testData(5*payload, 2)); err != nil {
+		t.Fatal(err)
+	}
+	live := usedBlocks(fs)
+
+	// A snapshot shares every block, so taking one allocates nothing
+	if err := fs.CreateSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSnapshot("s2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != live {
+		t.Fatalf("taking snapshots changed the used blocks from %d to %d", live, got)
+	}
+
+	// Deleting a live file keeps the blocks the snapshots still reference
+	if err := fs.DeleteFile("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != live {
+		t.Fatalf("deleting a snapshotted file freed %d blocks", live-got)
+	}
+
+	// Overwriting a block copies it
+	if err := fs.WriteAt("/a", 0, []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	copy(a, "changed")
+	if got := usedBlocks(fs); got <= live {
+		t.Fatal("overwriting a shared block did not copy it")
+	}
+
+	view, err := fs.OpenSnapshot("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteSnapshot("s1"); err == nil {
+		t.Fatal("an open snapshot was deleted")
+	}
+	view.Close()
+
+	if err := fs.DeleteSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	fs = reopenTestFS(t, fs, dir, Options{})
+	if err := fs.DeleteSnapshot("s2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteSnapshot("s2"); err == nil {
+		t.Fatal("a deleted snapshot was deleted again")
+	}
+
+	// Only the blocks of the live /a remain, none of them shared
+	if len(fs.header.BlockRefs) != 0 {
+		t.Fatalf("%d reference counts remain without snapshots", len(fs.header.BlockRefs))
+	}
+	if err := fs.DeleteFile("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != empty {
+		t.Fatalf("%d blocks are still used", got-empty)
+	}
+}
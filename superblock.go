@@ -0,0 +1,226 @@
+package yfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	RootMagic        = "YFSR" // Marks a checksummed root copy
+	BitmapMagic      = "YFSB" // Marks a checksummed bitmap
+	rootFrameSize    = 12     // Magic, root length and CRC32C in front of a root copy
+	bitmapFrameSize  = 24     // Magic, generation, total blocks and CRC32C in front of the bitmap
+	superblockPerm   = 0644
+	rootSlotCount    = 2
+	altRootExtension = ".alt"
+)
+
+// altRootPath returns the path of the second root copy, root.alt.yfs for root.yfs
+func altRootPath(rootPath string) string {
+	ext := filepath.Ext(rootPath)
+	return strings.TrimSuffix(rootPath, ext) + altRootExtension + ext
+}
+
+// rootSlotPath returns the root copy a generation is written to. Copies
+// alternate, so the previous generation survives a torn write of the next.
+func (yfs *YFS) rootSlotPath(generation uint64) string {
+	if generation%rootSlotCount == 0 {
+		return yfs.rootPath
+	}
+	return yfs.altRootPath
+}
+
+// rootExists reports whether any root copy is present
+func (yfs *YFS) rootExists() bool {
+	for _, path := range []string{yfs.rootPath, yfs.altRootPath} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRootSlot writes a serialized header, framed with its checksum, to the
+// root copy of its generation and syncs it
+func (yfs *YFS) writeRootSlot(generation uint64, data []byte) error {
+	frame := make([]byte, rootFrameSize, rootFrameSize+len(data))
+	copy(frame, RootMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(data)))
+	binary.LittleEndian.PutUint32(frame[8:12], crc32.Checksum(data, journalCRCTable))
+	frame = append(frame, data...)
+
+	file, err := os.OpenFile(yfs.rootSlotPath(generation), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, superblockPerm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(frame); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// readRootSlot parses a root copy. Roots written before copies were
+// checksummed are plain headers and count as generation 0.
+func (yfs *YFS) readRootSlot(path string) (*FileSystemHeader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) >= rootFrameSize && string(data[:4]) == RootMagic {
+		length := binary.LittleEndian.Uint32(data[4:8])
+		checksum := binary.LittleEndian.Uint32(data[8:12])
+		if uint64(len(data)-rootFrameSize) < uint64(length) {
+			return nil, fmt.Errorf("truncated root copy")
+		}
+
+		data = data[rootFrameSize : rootFrameSize+int(length)]
+		if crc32.Checksum(data, journalCRCTable) != checksum {
+			return nil, fmt.Errorf("root copy checksum mismatch")
+		}
+	}
+
+	if isSealed(data) {
+		if data, err = yfs.openMetadata(data); err != nil {
+			return nil, err
+		}
+	}
+
+	header := &FileSystemHeader{}
+	if err := proto.Unmarshal(data, header); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal root: %w", err)
+	}
+
+	if header.Root == nil || header.BlockSize == 0 {
+		return nil, fmt.Errorf("incomplete root")
+	}
+
+	initDirectoryMaps(header.Root)
+	return header, nil
+}
+
+// loadRoot returns the newest valid root copy
+func (yfs *YFS) loadRoot() (*FileSystemHeader, error) {
+	var newest *FileSystemHeader
+	var errs []string
+
+	for _, path := range []string{yfs.rootPath, yfs.altRootPath} {
+		header, err := yfs.readRootSlot(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if isKeyError(err) {
+			return nil, err
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", filepath.Base(path), err))
+			continue
+		}
+
+		if newest == nil || header.Generation > newest.Generation {
+			newest = header
+		}
+	}
+
+	if newest == nil {
+		return nil, fmt.Errorf("no valid root copy found (%s)", strings.Join(errs, "; "))
+	}
+
+	return newest, nil
+}
+
+// encodeBitmap frames the bitmap with the generation of the root it belongs
+// to and a checksum over both
+func encodeBitmap(generation, totalBlocks uint64, bits []byte) []byte {
+	data := make([]byte, bitmapFrameSize, bitmapFrameSize+len(bits))
+	copy(data, BitmapMagic)
+	binary.LittleEndian.PutUint64(data[4:12], generation)
+	binary.LittleEndian.PutUint64(data[12:20], totalBlocks)
+	data = append(data, bits...)
+
+	binary.LittleEndian.PutUint32(data[20:24], bitmapChecksum(data))
+	return data
+}
+
+// decodeBitmap parses a bitmap file and returns the generation it was saved
+// with. Bitmaps written before they were checksummed are trusted as they are;
+// they report ok with the generation of the loaded root.
+func (yfs *YFS) decodeBitmap(data []byte) (generation, totalBlocks uint64, bits []byte, err error) {
+	if isSealed(data) {
+		if data, err = yfs.openMetadata(data); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	if len(data) >= bitmapFrameSize && string(data[:4]) == BitmapMagic {
+		if binary.LittleEndian.Uint32(data[20:24]) != bitmapChecksum(data) {
+			return 0, 0, nil, fmt.Errorf("bitmap checksum mismatch")
+		}
+
+		generation = binary.LittleEndian.Uint64(data[4:12])
+		totalBlocks = binary.LittleEndian.Uint64(data[12:20])
+		bits = data[bitmapFrameSize:]
+	} else {
+		if len(data) < 8 {
+			return 0, 0, nil, fmt.Errorf("invalid bitmap file format")
+		}
+
+		generation = yfs.header.Generation
+		totalBlocks = binary.LittleEndian.Uint64(data[:8])
+		bits = data[8:]
+	}
+
+	if uint64(len(bits)) < (totalBlocks+7)/8 {
+		return 0, 0, nil, fmt.Errorf("truncated bitmap")
+	}
+
+	return generation, totalBlocks, bits, nil
+}
+
+// bitmapChecksum returns the CRC32C of a framed bitmap, skipping the checksum field
+func bitmapChecksum(data []byte) uint32 {
+	checksum := crc32.Update(0, journalCRCTable, data[:20])
+	return crc32.Update(checksum, journalCRCTable, data[bitmapFrameSize:])
+}
+
+// rebuildBitmap recomputes the bitmap from the blocks referenced by the root,
+// for when the saved bitmap is missing, corrupt or from another generation
+func (yfs *YFS) rebuildBitmap() error {
+	total := yfs.header.TotalBlocks
+	if size, err := yfs.blocksFileSize(); err == nil && size > HeaderSize {
+		total = max(total, uint64(size-HeaderSize)/uint64(yfs.blockSize))
+	}
+
+	yfs.bitmap = &BlockBitmap{dirty: true}
+	yfs.resizeBitmap(total)
+	yfs.header.TotalBlocks = total
+
+	return yfs.walkAllFiles(func(path string, file *FileEntry) error {
+		err := yfs.forEachFileBlock(file, func(blockID uint32) error {
+			if blockID == NullBlockID || uint64(blockID) > total {
+				return fmt.Errorf("block %d out of range", blockID)
+			}
+
+			yfs.markBlockUsed(uint64(blockID - 1))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to rebuild bitmap from %s: %w", path, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,121 @@
+package yfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// corruptFile flips a byte in the middle of a file
+func corruptFile(t *testing.T, path string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRootSlotRecovery(t *testing.T) {
+	damage := map[string]func(t *testing.T, path string){
+		"torn": func(t *testing.T, path string) {
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(path, info.Size()/2); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"corrupt": corruptFile,
+	}
+
+	for name, damageSlot := range damage {
+		t.Run(name, func(t *testing.T) {
+			fs, dir := newTestFS(t, Options{})
+
+			a := testData(10*fs.payloadSize(), 1)
+			if err := fs.WriteFile("/a", a); err != nil {
+				t.Fatal(err)
+			}
+			used := usedBlocks(fs)
+			previous := fs.header.Generation
+
+			if err := fs.WriteFile("/b", testData(10*fs.payloadSize(), 2)); err != nil {
+				t.Fatal(err)
+			}
+			if fs.rootSlotPath(fs.header.Generation) == fs.rootSlotPath(previous) {
+				t.Fatal("consecutive generations share a root copy")
+			}
+
+			// The newest copy is damaged, so the previous generation wins and
+			// the bitmap saved with the newest one is rebuilt
+			damageSlot(t, fs.rootSlotPath(fs.header.Generation))
+
+			fs = openTestFS(t, dir, Options{})
+			if fs.header.Generation <= previous {
+				t.Fatalf("recovery was committed as generation %d, previous was %d", fs.header.Generation, previous)
+			}
+			expectFile(t, fs, "/a", a)
+			if _, err := fs.GetFileInfo("/b"); err == nil {
+				t.Fatal("the file of the damaged generation survived")
+			}
+			if got := usedBlocks(fs); got != used {
+				t.Fatalf("%d blocks used after recovery, want %d", got, used)
+			}
+
+			fs = reopenTestFS(t, fs, dir, Options{})
+			expectFile(t, fs, "/a", a)
+		})
+	}
+}
+
+func TestBothRootSlotsCorrupt(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	if err := fs.WriteFile("/a", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptFile(t, fs.rootSlotPath(fs.header.Generation))
+	corruptFile(t, fs.rootSlotPath(fs.header.Generation+1))
+
+	if _, err := New(dir); err == nil {
+		t.Fatal("a file system without a valid root copy was opened")
+	}
+}
+
+func TestCorruptBitmapRebuilt(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	a := testData(10*fs.payloadSize(), 1)
+	if err := fs.WriteFile("/a", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.AppendFile("/b", testData(30*fs.payloadSize(), 2)); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptFile(t, filepath.Join(dir, "bitmap.yfs"))
+
+	fs = openTestFS(t, dir, Options{})
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("the rebuilt bitmap marks %d blocks used, want %d", got, used)
+	}
+
+	// New blocks do not land on the files' blocks
+	c := testData(5*fs.payloadSize(), 3)
+	if err := fs.WriteFile("/c", c); err != nil {
+		t.Fatal(err)
+	}
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/a", a)
+	expectFile(t, fs, "/c", c)
+}
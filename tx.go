@@ -0,0 +1,114 @@
+package yfs
+
+import (
+	"errors"
+)
+
+// ErrTxDone is returned by operations on a transaction that has already
+// been committed or rolled back
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx groups several operations into one journaled commit. The file system
+// is locked for writing from Begin until Commit or Rollback, so other
+// goroutines never see a partial transaction; the goroutine holding a
+// transaction must go through it instead of calling the YFS methods.
+type Tx struct {
+	fs    *YFS
+	saved *savepoint // State as it was when the transaction began
+	done  bool
+}
+
+// Begin starts a transaction
+func (yfs *YFS) Begin() *Tx {
+	yfs.mutex.Lock()
+
+	return &Tx{
+		fs:    yfs,
+		saved: yfs.save(),
+	}
+}
+
+// check returns the error an operation on the transaction should fail with
+func (tx *Tx) check() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.fs.checkWritable()
+}
+
+// WriteFile creates or updates a file within the transaction
+func (tx *Tx) WriteFile(path string, data []byte) error {
+	return tx.WriteFileWithOptions(path, data, WriteOptions{})
+}
+
+// WriteFileWithOptions creates or updates a file within the transaction
+// using the given options
+func (tx *Tx) WriteFileWithOptions(path string, data []byte, opts WriteOptions) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.fs.writeFileUnsafe(path, data, opts)
+}
+
+// ReadFile reads a file as the transaction sees it
+func (tx *Tx) ReadFile(path string) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.fs.readFileUnsafe(path)
+}
+
+// DeleteFile deletes a file within the transaction
+func (tx *Tx) DeleteFile(path string) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.fs.deleteFileUnsafe(path)
+}
+
+// CreateDirectory creates a directory within the transaction
+func (tx *Tx) CreateDirectory(path string) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.fs.createDirectoryUnsafe(path)
+}
+
+// Rename moves a file or directory within the transaction
+func (tx *Tx) Rename(srcPath, dstPath string) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.fs.renameUnsafe(srcPath, dstPath)
+}
+
+// Commit makes every change of the transaction durable as a single journal
+// record and releases the file system
+func (tx *Tx) Commit() error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+
+	defer tx.finish()
+	return tx.fs.commit()
+}
+
+// Rollback discards every change of the transaction and releases the file
+// system. Blocks written by the transaction are freed again; nothing on disk
+// references them. Changes made before Begin, such as the uncommitted writes
+// of open file handles, are kept.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	defer tx.finish()
+	tx.fs.restore(tx.saved)
+	return nil
+}
+
+// finish ends the transaction and unlocks the file system
+func (tx *Tx) finish() {
+	tx.done = true
+	tx.fs.mutex.Unlock()
+}
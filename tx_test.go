@@ -0,0 +1,151 @@
+package yfs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTxCommit(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	data := testData(10*fs.payloadSize(), 1)
+
+	tx := fs.Begin()
+	if err := tx.CreateDirectory("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.WriteFile("/d/a", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rename("/d/a", "/d/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tx.ReadFile("/d/b"); err != nil || len(got) != len(data) {
+		t.Fatalf("transaction does not see its own write: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("second commit returned %v, want ErrTxDone", err)
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	defer fs.Close()
+
+	expectFile(t, fs, "/d/b", data)
+	if _, err := fs.ReadFile("/d/a"); err == nil {
+		t.Fatal("renamed file still exists")
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	kept := testData(5*fs.payloadSize(), 1)
+	if err := fs.WriteFile("/kept", kept); err != nil {
+		t.Fatal(err)
+	}
+
+	used := usedBlocks(fs)
+	tx := fs.Begin()
+	if err := tx.WriteFile("/new", testData(20*fs.payloadSize(), 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.DeleteFile("/kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.WriteFile("/late", nil); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("write after rollback returned %v, want ErrTxDone", err)
+	}
+
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("%d used blocks after rollback, want %d", got, used)
+	}
+	expectFile(t, fs, "/kept", kept)
+	if _, err := fs.ReadFile("/new"); err == nil {
+		t.Fatal("rolled back file exists")
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	defer fs.Close()
+
+	expectFile(t, fs, "/kept", kept)
+	if _, err := fs.ReadFile("/new"); err == nil {
+		t.Fatal("rolled back file exists after reopening")
+	}
+}
+
+func TestTxRollbackThenCreateDirectory(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	tx := fs.Begin()
+	if err := tx.WriteFile("/a", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.CreateDirectory("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateDirectory("/d/e"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty directories come back from disk without maps too
+	fs = reopenTestFS(t, fs, dir, Options{})
+	defer fs.Close()
+
+	if err := fs.CreateDirectory("/d/e/x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/d/e/x/file", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, fs, "/d/e/x/file", []byte("data"))
+}
+
+func TestTxRollbackKeepsOpenHandleWrites(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	// The handle's blocks are allocated but stay uncommitted until Close
+	f, err := fs.Create("/h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := testData(20000, 1)
+	if _, err := f.Write(h); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fs.Begin()
+	if err := tx.WriteFile("/x", testData(9000, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// New blocks must not be allocated over the handle's
+	y := testData(20000, 3)
+	if err := fs.WriteFile("/y", y); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, fs, "/h", h)
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	defer fs.Close()
+
+	expectFile(t, fs, "/h", h)
+	expectFile(t, fs, "/y", y)
+	if _, err := fs.ReadFile("/x"); err == nil {
+		t.Fatal("rolled back file exists")
+	}
+}
@@ -1,6 +1,7 @@
 package yfs
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
@@ -16,15 +17,19 @@ import (
 
 const (
 	DefaultBlockSize  = 4096
-	HeaderSize        = 4 // Block size as uint32
+	FormatVersion     = 3  // On-disk format written by this version
+	HeaderSize        = 4  // Block size as uint32
+	BlockHeaderSize   = 20 // Type, payload length, checksum and owner at the start of every block
 	NullBlockID       = 0
-	MaxBlocksPerIndex = 1000 // Maximum block IDs per index block
+	MaxBlocksPerIndex = 1000 // Maximum block IDs per index block of a legacy chain
+	MaxBlocksPerRead  = 256  // Maximum blocks fetched by a single sequential read
 	BitmapCacheSize   = 1024 // Number of bitmap bytes to cache
 )
 
 // YFS represents the refactored file system
 type YFS struct {
 	rootPath        string
+	altRootPath     string // Second root copy, written on alternate generations
 	bitmapPath      string
 	blocksPath      string
 	blockSize       uint32
@@ -32,6 +37,24 @@ type YFS struct {
 	bitmap          *BlockBitmap
 	mutex           sync.RWMutex
 	checksumEnabled bool
+	dataChecksum    DataChecksumMode // Checksum kept for every data block
+	opts            Options
+
+	keys    *keyring               // Keys of an encrypted file system, nil otherwise
+	ciphers map[string]cipher.AEAD // Key encryption keys by derivation parameters, derived once
+
+	indexes    map[*FileEntry]*fileIndex // Lazily loaded file indexes
+	dedupKeys  map[uint32]uint64         // Reverse of the dedup index, built on first use
+	indexMutex sync.Mutex
+
+	journalPath     string
+	journalSequence uint64
+	op              *journalOp // Operation in progress, committed through the journal
+	ready           bool       // Whether changes are tracked by the journal
+
+	snapshotViews map[string]int // Open OpenSnapshot views by snapshot name
+	snapshotOf    *YFS           // File system a snapshot view was opened from
+	snapshotName  string         // Snapshot a view shows
 }
 
 // BlockBitmap manages free/used blocks efficiently
@@ -51,25 +74,68 @@ type FileInfo struct {
 	ModTime     time.Time
 	CreateTime  time.Time
 	BlockCount  uint32
+	Compression Compression // Algorithm the file's data is stored with
+	StoredSize  int64       // Bytes the file's data takes in data blocks
+	Inline      bool        // Whether the file's data is kept in root.yfs instead of in blocks
+}
+
+// CompressionRatio returns the logical size of a file per stored byte
+func (info *FileInfo) CompressionRatio() float64 {
+	return compressionRatio(info.Size, info.StoredSize)
+}
+
+// fileInfo describes a file entry
+func fileInfo(name string, file *FileEntry) FileInfo {
+	info := FileInfo{
+		Name:        name,
+		IsDirectory: false,
+		Size:        file.Size,
+		ModTime:     time.Unix(file.Metadata.ModTime, 0),
+		CreateTime:  time.Unix(file.Metadata.CreateTime, 0),
+		BlockCount:  file.DataBlockCount,
+		Compression: compressionFromEntry(file.Compression),
+		StoredSize:  file.Size,
+	}
+
+	if file.Compression != 0 {
+		info.StoredSize = file.StoredSize
+	}
+
+	if isInline(file) {
+		info.Inline = true
+		info.StoredSize = 0
+	}
+
+	return info
 }
 
 // New creates a new YFS instance from a directory
 func New(dir string) (*YFS, error) {
-	return NewFromPaths(
-		filepath.Join(dir, "root.yfs"),
-		filepath.Join(dir, "bitmap.yfs"),
-		filepath.Join(dir, "blocks.glob"),
-	)
+	return NewWithOptions(dir, Options{})
 }
 
 // NewFromPaths creates a new YFS instance from individual file paths
 func NewFromPaths(rootPath, bitmapPath, blocksPath string) (*YFS, error) {
+	return NewFromPathsWithOptions(rootPath, bitmapPath, blocksPath, Options{})
+}
+
+// NewFromPathsWithOptions creates a new YFS instance from individual file paths using the given options
+func NewFromPathsWithOptions(rootPath, bitmapPath, blocksPath string, opts Options) (*YFS, error) {
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
+
 	yfs := &YFS{
 		rootPath:        rootPath,
+		altRootPath:     altRootPath(rootPath),
 		bitmapPath:      bitmapPath,
 		blocksPath:      blocksPath,
-		blockSize:       DefaultBlockSize,
-		checksumEnabled: true,
+		journalPath:     opts.journalPath(rootPath),
+		blockSize:       opts.blockSize(),
+		checksumEnabled: opts.Checksums != ChecksumNone,
+		dataChecksum:    opts.dataChecksum(),
+		opts:            opts,
+		indexes:         make(map[*FileEntry]*fileIndex),
 	}
 
 	if err := yfs.initialize(); err != nil {
@@ -84,20 +150,28 @@ func (yfs *YFS) initialize() error {
 	yfs.mutex.Lock()
 	defer yfs.mutex.Unlock()
 
-	// Check if root file exists
-	if _, err := os.Stat(yfs.rootPath); os.IsNotExist(err) {
-		return yfs.createFileSystem()
+	// Check if either root copy exists
+	if !yfs.rootExists() {
+		if yfs.opts.ReadOnly {
+			return fmt.Errorf("file system not found: %s", yfs.rootPath)
+		}
+		if err := yfs.createFileSystem(); err != nil {
+			return err
+		}
+	} else if err := yfs.loadFileSystem(); err != nil {
+		return err
 	}
 
-	return yfs.loadFileSystem()
+	yfs.ready = true
+	return nil
 }
 
 // createFileSystem creates a new empty file system
 func (yfs *YFS) createFileSystem() error {
-	// Create header with default settings
+	// Create header with the requested settings
 	yfs.header = &FileSystemHeader{
-		Version:   2,
-		BlockSize: DefaultBlockSize,
+		Version:   FormatVersion,
+		BlockSize: yfs.blockSize,
 		Root: &DirectoryEntry{
 			Metadata: &FileMetadata{
 				Name:       "/",
@@ -107,14 +181,26 @@ func (yfs *YFS) createFileSystem() error {
 			Files:       make(map[string]*FileEntry),
 			Directories: make(map[string]*DirectoryEntry),
 		},
-		TotalBlocks:     0,
-		ChecksumEnabled: 1,
+		TotalBlocks:     yfs.opts.initialBlocks(),
+		ChecksumEnabled: yfs.opts.Checksums.headerValue(),
+		DataChecksum:    yfs.dataChecksum.headerValue(),
+		Dedup:           yfs.opts.Dedup,
+	}
+
+	if yfs.opts.encrypted() {
+		params, keys, err := yfs.newKeyring()
+		if err != nil {
+			return err
+		}
+		yfs.header.Encryption = params
+		yfs.keys = keys
 	}
 
 	// Initialize bitmap
+	initialBlocks := yfs.header.TotalBlocks
 	yfs.bitmap = &BlockBitmap{
-		data:        make([]byte, 1024), // Start with 8192 blocks capacity
-		totalBlocks: 8192,
+		data:        make([]byte, (initialBlocks+7)/8),
+		totalBlocks: initialBlocks,
 		searchPos:   0,
 		dirty:       true,
 	}
@@ -132,54 +218,116 @@ func (yfs *YFS) createFileSystem() error {
 		return err
 	}
 
-	return nil
+	return yfs.extendBlocksFile(initialBlocks)
 }
 
 // loadFileSystem loads an existing file system
 func (yfs *YFS) loadFileSystem() error {
-	// Load root
-	data, err := os.ReadFile(yfs.rootPath)
+	records, err := yfs.readJournal()
 	if err != nil {
-		return fmt.Errorf("failed to read root file: %w", err)
+		return err
+	}
+
+	// Load the newest root copy, unless a journaled operation supersedes it
+	if len(records) > 0 {
+		if yfs.header, err = journaledHeader(records); err != nil {
+			return err
+		}
+	} else if yfs.header, err = yfs.loadRoot(); err != nil {
+		return err
 	}
 
-	yfs.header = &FileSystemHeader{}
-	if err := proto.Unmarshal(data, yfs.header); err != nil {
-		return fmt.Errorf("failed to unmarshal root: %w", err)
+	if err := yfs.validateHeader(); err != nil {
+		return err
+	}
+
+	if err := yfs.loadKeys(); err != nil {
+		return err
 	}
 
 	yfs.blockSize = yfs.header.BlockSize
 	yfs.checksumEnabled = yfs.header.ChecksumEnabled > 0
+	if yfs.dataChecksum, err = dataChecksumFromHeader(yfs.header.DataChecksum); err != nil {
+		return err
+	}
+
+	// Dedup can be turned on for an existing file system; blocks written
+	// before are not indexed
+	if yfs.opts.Dedup && !yfs.opts.ReadOnly {
+		yfs.header.Dedup = true
+	}
 
 	// Load bitmap
-	if err := yfs.loadBitmap(); err != nil {
+	bitmapValid, err := yfs.loadBitmap(uint64(len(records)))
+	if err != nil {
 		return err
 	}
 
-	return nil
+	yfs.reconcileTotalBlocks()
+
+	if len(records) > 0 {
+		yfs.replayJournal(records)
+	}
+
+	if !bitmapValid {
+		if err := yfs.rebuildBitmap(); err != nil {
+			return err
+		}
+	}
+
+	// Recovery is committed as an operation of its own, under a new generation
+	if !yfs.opts.ReadOnly && (len(records) > 0 || !bitmapValid) {
+		if err := yfs.commit(); err != nil {
+			return fmt.Errorf("failed to recover file system: %w", err)
+		}
+	}
+
+	return yfs.validateCapacity()
 }
 
-// loadBitmap loads the block bitmap from disk
-func (yfs *YFS) loadBitmap() error {
-	data, err := os.ReadFile(yfs.bitmapPath)
-	if err != nil {
-		return fmt.Errorf("failed to read bitmap file: %w", err)
+// reconcileTotalBlocks brings the header and the bitmap to the same block
+// count. Images written before the header tracked it only have the bitmap's;
+// if a save was interrupted after the volume grew, the larger count wins.
+func (yfs *YFS) reconcileTotalBlocks() {
+	total := max(yfs.header.TotalBlocks, yfs.bitmap.totalBlocks)
+
+	if yfs.bitmap.totalBlocks != total {
+		yfs.resizeBitmap(total)
+		yfs.bitmap.dirty = true
 	}
 
-	if len(data) < 8 {
-		return fmt.Errorf("invalid bitmap file format")
+	yfs.header.TotalBlocks = total
+}
+
+// loadBitmap loads the block bitmap from disk and reports whether it
+// belongs to the loaded root. A bitmap may lag the root by the journaled
+// operations about to be replayed; one that is missing, corrupt or from
+// another generation is replaced by an empty one and must be rebuilt.
+func (yfs *YFS) loadBitmap(journaled uint64) (bool, error) {
+	data, err := os.ReadFile(yfs.bitmapPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to read bitmap file: %w", err)
 	}
 
-	totalBlocks := binary.LittleEndian.Uint64(data[:8])
-	bitmapData := data[8:]
+	if err == nil {
+		generation, totalBlocks, bitmapData, err := yfs.decodeBitmap(data)
+		if err == nil && generation <= yfs.header.Generation && generation+journaled >= yfs.header.Generation {
+			yfs.bitmap = &BlockBitmap{
+				data:        bitmapData,
+				totalBlocks: totalBlocks,
+				searchPos:   0,
+			}
+			return true, nil
+		}
 
-	yfs.bitmap = &BlockBitmap{
-		data:        bitmapData,
-		totalBlocks: totalBlocks,
-		searchPos:   0,
+		// Never reuse the generation of a newer bitmap whose root was lost
+		if err == nil && generation > yfs.header.Generation {
+			yfs.header.Generation = generation
+		}
 	}
 
-	return nil
+	yfs.bitmap = &BlockBitmap{}
+	return false, nil
 }
 
 // saveBitmap saves the block bitmap to disk
@@ -191,21 +339,12 @@ func (yfs *YFS) saveBitmap() error {
 		return nil
 	}
 
-	file, err := os.Create(yfs.bitmapPath)
+	data, err := yfs.sealMetadataFile(encodeBitmap(yfs.header.Generation, yfs.bitmap.totalBlocks, yfs.bitmap.data))
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	// Write total blocks count
-	header := make([]byte, 8)
-	binary.LittleEndian.PutUint64(header, yfs.bitmap.totalBlocks)
-	if _, err := file.Write(header); err != nil {
-		return err
-	}
 
-	// Write bitmap data
-	if _, err := file.Write(yfs.bitmap.data); err != nil {
+	if err := writeFileAtomic(yfs.bitmapPath, data); err != nil {
 		return err
 	}
 
@@ -213,18 +352,73 @@ func (yfs *YFS) saveBitmap() error {
 	return nil
 }
 
-// saveRoot saves the root directory to disk
+// saveRoot saves the root directory to the root copy of the current generation
 func (yfs *YFS) saveRoot() error {
+	data, err := yfs.marshalRoot()
+	if err != nil {
+		return err
+	}
+
+	if data, err = yfs.sealMetadataFile(data); err != nil {
+		return err
+	}
+
+	return yfs.writeRootSlot(yfs.header.Generation, data)
+}
+
+// marshalRoot serializes the header with an up to date root checksum
+func (yfs *YFS) marshalRoot() ([]byte, error) {
 	if yfs.checksumEnabled {
 		yfs.updateMetadataChecksum(yfs.header.Root.Metadata)
 	}
 
 	data, err := proto.Marshal(yfs.header)
 	if err != nil {
-		return fmt.Errorf("failed to marshal root: %w", err)
+		return nil, fmt.Errorf("failed to marshal root: %w", err)
+	}
+
+	return data, nil
+}
+
+// writeFileAtomic replaces a file with data so that a crash leaves either the
+// old or the new contents, never a mix of both
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// syncBlocksFile flushes blocks.glob to stable storage
+func (yfs *YFS) syncBlocksFile() error {
+	file, err := os.OpenFile(yfs.blocksPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	return os.WriteFile(yfs.rootPath, data, 0644)
+	return file.Sync()
 }
 
 // createEmptyBlocksFile creates the blocks file with header
@@ -274,6 +468,17 @@ func (yfs *YFS) calculateBlockOffset(blockID uint32) int64 {
 	return int64(HeaderSize) + int64(yfs.blockSize)*int64(blockID-1)
 }
 
+// payloadSize returns how many bytes of file data fit in a single block
+func (yfs *YFS) payloadSize() int {
+	return int(yfs.blockSize) - yfs.blockHeaderSize() - yfs.blockOverhead()
+}
+
+// dataBlocksFor returns the number of data blocks needed to hold size bytes
+func (yfs *YFS) dataBlocksFor(size int64) uint32 {
+	payloadSize := int64(yfs.payloadSize())
+	return uint32((size + payloadSize - 1) / payloadSize)
+}
+
 // allocateBlocks allocates multiple contiguous blocks using intelligent bitmap search
 func (yfs *YFS) allocateBlocks(count uint32) ([]uint32, error) {
 	yfs.bitmap.mutex.Lock()
@@ -316,10 +521,78 @@ func (yfs *YFS) allocateBlocks(count uint32) ([]uint32, error) {
 
 	// If we couldn't find contiguous blocks, try to allocate individual blocks
 	if count > 1 {
-		return yfs.allocateBlocksIndividual(count)
+		if allocatedBlocks, err := yfs.allocateBlocksIndividual(count); err == nil {
+			return allocatedBlocks, nil
+		}
+	}
+
+	// Grow the volume so the blocks fit in a contiguous run at its end
+	return yfs.allocateBlocksAtEnd(count)
+}
+
+// allocateBlocksAtEnd grows the volume and allocates count contiguous blocks
+// at its end, reusing any free blocks the volume already ends with
+func (yfs *YFS) allocateBlocksAtEnd(count uint32) ([]uint32, error) {
+	total := yfs.bitmap.totalBlocks
+
+	tailFree := uint64(0)
+	for tailFree < uint64(count) && tailFree < total && yfs.isBlockFree(total-1-tailFree) {
+		tailFree++
+	}
+
+	if err := yfs.growBitmap(uint64(count) - tailFree); err != nil {
+		return nil, err
+	}
+
+	pos := total - tailFree
+	allocatedBlocks := make([]uint32, 0, count)
+	for j := uint32(0); j < count; j++ {
+		yfs.markBlockUsed(pos + uint64(j))
+		allocatedBlocks = append(allocatedBlocks, uint32(pos+uint64(j)+1)) // Block IDs are 1-based
+	}
+
+	yfs.bitmap.searchPos = pos + uint64(count)
+	yfs.bitmap.dirty = true
+	return allocatedBlocks, nil
+}
+
+// growBitmap adds at least count blocks to the volume, extending both the
+// bitmap and blocks.glob. The volume never grows past MaxBlocks.
+func (yfs *YFS) growBitmap(count uint64) error {
+	if count == 0 {
+		return nil
+	}
+
+	total := yfs.bitmap.totalBlocks
+	limit := yfs.opts.maxBlocks()
+	if total+count > limit {
+		return fmt.Errorf("no free blocks available: file system is limited to %d blocks", limit)
+	}
+
+	newTotal := min(total+max(count, yfs.opts.growthBlocks(total)), limit)
+	if err := yfs.extendBlocksFile(newTotal); err != nil {
+		return fmt.Errorf("failed to grow blocks file: %w", err)
+	}
+
+	yfs.resizeBitmap(newTotal)
+	yfs.bitmap.dirty = true
+	yfs.header.TotalBlocks = newTotal
+	return nil
+}
+
+// extendBlocksFile makes blocks.glob large enough to hold totalBlocks blocks
+func (yfs *YFS) extendBlocksFile(totalBlocks uint64) error {
+	info, err := os.Stat(yfs.blocksPath)
+	if err != nil {
+		return err
+	}
+
+	size := int64(HeaderSize) + int64(totalBlocks)*int64(yfs.blockSize)
+	if info.Size() >= size {
+		return nil
 	}
 
-	return nil, fmt.Errorf("no free blocks available")
+	return os.Truncate(yfs.blocksPath, size)
 }
 
 // allocateBlocksIndividual allocates blocks individually when contiguous allocation fails
@@ -369,10 +642,8 @@ func (yfs *YFS) markBlockUsed(blockPos uint64) {
 	byteIndex := blockPos / 8
 	bitIndex := blockPos % 8
 
-	// Expand bitmap if necessary
-	for byteIndex >= uint64(len(yfs.bitmap.data)) {
-		yfs.bitmap.data = append(yfs.bitmap.data, make([]byte, 1024)...)
-		yfs.bitmap.totalBlocks += 8192
+	if yfs.ready {
+		yfs.trackBitmapChange(blockPos)
 	}
 
 	yfs.bitmap.data[byteIndex] |= (1 << bitIndex)
@@ -384,6 +655,10 @@ func (yfs *YFS) markBlockFree(blockPos uint64) {
 	bitIndex := blockPos % 8
 
 	if byteIndex < uint64(len(yfs.bitmap.data)) {
+		if yfs.ready {
+			yfs.trackBitmapChange(blockPos)
+		}
+
 		yfs.bitmap.data[byteIndex] &^= (1 << bitIndex)
 		yfs.bitmap.dirty = true
 	}
@@ -391,6 +666,8 @@ func (yfs *YFS) markBlockFree(blockPos uint64) {
 
 // freeBlocks frees multiple blocks in the bitmap
 func (yfs *YFS) freeBlocks(blockIDs []uint32) error {
+	yfs.forgetDedupBlocks(blockIDs)
+
 	yfs.bitmap.mutex.Lock()
 	defer yfs.bitmap.mutex.Unlock()
 
@@ -404,8 +681,36 @@ func (yfs *YFS) freeBlocks(blockIDs []uint32) error {
 	return nil
 }
 
-// writeBlock writes data to a specific block
-func (yfs *YFS) writeBlock(blockID uint32, data []byte) error {
+// writeBlock writes file data owned by an inode to a specific block
+func (yfs *YFS) writeBlock(blockID uint32, owner uint64, data []byte) error {
+	if len(data) > yfs.payloadSize() {
+		return fmt.Errorf("data exceeds block size limit: %d bytes, max: %d bytes", len(data), yfs.payloadSize())
+	}
+
+	return yfs.writeFramedBlock(blockID, frameBlock(blockData, owner, data))
+}
+
+// writeFramedBlock writes a block header and payload to a specific block.
+// Blocks that were in use when the current operation started are only
+// written once the operation commits.
+func (yfs *YFS) writeFramedBlock(blockID uint32, framed []byte) error {
+	if !yfs.ready {
+		return yfs.writeBlockDirect(blockID, framed)
+	}
+
+	op := yfs.pendingOp()
+	if !yfs.isFreshBlock(op, blockID) {
+		op.writes[blockID] = append([]byte(nil), framed...)
+		return nil
+	}
+
+	op.freshWrites = true
+	return yfs.writeBlockDirect(blockID, framed)
+}
+
+// writeBlockDirect writes a block header and payload to a specific block in
+// blocks.glob, padded to the block size
+func (yfs *YFS) writeBlockDirect(blockID uint32, framed []byte) error {
 	file, err := os.OpenFile(yfs.blocksPath, os.O_WRONLY, 0644)
 	if err != nil {
 		return err
@@ -422,25 +727,40 @@ func (yfs *YFS) writeBlock(blockID uint32, data []byte) error {
 		return err
 	}
 
-	// Prepare block data (pad or truncate to block size)
-	blockData := make([]byte, yfs.blockSize)
-
-	if len(data) > int(yfs.blockSize)-4 {
-		return fmt.Errorf("data exceeds block size limit: %d bytes, max: %d bytes", len(data), yfs.blockSize-4)
+	// Pad to the plain block size
+	blockData := make([]byte, int(yfs.blockSize)-yfs.blockOverhead())
+	if len(framed) > len(blockData) {
+		return fmt.Errorf("data exceeds block size limit: %d bytes, max: %d bytes", len(framed)-yfs.blockHeaderSize(), yfs.payloadSize())
 	}
+	copy(blockData, framed)
 
-	// Write length as first 4 bytes
-	binary.LittleEndian.PutUint32(blockData[0:4], uint32(len(data)))
-
-	// Copy actual data after the length header
-	copy(blockData[4:], data)
+	if yfs.keys != nil {
+		if blockData, err = yfs.sealBlock(blockID, blockData); err != nil {
+			return err
+		}
+	}
 
 	_, err = file.Write(blockData)
 	return err
 }
 
-// readBlock reads data from a specific block
+// readBlock reads the payload of a specific block
 func (yfs *YFS) readBlock(blockID uint32) ([]byte, error) {
+	framed, err := yfs.readFramedBlock(blockID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, payload, err := yfs.parseBlock(framed)
+	return payload, err
+}
+
+// readFramedBlock reads the header and payload of a specific block
+func (yfs *YFS) readFramedBlock(blockID uint32) ([]byte, error) {
+	if data, pending := yfs.pendingWrite(blockID); pending {
+		return append([]byte(nil), data...), nil
+	}
+
 	file, err := os.Open(yfs.blocksPath)
 	if err != nil {
 		return nil, err
@@ -463,24 +783,79 @@ func (yfs *YFS) readBlock(blockID uint32) ([]byte, error) {
 		return nil, err
 	}
 
-	// REad the actual data length from the first 4 bytes
-	dataLength := binary.LittleEndian.Uint32(blockData[0:4])
+	return yfs.unpackBlock(blockID, blockData)
+}
+
+// readBlockRun reads count contiguous blocks starting at startBlockID with a
+// single sequential read and returns the payload of each block
+func (yfs *YFS) readBlockRun(startBlockID, count uint32) ([][]byte, error) {
+	blocks, err := yfs.readFramedRun(startBlockID, count)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, framed := range blocks {
+		if _, _, blocks[i], err = yfs.parseBlock(framed); err != nil {
+			return nil, fmt.Errorf("block %d: %w", startBlockID+uint32(i), err)
+		}
+	}
+
+	return blocks, nil
+}
+
+// readFramedRun reads count contiguous blocks like readBlockRun and returns
+// the header and payload of each block
+func (yfs *YFS) readFramedRun(startBlockID, count uint32) ([][]byte, error) {
+	file, err := os.Open(yfs.blocksPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	offset := yfs.calculateBlockOffset(startBlockID)
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid block ID: %d", startBlockID)
+	}
+
+	runData := make([]byte, int(count)*int(yfs.blockSize))
+	if _, err := file.ReadAt(runData, offset); err != nil {
+		return nil, err
+	}
+
+	blocks := make([][]byte, count)
+	for i := range blocks {
+		start := i * int(yfs.blockSize)
+		if data, pending := yfs.pendingWrite(startBlockID + uint32(i)); pending {
+			blocks[i] = append([]byte(nil), data...)
+			continue
+		}
+
+		if blocks[i], err = yfs.unpackBlock(startBlockID+uint32(i), runData[start:start+int(yfs.blockSize)]); err != nil {
+			return nil, fmt.Errorf("block %d: %w", startBlockID+uint32(i), err)
+		}
+	}
+
+	return blocks, nil
+}
 
-	// Validate length
-	if dataLength > uint32(len(blockData)-4) {
-		return nil, fmt.Errorf("invalid data length: %d bytes, max: %d bytes", dataLength, len(blockData)-4)
+// unpackBlock decrypts the raw contents of a block and returns its header
+// and payload without the padding
+func (yfs *YFS) unpackBlock(blockID uint32, blockData []byte) ([]byte, error) {
+	if yfs.keys != nil {
+		var err error
+		if blockData, err = yfs.openBlock(blockID, blockData); err != nil {
+			return nil, err
+		}
 	}
 
-	return blockData[4 : 4+dataLength], nil
+	return yfs.trimBlock(blockData)
 }
 
-// writeIndexBlock writes an index block to disk
-func (yfs *YFS) writeIndexBlock(blockID uint32, indexBlock *IndexBlock) error {
+// writeIndexBlock writes an index block of an inode to disk
+func (yfs *YFS) writeIndexBlock(blockID uint32, owner uint64, indexBlock *IndexBlock) error {
 	if yfs.checksumEnabled {
 		// Calculate checksum for index block
-		data := fmt.Sprintf("%v%v%d", indexBlock.BlockIds, indexBlock.Extents,
-			indexBlock.NextIndexBlockId)
-		indexBlock.Crc32 = crc32.ChecksumIEEE([]byte(data))
+		indexBlock.Crc32 = indexBlockChecksum(indexBlock)
 	}
 
 	data, err := proto.Marshal(indexBlock)
@@ -488,16 +863,30 @@ func (yfs *YFS) writeIndexBlock(blockID uint32, indexBlock *IndexBlock) error {
 		return fmt.Errorf("failed to marshal index block: %w", err)
 	}
 
-	return yfs.writeBlock(blockID, data)
+	if len(data) > yfs.payloadSize() {
+		return fmt.Errorf("index block exceeds block size limit: %d bytes, max: %d bytes", len(data), yfs.payloadSize())
+	}
+
+	return yfs.writeFramedBlock(blockID, frameBlock(blockIndex, owner, data))
 }
 
 // readIndexBlock reads an index block from disk
 func (yfs *YFS) readIndexBlock(blockID uint32) (*IndexBlock, error) {
-	data, err := yfs.readBlock(blockID)
+	framed, err := yfs.readFramedBlock(blockID)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, _, data, err := yfs.parseBlock(framed)
 	if err != nil {
 		return nil, err
 	}
 
+	// Blocks of format v2 carry no type
+	if yfs.header.Version >= FormatVersion && kind != blockIndex {
+		return nil, fmt.Errorf("block %d is not an index block", blockID)
+	}
+
 	indexBlock := &IndexBlock{}
 	if err := proto.Unmarshal(data, indexBlock); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal index block: %w", err)
@@ -505,10 +894,7 @@ func (yfs *YFS) readIndexBlock(blockID uint32) (*IndexBlock, error) {
 
 	// Verify checksum if enabled
 	if yfs.checksumEnabled && indexBlock.Crc32 != 0 {
-		checkData := fmt.Sprintf("%v%v%d", indexBlock.BlockIds, indexBlock.Extents,
-			indexBlock.NextIndexBlockId)
-		expected := crc32.ChecksumIEEE([]byte(checkData))
-		if indexBlock.Crc32 != expected {
+		if indexBlock.Crc32 != indexBlockChecksum(indexBlock) {
 			return nil, fmt.Errorf("index block checksum mismatch")
 		}
 	}
@@ -516,156 +902,142 @@ func (yfs *YFS) readIndexBlock(blockID uint32) (*IndexBlock, error) {
 	return indexBlock, nil
 }
 
-// writeFileToBlocks writes file data using the new index block system
-func (yfs *YFS) writeFileToBlocks(data []byte, existingFirstIndexBlockID uint32) (uint32, error) {
-	if len(data) == 0 {
-		// Free existing blocks if any
-		if existingFirstIndexBlockID != NullBlockID {
-			yfs.freeFileBlocks(existingFirstIndexBlockID)
+// indexBlockChecksum calculates the CRC32 of an index block's references.
+// Extents are rendered as plain start/count pairs so the result does not
+// depend on the text format of the generated protobuf types.
+func indexBlockChecksum(indexBlock *IndexBlock) uint32 {
+	extents := make([][2]uint32, len(indexBlock.Extents))
+	for i, extent := range indexBlock.Extents {
+		extents[i] = [2]uint32{extent.StartBlockId, extent.BlockCount}
+	}
+
+	data := fmt.Sprintf("%v%v%d", indexBlock.BlockIds, extents, indexBlock.NextIndexBlockId)
+	if len(indexBlock.DataChecksums) > 0 {
+		data += fmt.Sprintf("%x", indexBlock.DataChecksums)
+	}
+	return crc32.ChecksumIEEE([]byte(data))
+}
+
+// buildExtents collapses a list of block references into extents of
+// contiguous runs. Runs of unallocated references become extents starting
+// at NullBlockID.
+func buildExtents(blockIDs []uint32) []*Extent {
+	var extents []*Extent
+
+	for _, blockID := range blockIDs {
+		if len(extents) > 0 {
+			last := extents[len(extents)-1]
+			if (last.StartBlockId == NullBlockID && blockID == NullBlockID) ||
+				(last.StartBlockId != NullBlockID && last.StartBlockId+last.BlockCount == blockID) {
+				last.BlockCount++
+				continue
+			}
 		}
-		return NullBlockID, nil
+
+		extents = append(extents, &Extent{StartBlockId: blockID, BlockCount: 1})
+	}
+
+	return extents
+}
+
+// newIndexBlock creates an index block holding the given references and
+// the data checksums that go with them. Contiguous runs are recorded as
+// extents unless the file is so fragmented that a plain block_ids list is
+// smaller; an index block never mixes both.
+func (yfs *YFS) newIndexBlock(blockIDs []uint32, checksums []byte) *IndexBlock {
+	withExtents := &IndexBlock{Extents: buildExtents(blockIDs)}
+	withBlockIDs := &IndexBlock{BlockIds: append([]uint32(nil), blockIDs...)}
+
+	indexBlock := withBlockIDs
+	if proto.Size(withExtents) <= proto.Size(withBlockIDs) {
+		indexBlock = withExtents
+	}
+
+	indexBlock.DataChecksums = yfs.trimChecksums(checksums, len(blockIDs))
+	return indexBlock
+}
+
+// writeFileToBlocks writes file data to freshly allocated blocks and indexes
+// them in the given file entry, which must not reference any blocks yet
+func (yfs *YFS) writeFileToBlocks(file *FileEntry, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if yfs.header.Dedup {
+		return yfs.writeDedupedToBlocks(file, data)
 	}
 
 	// Calculate how many data blocks we need
-	blocksNeeded := (len(data) + int(yfs.blockSize) - 1) / int(yfs.blockSize)
+	payloadSize := yfs.payloadSize()
+	blocksNeeded := (len(data) + payloadSize - 1) / payloadSize
 
 	// Allocate data blocks
 	dataBlocks, err := yfs.allocateBlocks(uint32(blocksNeeded))
 	if err != nil {
-		return NullBlockID, err
+		return err
 	}
 
 	// Write data to blocks
 	for i, blockID := range dataBlocks {
-		start := i * int(yfs.blockSize)
-		end := start + int(yfs.blockSize)
+		start := i * payloadSize
+		end := start + payloadSize
 		if end > len(data) {
 			end = len(data)
 		}
 
-		if err := yfs.writeBlock(blockID, data[start:end]); err != nil {
+		if err := yfs.writeBlock(blockID, file.Inode, data[start:end]); err != nil {
 			yfs.freeBlocks(dataBlocks)
-			return NullBlockID, err
+			return err
 		}
 	}
 
-	// Create index blocks to point to data blocks
-	firstIndexBlockID, err := yfs.createIndexBlocks(dataBlocks)
-	if err != nil {
-		yfs.freeBlocks(dataBlocks)
-		return NullBlockID, err
+	// Build the index tree pointing to the data blocks
+	idx := newFileIndex(file)
+	for i, blockID := range dataBlocks {
+		if err := yfs.setBlock(idx, int64(i), blockID); err != nil {
+			yfs.truncateIndex(idx, 0)
+			yfs.freeBlocks(dataBlocks[i:])
+			return err
+		}
+		file.DataBlockCount++
+
+		payload := data[i*payloadSize : min((i+1)*payloadSize, len(data))]
+		if err := yfs.setBlockChecksum(idx, int64(i), yfs.dataChecksum.sum(payload)); err != nil {
+			yfs.truncateIndex(idx, 0)
+			yfs.freeBlocks(dataBlocks[i+1:])
+			return err
+		}
 	}
 
-	// Free old blocks if they existed
-	if existingFirstIndexBlockID != NullBlockID {
-		yfs.freeFileBlocks(existingFirstIndexBlockID)
+	if err := yfs.flushIndex(idx); err != nil {
+		yfs.truncateIndex(idx, 0)
+		return err
 	}
 
-	return firstIndexBlockID, nil
+	return nil
 }
 
-// createIndexBlocks creates index blocks for a list of data blocks
-func (yfs *YFS) createIndexBlocks(dataBlocks []uint32) (uint32, error) {
-	if len(dataBlocks) == 0 {
-		return NullBlockID, nil
+// writeDataToBlocks writes file data to fresh blocks, compressed in chunks
+// when the file entry asks for it
+func (yfs *YFS) writeDataToBlocks(file *FileEntry, data []byte) error {
+	if file.Compression != 0 {
+		return yfs.writeCompressedToBlocks(file, data)
 	}
+	return yfs.writeFileToBlocks(file, data)
+}
 
-	var indexBlocks []uint32
+// readFileFromBlocks reads the whole contents of a file
+func (yfs *YFS) readFileFromBlocks(file *FileEntry) ([]byte, error) {
+	data := make([]byte, file.Size)
+	if _, err := yfs.readAtUnsafe(file, data, 0); err != nil {
+		return nil, err
+	}
 
-	// Create index blocks
-	for i := 0; i < len(dataBlocks); i += MaxBlocksPerIndex {
-		end := i + MaxBlocksPerIndex
-		if end > len(dataBlocks) {
-			end = len(dataBlocks)
-		}
-
-		// Allocate block for this index
-		indexBlockIDs, err := yfs.allocateBlocks(1)
-		if err != nil {
-			yfs.freeBlocks(indexBlocks)
-			return NullBlockID, err
-		}
-		indexBlockID := indexBlockIDs[0]
-		indexBlocks = append(indexBlocks, indexBlockID)
-
-		// Create index block content
-		blockIDs := dataBlocks[i:end]
-		indexBlock := &IndexBlock{
-			BlockIds: blockIDs,
-			DataSize: uint32(len(blockIDs) * int(yfs.blockSize)),
-		}
-
-		// Link to next index block if there are more
-		if end < len(dataBlocks) {
-			// We'll set this after creating the next index block
-		}
-
-		if err := yfs.writeIndexBlock(indexBlockID, indexBlock); err != nil {
-			yfs.freeBlocks(indexBlocks)
-			return NullBlockID, err
-		}
-	}
-
-	// Link index blocks together
-	for i := 0; i < len(indexBlocks)-1; i++ {
-		indexBlock, err := yfs.readIndexBlock(indexBlocks[i])
-		if err != nil {
-			return NullBlockID, err
-		}
-		indexBlock.NextIndexBlockId = indexBlocks[i+1]
-		if err := yfs.writeIndexBlock(indexBlocks[i], indexBlock); err != nil {
-			return NullBlockID, err
-		}
-	}
-
-	return indexBlocks[0], nil
+	return data, nil
 }
 
-// readFileFromBlocks reads file data using the index block system
-func (yfs *YFS) readFileFromBlocks(firstIndexBlockID uint32, fileSize int64) ([]byte, error) {
-	if firstIndexBlockID == NullBlockID || fileSize == 0 {
-		return []byte{}, nil
-	}
-
-	var result []byte
-	currentIndexBlockID := firstIndexBlockID
-	bytesRead := int64(0)
-
-	for currentIndexBlockID != NullBlockID && bytesRead < fileSize {
-		indexBlock, err := yfs.readIndexBlock(currentIndexBlockID)
-		if err != nil {
-			return nil, err
-		}
-
-		// Read data from blocks referenced by this index block
-		for _, blockID := range indexBlock.BlockIds {
-			if bytesRead >= fileSize {
-				break
-			}
-
-			blockData, err := yfs.readBlock(blockID)
-			if err != nil {
-				return nil, err
-			}
-
-			// Calculate how much data to take from this block
-			remainingBytes := fileSize - bytesRead
-			bytesToTake := int64(len(blockData))
-			if bytesToTake > remainingBytes {
-				bytesToTake = remainingBytes
-			}
-
-			result = append(result, blockData[:bytesToTake]...)
-			bytesRead += bytesToTake
-		}
-
-		currentIndexBlockID = indexBlock.NextIndexBlockId
-	}
-
-	return result, nil
-}
-
-// freeFileBlocks frees all blocks associated with a file (index and data blocks)
+// freeFileBlocks releases all blocks associated with a legacy index chain (index and data blocks)
 func (yfs *YFS) freeFileBlocks(firstIndexBlockID uint32) error {
 	currentIndexBlockID := firstIndexBlockID
 
@@ -676,7 +1048,7 @@ func (yfs *YFS) freeFileBlocks(firstIndexBlockID uint32) error {
 		}
 
 		// Free data blocks
-		if err := yfs.freeBlocks(indexBlock.BlockIds); err != nil {
+		if err := yfs.releaseBlocks(indexBlock.BlockIds); err != nil {
 			return err
 		}
 
@@ -686,7 +1058,7 @@ func (yfs *YFS) freeFileBlocks(firstIndexBlockID uint32) error {
 			for i := uint32(0); i < extent.BlockCount; i++ {
 				blockIDs = append(blockIDs, extent.StartBlockId+i)
 			}
-			if err := yfs.freeBlocks(blockIDs); err != nil {
+			if err := yfs.releaseBlocks(blockIDs); err != nil {
 				return err
 			}
 		}
@@ -694,7 +1066,7 @@ func (yfs *YFS) freeFileBlocks(firstIndexBlockID uint32) error {
 		nextIndexBlockID := indexBlock.NextIndexBlockId
 
 		// Free the index block itself
-		if err := yfs.freeBlocks([]uint32{currentIndexBlockID}); err != nil {
+		if err := yfs.releaseBlocks([]uint32{currentIndexBlockID}); err != nil {
 			return err
 		}
 
@@ -748,9 +1120,33 @@ func (yfs *YFS) findEntry(path string) (*DirectoryEntry, *FileEntry, bool, error
 
 // WriteFile creates or updates a file
 func (yfs *YFS) WriteFile(path string, data []byte) error {
+	return yfs.WriteFileWithOptions(path, data, WriteOptions{})
+}
+
+// WriteFileWithOptions creates or updates a file using the given options.
+// Compressed files are stored as independently compressed chunks, so reads
+// and writes at an offset only decompress the chunks they cover.
+func (yfs *YFS) WriteFileWithOptions(path string, data []byte, opts WriteOptions) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
 	yfs.mutex.Lock()
 	defer yfs.mutex.Unlock()
 
+	saved := yfs.save()
+	if err := yfs.writeFileUnsafe(path, data, opts); err != nil {
+		yfs.restore(saved)
+		return err
+	}
+
+	// Save changes
+	return yfs.commit()
+}
+
+// writeFileUnsafe creates or updates a file without committing
+// This should only be called when the caller already holds the write lock
+func (yfs *YFS) writeFileUnsafe(path string, data []byte, opts WriteOptions) error {
 	_, file, isDir, err := yfs.findEntryUnsafe(path)
 	if err != nil {
 		return err
@@ -760,6 +1156,19 @@ func (yfs *YFS) WriteFile(path string, data []byte) error {
 		return fmt.Errorf("path is a directory: %s", path)
 	}
 
+	compression := opts.Compression
+	if compression == "" {
+		compression = CompressionNone
+		if file != nil {
+			compression = compressionFromEntry(file.Compression)
+		}
+	}
+
+	compressionValue, err := compression.entryValue()
+	if err != nil {
+		return err
+	}
+
 	pathParts := strings.Split(strings.Trim(path, "/"), "/")
 	fileName := pathParts[len(pathParts)-1]
 
@@ -773,17 +1182,29 @@ func (yfs *YFS) WriteFile(path string, data []byte) error {
 		parentDir, _, _, _ = yfs.findEntryUnsafe(parentPath)
 	}
 
-	var existingFirstIndexBlockID uint32
+	// Write data to fresh blocks before releasing the old ones
+	written := &FileEntry{Compression: compressionValue}
 	if file != nil {
-		existingFirstIndexBlockID = file.FirstIndexBlockId
+		written.Inode = file.Inode
+	} else {
+		written.Inode = yfs.newInode()
+	}
+	if compressionValue != 0 {
+		written.CompressionChunkSize = uint32(yfs.payloadSize() * compressionChunkBlocks)
 	}
 
-	// Write data to blocks
-	firstIndexBlockID, err := yfs.writeFileToBlocks(data, existingFirstIndexBlockID)
-	if err != nil {
+	if int64(len(data)) <= yfs.inlineSize() {
+		written.InlineData = append([]byte(nil), data...)
+	} else if err := yfs.writeDataToBlocks(written, data); err != nil {
 		return err
 	}
 
+	if file != nil {
+		if err := yfs.releaseFileBlocks(file); err != nil {
+			return err
+		}
+	}
+
 	now := time.Now().Unix()
 
 	// Update or create file entry
@@ -794,8 +1215,7 @@ func (yfs *YFS) WriteFile(path string, data []byte) error {
 				ModTime:    now,
 				CreateTime: now,
 			},
-			FirstIndexBlockId: firstIndexBlockID,
-			Size:              int64(len(data)),
+			Inode: written.Inode,
 		}
 
 		if parentDir.Files == nil {
@@ -804,20 +1224,159 @@ func (yfs *YFS) WriteFile(path string, data []byte) error {
 
 		parentDir.Files[fileName] = file
 	} else {
-		file.FirstIndexBlockId = firstIndexBlockID
-		file.Size = int64(len(data))
 		file.Metadata.ModTime = now
 	}
 
+	file.Size = int64(len(data))
+	file.DirectBlockIds = written.DirectBlockIds
+	file.DirectBlockChecksums = written.DirectBlockChecksums
+	file.IndirectBlockIds = written.IndirectBlockIds
+	file.DataBlockCount = written.DataBlockCount
+	file.IndexBlockCount = written.IndexBlockCount
+	file.Compression = written.Compression
+	file.CompressionChunkSize = written.CompressionChunkSize
+	file.ChunkSizes = written.ChunkSizes
+	file.StoredSize = written.StoredSize
+	file.InlineData = written.InlineData
+
+	// Update checksums
+	yfs.updateMetadataChecksum(file.Metadata)
+
+	return nil
+}
+
+// WriteAt writes data into an existing file at the given offset. Only the
+// data blocks covered by the write are rewritten and the file keeps its index
+// chain; blocks are appended when the write extends past the end of the file.
+func (yfs *YFS) WriteAt(path string, offset int64, data []byte) error {
+	if offset < 0 {
+		return fmt.Errorf("negative offset: %d", offset)
+	}
+
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	_, file, isDir, err := yfs.findEntryUnsafe(path)
+	if err != nil {
+		return err
+	}
+
+	if isDir || file == nil {
+		return fmt.Errorf("file not found: %s", path)
+	}
+
+	saved := yfs.save()
+	if err := yfs.writeAtUnsafe(file, data, offset); err != nil {
+		yfs.restore(saved)
+		return withPath(err, path)
+	}
+
 	// Update checksums
 	yfs.updateMetadataChecksum(file.Metadata)
 
 	// Save changes
-	if err := yfs.saveRoot(); err != nil {
+	return yfs.commit()
+}
+
+// Truncate changes the size of a file. Shrinking frees the trailing data and
+// index blocks; growing fills the new space with zeros.
+func (yfs *YFS) Truncate(path string, size int64) error {
+	if err := yfs.checkWritable(); err != nil {
 		return err
 	}
 
-	return yfs.saveBitmap()
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	_, file, isDir, err := yfs.findEntryUnsafe(path)
+	if err != nil {
+		return err
+	}
+
+	if isDir || file == nil {
+		return fmt.Errorf("file not found: %s", path)
+	}
+
+	saved := yfs.save()
+	if err := yfs.truncateUnsafe(file, size); err != nil {
+		yfs.restore(saved)
+		return withPath(err, path)
+	}
+
+	// Update checksums
+	yfs.updateMetadataChecksum(file.Metadata)
+
+	// Save changes
+	return yfs.commit()
+}
+
+// Fallocate reserves blocks for the first size bytes of a file without
+// changing its size, so data written later lands in contiguous blocks
+func (yfs *YFS) Fallocate(path string, size int64) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	_, file, isDir, err := yfs.findEntryUnsafe(path)
+	if err != nil {
+		return err
+	}
+
+	if isDir || file == nil {
+		return fmt.Errorf("file not found: %s", path)
+	}
+
+	saved := yfs.save()
+	if err := yfs.fallocateUnsafe(file, size); err != nil {
+		yfs.restore(saved)
+		return err
+	}
+
+	// Save changes
+	return yfs.commit()
+}
+
+// AppendFile appends data to the end of a file, creating it if it does not
+// exist. The tail data block is filled first and new blocks are added to the
+// last index block of the existing chain.
+func (yfs *YFS) AppendFile(path string, data []byte) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	_, file, isDir, err := yfs.findEntryUnsafe(path)
+	if err == nil && isDir && file == nil {
+		return fmt.Errorf("path is a directory: %s", path)
+	}
+
+	saved := yfs.save()
+	if file == nil {
+		if file, err = yfs.createFileEntryUnsafe(path, 0644); err != nil {
+			yfs.restore(saved)
+			return err
+		}
+	}
+
+	if err := yfs.writeAtUnsafe(file, data, file.Size); err != nil {
+		yfs.restore(saved)
+		return withPath(err, path)
+	}
+
+	// Update checksums
+	yfs.updateMetadataChecksum(file.Metadata)
+
+	// Save changes
+	return yfs.commit()
 }
 
 // ReadFile reads a file's contents
@@ -825,7 +1384,13 @@ func (yfs *YFS) ReadFile(path string) ([]byte, error) {
 	yfs.mutex.RLock()
 	defer yfs.mutex.RUnlock()
 
-	_, file, isDir, err := yfs.findEntry(path)
+	return yfs.readFileUnsafe(path)
+}
+
+// readFileUnsafe reads a file
+// This should only be called when the caller already holds the appropriate lock
+func (yfs *YFS) readFileUnsafe(path string) ([]byte, error) {
+	_, file, isDir, err := yfs.findEntryUnsafe(path)
 	if err != nil {
 		return nil, err
 	}
@@ -839,14 +1404,32 @@ func (yfs *YFS) ReadFile(path string) ([]byte, error) {
 		return nil, fmt.Errorf("metadata checksum verification failed for file: %s", path)
 	}
 
-	return yfs.readFileFromBlocks(file.FirstIndexBlockId, file.Size)
+	data, err := yfs.readFileFromBlocks(file)
+	return data, withPath(err, path)
 }
 
 // DeleteFile deletes a file
 func (yfs *YFS) DeleteFile(path string) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
 	yfs.mutex.Lock()
 	defer yfs.mutex.Unlock()
 
+	saved := yfs.save()
+	if err := yfs.deleteFileUnsafe(path); err != nil {
+		yfs.restore(saved)
+		return err
+	}
+
+	// Save changes
+	return yfs.commit()
+}
+
+// deleteFileUnsafe deletes a file without committing
+// This should only be called when the caller already holds the write lock
+func (yfs *YFS) deleteFileUnsafe(path string) error {
 	parentDir, file, isDir, err := yfs.findEntryUnsafe(path)
 	if err != nil {
 		return err
@@ -857,7 +1440,7 @@ func (yfs *YFS) DeleteFile(path string) error {
 	}
 
 	// Free all blocks associated with the file
-	if err := yfs.freeFileBlocks(file.FirstIndexBlockId); err != nil {
+	if err := yfs.releaseFileBlocks(file); err != nil {
 		return err
 	}
 
@@ -866,26 +1449,142 @@ func (yfs *YFS) DeleteFile(path string) error {
 	fileName := pathParts[len(pathParts)-1]
 	delete(parentDir.Files, fileName)
 
-	// Save changes
-	if err := yfs.saveRoot(); err != nil {
+	return nil
+}
+
+// CopyOptions configures CopyFileWithOptions
+type CopyOptions struct {
+	Physical bool // Duplicate the data blocks instead of sharing them
+}
+
+// CopyFile copies a file. The copy shares the data and index blocks of the
+// source copy-on-write, so only the root is written; a block is duplicated
+// when either file modifies it.
+func (yfs *YFS) CopyFile(srcPath, dstPath string) error {
+	return yfs.CopyFileWithOptions(srcPath, dstPath, CopyOptions{})
+}
+
+// CopyFileWithOptions copies a file using the given options
+func (yfs *YFS) CopyFileWithOptions(srcPath, dstPath string, opts CopyOptions) error {
+	if err := yfs.checkWritable(); err != nil {
 		return err
 	}
 
-	return yfs.saveBitmap()
+	if opts.Physical {
+		info, err := yfs.GetFileInfo(srcPath)
+		if err != nil {
+			return err
+		}
+
+		data, err := yfs.ReadFile(srcPath)
+		if err != nil {
+			return err
+		}
+
+		return yfs.WriteFileWithOptions(dstPath, data, WriteOptions{Compression: info.Compression})
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	saved := yfs.save()
+	if err := yfs.cloneFileUnsafe(srcPath, dstPath); err != nil {
+		yfs.restore(saved)
+		return err
+	}
+
+	// Save changes
+	return yfs.commit()
 }
 
-// CopyFile copies a file
-func (yfs *YFS) CopyFile(srcPath, dstPath string) error {
-	data, err := yfs.ReadFile(srcPath)
+// cloneFileUnsafe points a file at the blocks of another one, adding a
+// reference to each of them
+// This should only be called when the caller already holds the write lock
+func (yfs *YFS) cloneFileUnsafe(srcPath, dstPath string) error {
+	_, src, isDir, err := yfs.findEntryUnsafe(srcPath)
 	if err != nil {
 		return err
 	}
 
-	return yfs.WriteFile(dstPath, data)
+	if isDir || src == nil {
+		return fmt.Errorf("file not found: %s", srcPath)
+	}
+
+	if !yfs.verifyMetadataChecksum(src.Metadata) {
+		return fmt.Errorf("metadata checksum verification failed for file: %s", srcPath)
+	}
+
+	if strings.Trim(srcPath, "/") == strings.Trim(dstPath, "/") {
+		return nil
+	}
+
+	pathParts := strings.Split(strings.Trim(dstPath, "/"), "/")
+	fileName := pathParts[len(pathParts)-1]
+	parentPath := strings.Join(pathParts[:len(pathParts)-1], "/")
+
+	if err := yfs.createDirectoryChain(parentPath); err != nil {
+		return err
+	}
+
+	parentDir, dst, isDir, err := yfs.findEntryUnsafe(dstPath)
+	if err != nil {
+		return err
+	}
+
+	if isDir {
+		return fmt.Errorf("path is a directory: %s", dstPath)
+	}
+
+	// Reference the source blocks before releasing the old ones, they may overlap
+	if err := yfs.retainFileBlocks(src); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+
+	if dst == nil {
+		dst = &FileEntry{
+			Metadata: &FileMetadata{
+				Name:        fileName,
+				CreateTime:  now,
+				Permissions: src.Metadata.Permissions,
+			},
+			Inode: yfs.newInode(),
+		}
+
+		if parentDir.Files == nil {
+			parentDir.Files = make(map[string]*FileEntry)
+		}
+		parentDir.Files[fileName] = dst
+	} else if err := yfs.releaseFileBlocks(dst); err != nil {
+		return err
+	}
+
+	dst.FirstIndexBlockId = src.FirstIndexBlockId
+	dst.DirectBlockIds = append([]uint32(nil), src.DirectBlockIds...)
+	dst.DirectBlockChecksums = append([]byte(nil), src.DirectBlockChecksums...)
+	dst.IndirectBlockIds = append([]uint32(nil), src.IndirectBlockIds...)
+	dst.DataBlockCount = src.DataBlockCount
+	dst.IndexBlockCount = src.IndexBlockCount
+	dst.Compression = src.Compression
+	dst.CompressionChunkSize = src.CompressionChunkSize
+	dst.ChunkSizes = append([]uint32(nil), src.ChunkSizes...)
+	dst.StoredSize = src.StoredSize
+	dst.InlineData = append([]byte(nil), src.InlineData...)
+	dst.Size = src.Size
+
+	dst.Metadata.ModTime = now
+	yfs.updateMetadataChecksum(dst.Metadata)
+
+	return nil
 }
 
 // MoveFile moves/renames a file
 func (yfs *YFS) MoveFile(srcPath, dstPath string) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
 	if err := yfs.CopyFile(srcPath, dstPath); err != nil {
 		return err
 	}
@@ -893,6 +1592,94 @@ func (yfs *YFS) MoveFile(srcPath, dstPath string) error {
 	return yfs.DeleteFile(srcPath)
 }
 
+// Rename moves a file or directory to a new path without copying its blocks
+func (yfs *YFS) Rename(srcPath, dstPath string) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
+	yfs.mutex.Lock()
+	defer yfs.mutex.Unlock()
+
+	if err := yfs.renameUnsafe(srcPath, dstPath); err != nil {
+		return err
+	}
+
+	return yfs.commit()
+}
+
+// renameUnsafe moves a file or directory entry without committing
+// This should only be called when the caller already holds the write lock
+func (yfs *YFS) renameUnsafe(srcPath, dstPath string) error {
+	src := strings.Trim(srcPath, "/")
+	dst := strings.Trim(dstPath, "/")
+	if src == "" || dst == "" {
+		return fmt.Errorf("cannot rename root directory")
+	}
+
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return fmt.Errorf("cannot move %s into itself", srcPath)
+	}
+
+	entry, file, isDir, err := yfs.findEntryUnsafe(src)
+	if err != nil {
+		return err
+	}
+
+	if !isDir && file == nil {
+		return fmt.Errorf("file not found: %s", srcPath)
+	}
+
+	_, dstFile, dstIsDir, err := yfs.findEntryUnsafe(dst)
+	if err == nil && (dstIsDir || dstFile != nil) {
+		return fmt.Errorf("destination already exists: %s", dstPath)
+	}
+
+	srcParts := strings.Split(src, "/")
+	dstParts := strings.Split(dst, "/")
+	srcName := srcParts[len(srcParts)-1]
+	dstName := dstParts[len(dstParts)-1]
+
+	// Create parent directories if they don't exist
+	parentPath := strings.Join(dstParts[:len(dstParts)-1], "/")
+	if err := yfs.createDirectoryChain(parentPath); err != nil {
+		return err
+	}
+
+	dstParent, _, _, err := yfs.findEntryUnsafe(parentPath)
+	if err != nil {
+		return err
+	}
+
+	srcParent, _, _, err := yfs.findEntryUnsafe(strings.Join(srcParts[:len(srcParts)-1], "/"))
+	if err != nil {
+		return err
+	}
+
+	var metadata *FileMetadata
+	if isDir {
+		delete(srcParent.Directories, srcName)
+		if dstParent.Directories == nil {
+			dstParent.Directories = make(map[string]*DirectoryEntry)
+		}
+		dstParent.Directories[dstName] = entry
+		metadata = entry.Metadata
+	} else {
+		delete(srcParent.Files, srcName)
+		if dstParent.Files == nil {
+			dstParent.Files = make(map[string]*FileEntry)
+		}
+		dstParent.Files[dstName] = file
+		metadata = file.Metadata
+	}
+
+	metadata.Name = dstName
+	metadata.ModTime = time.Now().Unix()
+	yfs.updateMetadataChecksum(metadata)
+
+	return nil
+}
+
 // createDirectoryChain creates a chain of directories
 func (yfs *YFS) createDirectoryChain(path string) error {
 	if path == "" {
@@ -927,25 +1714,54 @@ func (yfs *YFS) createDirectoryChain(path string) error {
 	return nil
 }
 
+// initDirectoryMaps gives every directory below dir the empty Files and
+// Directories maps that unmarshalling or cloning an empty directory leaves nil
+func initDirectoryMaps(dir *DirectoryEntry) {
+	if dir.Files == nil {
+		dir.Files = make(map[string]*FileEntry)
+	}
+	if dir.Directories == nil {
+		dir.Directories = make(map[string]*DirectoryEntry)
+	}
+
+	for _, subDir := range dir.Directories {
+		initDirectoryMaps(subDir)
+	}
+}
+
 // CreateDirectory creates a new directory
 func (yfs *YFS) CreateDirectory(path string) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
 	yfs.mutex.Lock()
 	defer yfs.mutex.Unlock()
 
+	if err := yfs.createDirectoryUnsafe(path); err != nil {
+		return err
+	}
+
+	return yfs.commit()
+}
+
+// createDirectoryUnsafe creates a directory without committing
+// This should only be called when the caller already holds the write lock
+func (yfs *YFS) createDirectoryUnsafe(path string) error {
 	_, _, isDir, err := yfs.findEntryUnsafe(path)
 	if err == nil && isDir {
 		return fmt.Errorf("directory already exists: %s", path)
 	}
 
-	if err := yfs.createDirectoryChain(path); err != nil {
-		return err
-	}
-
-	return yfs.saveRoot()
+	return yfs.createDirectoryChain(path)
 }
 
 // DeleteDirectory deletes an empty directory
 func (yfs *YFS) DeleteDirectory(path string) error {
+	if err := yfs.checkWritable(); err != nil {
+		return err
+	}
+
 	yfs.mutex.Lock()
 	defer yfs.mutex.Unlock()
 
@@ -969,7 +1785,7 @@ func (yfs *YFS) DeleteDirectory(path string) error {
 	}
 
 	parentPath := strings.Join(pathParts[:len(pathParts)-1], "/")
-	parentDir, _, _, err := yfs.findEntry(parentPath)
+	parentDir, _, _, err := yfs.findEntryUnsafe(parentPath)
 	if err != nil {
 		return err
 	}
@@ -977,7 +1793,7 @@ func (yfs *YFS) DeleteDirectory(path string) error {
 	dirName := pathParts[len(pathParts)-1]
 	delete(parentDir.Directories, dirName)
 
-	return yfs.saveRoot()
+	return yfs.commit()
 }
 
 // Ls lists files and directories in a path
@@ -1008,14 +1824,7 @@ func (yfs *YFS) Ls(path string) ([]FileInfo, error) {
 
 	// Add files
 	for name, file := range dir.Files {
-		entries = append(entries, FileInfo{
-			Name:        name,
-			IsDirectory: false,
-			Size:        file.Size,
-			ModTime:     time.Unix(file.Metadata.ModTime, 0),
-			CreateTime:  time.Unix(file.Metadata.CreateTime, 0),
-			BlockCount:  file.DataBlockCount,
-		})
+		entries = append(entries, fileInfo(name, file))
 	}
 
 	return entries, nil
@@ -1064,14 +1873,8 @@ func (yfs *YFS) GetFileInfo(path string) (*FileInfo, error) {
 		return nil, fmt.Errorf("file not found: %s", path)
 	}
 
-	return &FileInfo{
-		Name:        file.Metadata.Name,
-		IsDirectory: false,
-		Size:        file.Size,
-		ModTime:     time.Unix(file.Metadata.ModTime, 0),
-		CreateTime:  time.Unix(file.Metadata.CreateTime, 0),
-		BlockCount:  file.DataBlockCount,
-	}, nil
+	info := fileInfo(file.Metadata.Name, file)
+	return &info, nil
 }
 
 // GetBlockSize returns the current block size
@@ -1106,48 +1909,84 @@ func (yfs *YFS) GetStats() (map[string]interface{}, error) {
 
 	allocatedBlocks := (blocksStat.Size() - int64(HeaderSize)) / int64(yfs.blockSize)
 
-	stats := map[string]interface{}{
-		"version":           yfs.header.Version,
-		"block_size":        yfs.blockSize,
-		"total_blocks":      yfs.bitmap.totalBlocks,
-		"allocated_blocks":  allocatedBlocks,
-		"used_blocks":       usedBlocks,
-		"free_blocks":       yfs.bitmap.totalBlocks - usedBlocks,
-		"checksum_enabled":  yfs.checksumEnabled,
-		"bitmap_search_pos": yfs.bitmap.searchPos,
-		"blocks_file_size":  blocksStat.Size(),
+	dedupRatio := 1.0
+	if yfs.header.Dedup {
+		if dedupRatio, err = yfs.dedupRatio(); err != nil {
+			return nil, err
+		}
 	}
 
-	return stats, nil
-}
+	// Compare the logical and stored size of compressed files
+	var compressedFiles, inlineFiles int
+	var logicalBytes, storedBytes, inlineBytes int64
+	walkFiles(yfs.header.Root, "", func(path string, file *FileEntry) error {
+		if isInline(file) {
+			inlineFiles++
+			inlineBytes += file.Size
+			return nil
+		}
 
-// Defragment performs file system defragmentation (basic implementation)
-func (yfs *YFS) Defragment() error {
-	yfs.mutex.Lock()
-	defer yfs.mutex.Unlock()
+		if file.Compression != 0 {
+			compressedFiles++
+			logicalBytes += file.Size
+			storedBytes += file.StoredSize
+		}
+		return nil
+	})
 
-	// This is a simplified defragmentation that resets the bitmap search position
-	// A full implementation would reorganize blocks to be more contiguous
-	yfs.bitmap.searchPos = 0
-	yfs.bitmap.dirty = true
+	stats := map[string]interface{}{
+		"version":            yfs.header.Version,
+		"block_size":         yfs.blockSize,
+		"total_blocks":       yfs.bitmap.totalBlocks,
+		"max_blocks":         yfs.opts.maxBlocks(),
+		"allocated_blocks":   allocatedBlocks,
+		"used_blocks":        usedBlocks,
+		"free_blocks":        yfs.bitmap.totalBlocks - usedBlocks,
+		"checksum_enabled":   yfs.checksumEnabled,
+		"data_checksum":      yfs.dataChecksum.String(),
+		"read_only":          yfs.opts.ReadOnly,
+		"bitmap_search_pos":  yfs.bitmap.searchPos,
+		"blocks_file_size":   blocksStat.Size(),
+		"snapshots":          len(yfs.header.Snapshots),
+		"shared_blocks":      len(yfs.header.BlockRefs),
+		"encrypted":          yfs.keys != nil,
+		"data_keys":          len(yfs.header.Encryption.GetDataKeys()),
+		"reencrypt_next":     yfs.header.Encryption.GetReencryptNext(),
+		"encrypted_metadata": yfs.header.Encryption.GetMetadata(),
+		"compressed_files":   compressedFiles,
+		"compressed_bytes":   logicalBytes,
+		"compressed_stored":  storedBytes,
+		"compression_ratio":  compressionRatio(logicalBytes, storedBytes),
+		"inline_files":       inlineFiles,
+		"inline_bytes":       inlineBytes,
+		"inline_size":        yfs.inlineSize(),
+		"dedup":              yfs.header.Dedup,
+		"dedup_blocks":       len(yfs.header.DedupBlocks),
+		"dedup_ratio":        dedupRatio,
+	}
 
-	return yfs.saveBitmap()
+	return stats, nil
 }
 
 // Sync ensures all pending changes are written to disk
 func (yfs *YFS) Sync() error {
+	if yfs.opts.ReadOnly {
+		return nil
+	}
+
 	yfs.mutex.Lock()
 	defer yfs.mutex.Unlock()
 
-	if err := yfs.saveRoot(); err != nil {
-		return err
-	}
-
-	return yfs.saveBitmap()
+	return yfs.commit()
 }
 
 // Close closes the file system and ensures all changes are saved
 func (yfs *YFS) Close() error {
+	if yfs.snapshotOf != nil {
+		yfs.closeSnapshotView()
+		return nil
+	}
+
 	return yfs.Sync()
 }
 
@@ -1179,7 +2018,7 @@ func (yfs *YFS) verifyDirectoryIntegrity(dir *DirectoryEntry, path string) error
 		}
 
 		// Verify index blocks for this file
-		if err := yfs.verifyFileIndexBlocks(file.FirstIndexBlockId); err != nil {
+		if err := yfs.verifyFileIndex(file); err != nil {
 			return fmt.Errorf("file index block verification failed for %s/%s: %w", path, name, err)
 		}
 	}
@@ -1195,7 +2034,7 @@ func (yfs *YFS) verifyDirectoryIntegrity(dir *DirectoryEntry, path string) error
 	return nil
 }
 
-// verifyFileIndexBlocks verifies the integrity of a file's index blocks
+// verifyFileIndexBlocks verifies the integrity of a legacy index chain
 func (yfs *YFS) verifyFileIndexBlocks(firstIndexBlockID uint32) error {
 	if firstIndexBlockID == NullBlockID {
 		return nil
@@ -1226,8 +2065,8 @@ func (yfs *YFS) verifyFileIndexBlocks(firstIndexBlockID uint32) error {
 
 		// Verify extents
 		for _, extent := range indexBlock.Extents {
-			if extent.StartBlockId == NullBlockID ||
-				extent.StartBlockId+extent.BlockCount > uint32(yfs.bitmap.totalBlocks) {
+			if extent.StartBlockId == NullBlockID || extent.BlockCount == 0 ||
+				uint64(extent.StartBlockId)+uint64(extent.BlockCount)-1 > yfs.bitmap.totalBlocks {
 				return fmt.Errorf("invalid extent in index block %d: start=%d, count=%d",
 					currentIndexBlockID, extent.StartBlockId, extent.BlockCount)
 			}
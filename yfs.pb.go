@@ -24,11 +24,19 @@ const (
 // FileSystemHeader contains the root directory and system metadata
 type FileSystemHeader struct {
 	state           protoimpl.MessageState `protogen:"open.v1"`
-	Version         uint32                 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Version         uint32                 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"` // On-disk format version, see FormatVersion
 	BlockSize       uint32                 `protobuf:"varint,2,opt,name=block_size,json=blockSize,proto3" json:"block_size,omitempty"`
 	Root            *DirectoryEntry        `protobuf:"bytes,3,opt,name=root,proto3" json:"root,omitempty"`
-	TotalBlocks     uint64                 `protobuf:"varint,4,opt,name=total_blocks,json=totalBlocks,proto3" json:"total_blocks,omitempty"`             // Total blocks in the system
-	ChecksumEnabled uint32                 `protobuf:"varint,5,opt,name=checksum_enabled,json=checksumEnabled,proto3" json:"checksum_enabled,omitempty"` // Whether checksums are enabled
+	TotalBlocks     uint64                 `protobuf:"varint,4,opt,name=total_blocks,json=totalBlocks,proto3" json:"total_blocks,omitempty"`                                                                             // Total blocks in the system
+	ChecksumEnabled uint32                 `protobuf:"varint,5,opt,name=checksum_enabled,json=checksumEnabled,proto3" json:"checksum_enabled,omitempty"`                                                                 // Whether checksums are enabled
+	Generation      uint64                 `protobuf:"varint,6,opt,name=generation,proto3" json:"generation,omitempty"`                                                                                                  // Incremented on every commit; the newest valid root copy wins
+	BlockRefs       map[uint32]uint32      `protobuf:"bytes,7,rep,name=block_refs,json=blockRefs,proto3" json:"block_refs,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`        // Number of file trees referencing each shared block (absent means 1)
+	Snapshots       map[string]*Snapshot   `protobuf:"bytes,8,rep,name=snapshots,proto3" json:"snapshots,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`                           // Read-only copies of the directory tree by name
+	DataChecksum    uint32                 `protobuf:"varint,9,opt,name=data_checksum,json=dataChecksum,proto3" json:"data_checksum,omitempty"`                                                                          // Data block checksum algorithm (0 none, 1 CRC32C, 2 XXH64, 3 SHA-256)
+	Encryption      *EncryptionParams      `protobuf:"bytes,10,opt,name=encryption,proto3" json:"encryption,omitempty"`                                                                                                  // Set when blocks are encrypted
+	Dedup           bool                   `protobuf:"varint,11,opt,name=dedup,proto3" json:"dedup,omitempty"`                                                                                                           // Whether whole-file writes share identical data blocks
+	DedupBlocks     map[uint64]uint32      `protobuf:"bytes,12,rep,name=dedup_blocks,json=dedupBlocks,proto3" json:"dedup_blocks,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"` // XXH64 of a data block payload to a block holding it
+	NextInode       uint64                 `protobuf:"varint,13,opt,name=next_inode,json=nextInode,proto3" json:"next_inode,omitempty"`                                                                                  // Inode number given to the next file created
 	unknownFields   protoimpl.UnknownFields
 	sizeCache       protoimpl.SizeCache
 }
@@ -98,6 +106,228 @@ func (x *FileSystemHeader) GetChecksumEnabled() uint32 {
 	return 0
 }
 
+func (x *FileSystemHeader) GetGeneration() uint64 {
+	if x != nil {
+		return x.Generation
+	}
+	return 0
+}
+
+func (x *FileSystemHeader) GetBlockRefs() map[uint32]uint32 {
+	if x != nil {
+		return x.BlockRefs
+	}
+	return nil
+}
+
+func (x *FileSystemHeader) GetSnapshots() map[string]*Snapshot {
+	if x != nil {
+		return x.Snapshots
+	}
+	return nil
+}
+
+func (x *FileSystemHeader) GetDataChecksum() uint32 {
+	if x != nil {
+		return x.DataChecksum
+	}
+	return 0
+}
+
+func (x *FileSystemHeader) GetEncryption() *EncryptionParams {
+	if x != nil {
+		return x.Encryption
+	}
+	return nil
+}
+
+func (x *FileSystemHeader) GetDedup() bool {
+	if x != nil {
+		return x.Dedup
+	}
+	return false
+}
+
+func (x *FileSystemHeader) GetDedupBlocks() map[uint64]uint32 {
+	if x != nil {
+		return x.DedupBlocks
+	}
+	return nil
+}
+
+func (x *FileSystemHeader) GetNextInode() uint64 {
+	if x != nil {
+		return x.NextInode
+	}
+	return 0
+}
+
+// EncryptionParams describes how the key encryption key of an encrypted file
+// system is derived and holds the data keys it wraps. Encrypted metadata
+// files carry a copy in front of their ciphertext, so they can be opened
+// before the root is known.
+type EncryptionParams struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Cipher        uint32                 `protobuf:"varint,1,opt,name=cipher,proto3" json:"cipher,omitempty"` // 1 AES-256-GCM
+	Kdf           uint32                 `protobuf:"varint,2,opt,name=kdf,proto3" json:"kdf,omitempty"`       // 0 raw 32-byte key, 1 PBKDF2-HMAC-SHA256 over a passphrase
+	Salt          []byte                 `protobuf:"bytes,3,opt,name=salt,proto3" json:"salt,omitempty"`
+	Iterations    uint32                 `protobuf:"varint,4,opt,name=iterations,proto3" json:"iterations,omitempty"`                            // KDF iterations
+	KeyCheck      []byte                 `protobuf:"bytes,5,opt,name=key_check,json=keyCheck,proto3" json:"key_check,omitempty"`                 // GCM tag over a fixed message, detects a wrong key
+	Metadata      bool                   `protobuf:"varint,6,opt,name=metadata,proto3" json:"metadata,omitempty"`                                // Whether root.yfs and bitmap.yfs are encrypted too
+	DataKeys      [][]byte               `protobuf:"bytes,7,rep,name=data_keys,json=dataKeys,proto3" json:"data_keys,omitempty"`                 // Data keys sealing the blocks, wrapped by the derived key; current one first. Empty when the derived key seals blocks itself.
+	ReencryptNext uint64                 `protobuf:"varint,8,opt,name=reencrypt_next,json=reencryptNext,proto3" json:"reencrypt_next,omitempty"` // Next block RotateDataKey re-encrypts, 0 when no rotation is in progress
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EncryptionParams) Reset() {
+	*x = EncryptionParams{}
+	mi := &file_yfs_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EncryptionParams) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EncryptionParams) ProtoMessage() {}
+
+func (x *EncryptionParams) ProtoReflect() protoreflect.Message {
+	mi := &file_yfs_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EncryptionParams.ProtoReflect.Descriptor instead.
+func (*EncryptionParams) Descriptor() ([]byte, []int) {
+	return file_yfs_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *EncryptionParams) GetCipher() uint32 {
+	if x != nil {
+		return x.Cipher
+	}
+	return 0
+}
+
+func (x *EncryptionParams) GetKdf() uint32 {
+	if x != nil {
+		return x.Kdf
+	}
+	return 0
+}
+
+func (x *EncryptionParams) GetSalt() []byte {
+	if x != nil {
+		return x.Salt
+	}
+	return nil
+}
+
+func (x *EncryptionParams) GetIterations() uint32 {
+	if x != nil {
+		return x.Iterations
+	}
+	return 0
+}
+
+func (x *EncryptionParams) GetKeyCheck() []byte {
+	if x != nil {
+		return x.KeyCheck
+	}
+	return nil
+}
+
+func (x *EncryptionParams) GetMetadata() bool {
+	if x != nil {
+		return x.Metadata
+	}
+	return false
+}
+
+func (x *EncryptionParams) GetDataKeys() [][]byte {
+	if x != nil {
+		return x.DataKeys
+	}
+	return nil
+}
+
+func (x *EncryptionParams) GetReencryptNext() uint64 {
+	if x != nil {
+		return x.ReencryptNext
+	}
+	return 0
+}
+
+// Snapshot is a frozen copy of the directory tree. Its blocks are shared
+// with the live tree and copied when either side modifies them.
+type Snapshot struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	CreateTime    int64                  `protobuf:"varint,2,opt,name=create_time,json=createTime,proto3" json:"create_time,omitempty"` // Unix timestamp
+	Root          *DirectoryEntry        `protobuf:"bytes,3,opt,name=root,proto3" json:"root,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Snapshot) Reset() {
+	*x = Snapshot{}
+	mi := &file_yfs_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Snapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Snapshot) ProtoMessage() {}
+
+func (x *Snapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_yfs_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Snapshot.ProtoReflect.Descriptor instead.
+func (*Snapshot) Descriptor() ([]byte, []int) {
+	return file_yfs_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Snapshot) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Snapshot) GetCreateTime() int64 {
+	if x != nil {
+		return x.CreateTime
+	}
+	return 0
+}
+
+func (x *Snapshot) GetRoot() *DirectoryEntry {
+	if x != nil {
+		return x.Root
+	}
+	return nil
+}
+
 // FileMetadata contains common metadata for files and directories
 type FileMetadata struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -112,7 +342,7 @@ type FileMetadata struct {
 
 func (x *FileMetadata) Reset() {
 	*x = FileMetadata{}
-	mi := &file_yfs_proto_msgTypes[1]
+	mi := &file_yfs_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -124,7 +354,7 @@ func (x *FileMetadata) String() string {
 func (*FileMetadata) ProtoMessage() {}
 
 func (x *FileMetadata) ProtoReflect() protoreflect.Message {
-	mi := &file_yfs_proto_msgTypes[1]
+	mi := &file_yfs_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -137,7 +367,7 @@ func (x *FileMetadata) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FileMetadata.ProtoReflect.Descriptor instead.
 func (*FileMetadata) Descriptor() ([]byte, []int) {
-	return file_yfs_proto_rawDescGZIP(), []int{1}
+	return file_yfs_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *FileMetadata) GetName() string {
@@ -186,7 +416,7 @@ type Extent struct {
 
 func (x *Extent) Reset() {
 	*x = Extent{}
-	mi := &file_yfs_proto_msgTypes[2]
+	mi := &file_yfs_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -198,7 +428,7 @@ func (x *Extent) String() string {
 func (*Extent) ProtoMessage() {}
 
 func (x *Extent) ProtoReflect() protoreflect.Message {
-	mi := &file_yfs_proto_msgTypes[2]
+	mi := &file_yfs_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -211,7 +441,7 @@ func (x *Extent) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Extent.ProtoReflect.Descriptor instead.
 func (*Extent) Descriptor() ([]byte, []int) {
-	return file_yfs_proto_rawDescGZIP(), []int{2}
+	return file_yfs_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *Extent) GetStartBlockId() uint32 {
@@ -228,7 +458,10 @@ func (x *Extent) GetBlockCount() uint32 {
 	return 0
 }
 
-// IndexBlock represents a block that contains block references for a file
+// IndexBlock represents a block that contains block references for a file.
+// Inside the index tree the references are positional: counting extents block
+// by block, the i-th reference covers the i-th child range, and a reference of
+// 0 (or an extent starting at block 0) marks unallocated positions.
 type IndexBlock struct {
 	state            protoimpl.MessageState `protogen:"open.v1"`
 	BlockIds         []uint32               `protobuf:"varint,1,rep,packed,name=block_ids,json=blockIds,proto3" json:"block_ids,omitempty"`                      // Direct block IDs
@@ -236,13 +469,14 @@ type IndexBlock struct {
 	NextIndexBlockId uint32                 `protobuf:"varint,3,opt,name=next_index_block_id,json=nextIndexBlockId,proto3" json:"next_index_block_id,omitempty"` // Next index block (0 if last)
 	DataSize         uint32                 `protobuf:"varint,4,opt,name=data_size,json=dataSize,proto3" json:"data_size,omitempty"`                             // Actual data size in this index block's data
 	Crc32            uint32                 `protobuf:"varint,5,opt,name=crc32,proto3" json:"crc32,omitempty"`                                                   // Optional checksum
+	DataChecksums    []byte                 `protobuf:"bytes,6,opt,name=data_checksums,json=dataChecksums,proto3" json:"data_checksums,omitempty"`               // Fixed-size checksum of the data block behind each reference, in reference order
 	unknownFields    protoimpl.UnknownFields
 	sizeCache        protoimpl.SizeCache
 }
 
 func (x *IndexBlock) Reset() {
 	*x = IndexBlock{}
-	mi := &file_yfs_proto_msgTypes[3]
+	mi := &file_yfs_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -254,7 +488,7 @@ func (x *IndexBlock) String() string {
 func (*IndexBlock) ProtoMessage() {}
 
 func (x *IndexBlock) ProtoReflect() protoreflect.Message {
-	mi := &file_yfs_proto_msgTypes[3]
+	mi := &file_yfs_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -267,7 +501,7 @@ func (x *IndexBlock) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use IndexBlock.ProtoReflect.Descriptor instead.
 func (*IndexBlock) Descriptor() ([]byte, []int) {
-	return file_yfs_proto_rawDescGZIP(), []int{3}
+	return file_yfs_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *IndexBlock) GetBlockIds() []uint32 {
@@ -305,21 +539,37 @@ func (x *IndexBlock) GetCrc32() uint32 {
 	return 0
 }
 
+func (x *IndexBlock) GetDataChecksums() []byte {
+	if x != nil {
+		return x.DataChecksums
+	}
+	return nil
+}
+
 // FileEntry represents a file in the system
 type FileEntry struct {
-	state             protoimpl.MessageState `protogen:"open.v1"`
-	Metadata          *FileMetadata          `protobuf:"bytes,1,opt,name=metadata,proto3" json:"metadata,omitempty"`
-	FirstIndexBlockId uint32                 `protobuf:"varint,2,opt,name=first_index_block_id,json=firstIndexBlockId,proto3" json:"first_index_block_id,omitempty"` // Points to first index block (not data block)
-	Size              int64                  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`                                                        // Total file size in bytes
-	IndexBlockCount   uint32                 `protobuf:"varint,4,opt,name=index_block_count,json=indexBlockCount,proto3" json:"index_block_count,omitempty"`         // Number of index blocks used
-	DataBlockCount    uint32                 `protobuf:"varint,5,opt,name=data_block_count,json=dataBlockCount,proto3" json:"data_block_count,omitempty"`            // Number of data blocks used
-	unknownFields     protoimpl.UnknownFields
-	sizeCache         protoimpl.SizeCache
+	state                protoimpl.MessageState `protogen:"open.v1"`
+	Metadata             *FileMetadata          `protobuf:"bytes,1,opt,name=metadata,proto3" json:"metadata,omitempty"`
+	FirstIndexBlockId    uint32                 `protobuf:"varint,2,opt,name=first_index_block_id,json=firstIndexBlockId,proto3" json:"first_index_block_id,omitempty"`         // Points to first index block of a legacy chain (0 for tree-indexed files)
+	Size                 int64                  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`                                                                // Total file size in bytes
+	IndexBlockCount      uint32                 `protobuf:"varint,4,opt,name=index_block_count,json=indexBlockCount,proto3" json:"index_block_count,omitempty"`                 // Number of index blocks used
+	DataBlockCount       uint32                 `protobuf:"varint,5,opt,name=data_block_count,json=dataBlockCount,proto3" json:"data_block_count,omitempty"`                    // Number of data blocks used
+	DirectBlockIds       []uint32               `protobuf:"varint,6,rep,packed,name=direct_block_ids,json=directBlockIds,proto3" json:"direct_block_ids,omitempty"`             // Data blocks of the first logical positions (0 if unallocated)
+	IndirectBlockIds     []uint32               `protobuf:"varint,7,rep,packed,name=indirect_block_ids,json=indirectBlockIds,proto3" json:"indirect_block_ids,omitempty"`       // Roots of the single, double, triple and quadruple indirect trees
+	DirectBlockChecksums []byte                 `protobuf:"bytes,8,opt,name=direct_block_checksums,json=directBlockChecksums,proto3" json:"direct_block_checksums,omitempty"`   // Checksums of the direct data blocks, in the layout of IndexBlock.data_checksums
+	Compression          uint32                 `protobuf:"varint,9,opt,name=compression,proto3" json:"compression,omitempty"`                                                  // Compression of the data: 0 none, 1 deflate, 2 zlib, 3 LZW
+	CompressionChunkSize uint32                 `protobuf:"varint,10,opt,name=compression_chunk_size,json=compressionChunkSize,proto3" json:"compression_chunk_size,omitempty"` // Logical bytes per independently compressed chunk
+	ChunkSizes           []uint32               `protobuf:"varint,11,rep,packed,name=chunk_sizes,json=chunkSizes,proto3" json:"chunk_sizes,omitempty"`                          // Stored bytes of each chunk; the logical size when kept uncompressed
+	StoredSize           int64                  `protobuf:"varint,12,opt,name=stored_size,json=storedSize,proto3" json:"stored_size,omitempty"`                                 // Bytes stored in data blocks, the sum of chunk_sizes
+	InlineData           []byte                 `protobuf:"bytes,13,opt,name=inline_data,json=inlineData,proto3" json:"inline_data,omitempty"`                                  // Contents of a small file kept in the root instead of in blocks
+	Inode                uint64                 `protobuf:"varint,14,opt,name=inode,proto3" json:"inode,omitempty"`                                                             // Number recorded as the owner in the header of the file's blocks
+	unknownFields        protoimpl.UnknownFields
+	sizeCache            protoimpl.SizeCache
 }
 
 func (x *FileEntry) Reset() {
 	*x = FileEntry{}
-	mi := &file_yfs_proto_msgTypes[4]
+	mi := &file_yfs_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -331,7 +581,7 @@ func (x *FileEntry) String() string {
 func (*FileEntry) ProtoMessage() {}
 
 func (x *FileEntry) ProtoReflect() protoreflect.Message {
-	mi := &file_yfs_proto_msgTypes[4]
+	mi := &file_yfs_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -344,7 +594,7 @@ func (x *FileEntry) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FileEntry.ProtoReflect.Descriptor instead.
 func (*FileEntry) Descriptor() ([]byte, []int) {
-	return file_yfs_proto_rawDescGZIP(), []int{4}
+	return file_yfs_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *FileEntry) GetMetadata() *FileMetadata {
@@ -382,6 +632,69 @@ func (x *FileEntry) GetDataBlockCount() uint32 {
 	return 0
 }
 
+func (x *FileEntry) GetDirectBlockIds() []uint32 {
+	if x != nil {
+		return x.DirectBlockIds
+	}
+	return nil
+}
+
+func (x *FileEntry) GetIndirectBlockIds() []uint32 {
+	if x != nil {
+		return x.IndirectBlockIds
+	}
+	return nil
+}
+
+func (x *FileEntry) GetDirectBlockChecksums() []byte {
+	if x != nil {
+		return x.DirectBlockChecksums
+	}
+	return nil
+}
+
+func (x *FileEntry) GetCompression() uint32 {
+	if x != nil {
+		return x.Compression
+	}
+	return 0
+}
+
+func (x *FileEntry) GetCompressionChunkSize() uint32 {
+	if x != nil {
+		return x.CompressionChunkSize
+	}
+	return 0
+}
+
+func (x *FileEntry) GetChunkSizes() []uint32 {
+	if x != nil {
+		return x.ChunkSizes
+	}
+	return nil
+}
+
+func (x *FileEntry) GetStoredSize() int64 {
+	if x != nil {
+		return x.StoredSize
+	}
+	return 0
+}
+
+func (x *FileEntry) GetInlineData() []byte {
+	if x != nil {
+		return x.InlineData
+	}
+	return nil
+}
+
+func (x *FileEntry) GetInode() uint64 {
+	if x != nil {
+		return x.Inode
+	}
+	return 0
+}
+
 // DirectoryEntry represents a directory with files and subdirectories
 type DirectoryEntry struct {
 	state         protoimpl.MessageState     `protogen:"open.v1"`
@@ -394,7 +707,7 @@ type DirectoryEntry struct {
 
 func (x *DirectoryEntry) Reset() {
 	*x = DirectoryEntry{}
-	mi := &file_yfs_proto_msgTypes[5]
+	mi := &file_yfs_proto_msgTypes[7]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -406,7 +719,7 @@ func (x *DirectoryEntry) String() string {
 func (*DirectoryEntry) ProtoMessage() {}
 
 func (x *DirectoryEntry) ProtoReflect() protoreflect.Message {
-	mi := &file_yfs_proto_msgTypes[5]
+	mi := &file_yfs_proto_msgTypes[7]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -419,7 +732,7 @@ func (x *DirectoryEntry) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DirectoryEntry.ProtoReflect.Descriptor instead.
 func (*DirectoryEntry) Descriptor() ([]byte, []int) {
-	return file_yfs_proto_rawDescGZIP(), []int{5}
+	return file_yfs_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *DirectoryEntry) GetMetadata() *FileMetadata {
@@ -443,18 +756,198 @@ func (x *DirectoryEntry) GetDirectories() map[string]*DirectoryEntry {
 	return nil
 }
 
+// BlockWrite is a block overwrite recorded in the journal
+type BlockWrite struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	BlockId       uint32                 `protobuf:"varint,1,opt,name=block_id,json=blockId,proto3" json:"block_id,omitempty"`
+	Data          []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"` // Block header and payload, without padding
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlockWrite) Reset() {
+	*x = BlockWrite{}
+	mi := &file_yfs_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlockWrite) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockWrite) ProtoMessage() {}
+
+func (x *BlockWrite) ProtoReflect() protoreflect.Message {
+	mi := &file_yfs_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockWrite.ProtoReflect.Descriptor instead.
+func (*BlockWrite) Descriptor() ([]byte, []int) {
+	return file_yfs_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *BlockWrite) GetBlockId() uint32 {
+	if x != nil {
+		return x.BlockId
+	}
+	return 0
+}
+
+func (x *BlockWrite) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+// JournalRecord describes one committed operation. It is appended to the
+// journal before the operation is applied and replayed on load if the
+// operation did not finish.
+type JournalRecord struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Sequence          uint64                 `protobuf:"varint,1,opt,name=sequence,proto3" json:"sequence,omitempty"`                          // Position of the record in the journal
+	TotalBlocks       uint64                 `protobuf:"varint,2,opt,name=total_blocks,json=totalBlocks,proto3" json:"total_blocks,omitempty"` // Volume size after the operation
+	AllocatedBlockIds []uint32               `protobuf:"varint,3,rep,packed,name=allocated_block_ids,json=allocatedBlockIds,proto3" json:"allocated_block_ids,omitempty"`
+	FreedBlockIds     []uint32               `protobuf:"varint,4,rep,packed,name=freed_block_ids,json=freedBlockIds,proto3" json:"freed_block_ids,omitempty"`
+	Writes            []*BlockWrite          `protobuf:"bytes,5,rep,name=writes,proto3" json:"writes,omitempty"` // Overwrites of blocks that were in use
+	Header            []byte                 `protobuf:"bytes,6,opt,name=header,proto3" json:"header,omitempty"` // Serialized FileSystemHeader after the operation
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *JournalRecord) Reset() {
+	*x = JournalRecord{}
+	mi := &file_yfs_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *JournalRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*JournalRecord) ProtoMessage() {}
+
+func (x *JournalRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_yfs_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use JournalRecord.ProtoReflect.Descriptor instead.
+func (*JournalRecord) Descriptor() ([]byte, []int) {
+	return file_yfs_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *JournalRecord) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *JournalRecord) GetTotalBlocks() uint64 {
+	if x != nil {
+		return x.TotalBlocks
+	}
+	return 0
+}
+
+func (x *JournalRecord) GetAllocatedBlockIds() []uint32 {
+	if x != nil {
+		return x.AllocatedBlockIds
+	}
+	return nil
+}
+
+func (x *JournalRecord) GetFreedBlockIds() []uint32 {
+	if x != nil {
+		return x.FreedBlockIds
+	}
+	return nil
+}
+
+func (x *JournalRecord) GetWrites() []*BlockWrite {
+	if x != nil {
+		return x.Writes
+	}
+	return nil
+}
+
+func (x *JournalRecord) GetHeader() []byte {
+	if x != nil {
+		return x.Header
+	}
+	return nil
+}
+
 var File_yfs_proto protoreflect.FileDescriptor
 
 const file_yfs_proto_rawDesc = "" +
 	"\n" +
-	"\tyfs.proto\x12\x03yfs\"\xc2\x01\n" +
+	"\tyfs.proto\x12\x03yfs\"\x92\x06\n" +
 	"\x10FileSystemHeader\x12\x18\n" +
 	"\aversion\x18\x01 \x01(\rR\aversion\x12\x1d\n" +
 	"\n" +
 	"block_size\x18\x02 \x01(\rR\tblockSize\x12'\n" +
 	"\x04root\x18\x03 \x01(\v2\x13.yfs.DirectoryEntryR\x04root\x12!\n" +
 	"\ftotal_blocks\x18\x04 \x01(\x04R\vtotalBlocks\x12)\n" +
-	"\x10checksum_enabled\x18\x05 \x01(\rR\x0fchecksumEnabled\"\x96\x01\n" +
+	"\x10checksum_enabled\x18\x05 \x01(\rR\x0fchecksumEnabled\x12\x1e\n" +
+	"\n" +
+	"generation\x18\x06 \x01(\x04R\n" +
+	"generation\x12C\n" +
+	"\n" +
+	"block_refs\x18\a \x03(\v2$.yfs.FileSystemHeader.BlockRefsEntryR\tblockRefs\x12B\n" +
+	"\tsnapshots\x18\b \x03(\v2$.yfs.FileSystemHeader.SnapshotsEntryR\tsnapshots\x12#\n" +
+	"\rdata_checksum\x18\t \x01(\rR\fdataChecksum\x125\n" +
+	"\n" +
+	"encryption\x18\n" +
+	" \x01(\v2\x15.yfs.EncryptionParamsR\n" +
+	"encryption\x12\x14\n" +
+	"\x05dedup\x18\v \x01(\bR\x05dedup\x12I\n" +
+	"\fdedup_blocks\x18\f \x03(\v2&.yfs.FileSystemHeader.DedupBlocksEntryR\vdedupBlocks\x12\x1d\n" +
+	"\n" +
+	"next_inode\x18\r \x01(\x04R\tnextInode\x1a<\n" +
+	"\x0eBlockRefsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\rR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\rR\x05value:\x028\x01\x1aK\n" +
+	"\x0eSnapshotsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12#\n" +
+	"\x05value\x18\x02 \x01(\v2\r.yfs.SnapshotR\x05value:\x028\x01\x1a>\n" +
+	"\x10DedupBlocksEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x04R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\rR\x05value:\x028\x01\"\xed\x01\n" +
+	"\x10EncryptionParams\x12\x16\n" +
+	"\x06cipher\x18\x01 \x01(\rR\x06cipher\x12\x10\n" +
+	"\x03kdf\x18\x02 \x01(\rR\x03kdf\x12\x12\n" +
+	"\x04salt\x18\x03 \x01(\fR\x04salt\x12\x1e\n" +
+	"\n" +
+	"iterations\x18\x04 \x01(\rR\n" +
+	"iterations\x12\x1b\n" +
+	"\tkey_check\x18\x05 \x01(\fR\bkeyCheck\x12\x1a\n" +
+	"\bmetadata\x18\x06 \x01(\bR\bmetadata\x12\x1b\n" +
+	"\tdata_keys\x18\a \x03(\fR\bdataKeys\x12%\n" +
+	"\x0ereencrypt_next\x18\b \x01(\x04R\rreencryptNext\"h\n" +
+	"\bSnapshot\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1f\n" +
+	"\vcreate_time\x18\x02 \x01(\x03R\n" +
+	"createTime\x12'\n" +
+	"\x04root\x18\x03 \x01(\v2\x13.yfs.DirectoryEntryR\x04root\"\x96\x01\n" +
 	"\fFileMetadata\x12\x12\n" +
 	"\x04name\x18\x01 \x01(\tR\x04name\x12\x19\n" +
 	"\bmod_time\x18\x02 \x01(\x03R\amodTime\x12\x1f\n" +
@@ -465,20 +958,34 @@ const file_yfs_proto_rawDesc = "" +
 	"\x06Extent\x12$\n" +
 	"\x0estart_block_id\x18\x01 \x01(\rR\fstartBlockId\x12\x1f\n" +
 	"\vblock_count\x18\x02 \x01(\rR\n" +
-	"blockCount\"\xb2\x01\n" +
+	"blockCount\"\xd9\x01\n" +
 	"\n" +
 	"IndexBlock\x12\x1b\n" +
 	"\tblock_ids\x18\x01 \x03(\rR\bblockIds\x12%\n" +
 	"\aextents\x18\x02 \x03(\v2\v.yfs.ExtentR\aextents\x12-\n" +
 	"\x13next_index_block_id\x18\x03 \x01(\rR\x10nextIndexBlockId\x12\x1b\n" +
 	"\tdata_size\x18\x04 \x01(\rR\bdataSize\x12\x14\n" +
-	"\x05crc32\x18\x05 \x01(\rR\x05crc32\"\xd5\x01\n" +
+	"\x05crc32\x18\x05 \x01(\rR\x05crc32\x12%\n" +
+	"\x0edata_checksums\x18\x06 \x01(\fR\rdataChecksums\"\xb4\x04\n" +
 	"\tFileEntry\x12-\n" +
 	"\bmetadata\x18\x01 \x01(\v2\x11.yfs.FileMetadataR\bmetadata\x12/\n" +
 	"\x14first_index_block_id\x18\x02 \x01(\rR\x11firstIndexBlockId\x12\x12\n" +
 	"\x04size\x18\x03 \x01(\x03R\x04size\x12*\n" +
 	"\x11index_block_count\x18\x04 \x01(\rR\x0findexBlockCount\x12(\n" +
-	"\x10data_block_count\x18\x05 \x01(\rR\x0edataBlockCount\"\xdc\x02\n" +
+	"\x10data_block_count\x18\x05 \x01(\rR\x0edataBlockCount\x12(\n" +
+	"\x10direct_block_ids\x18\x06 \x03(\rR\x0edirectBlockIds\x12,\n" +
+	"\x12indirect_block_ids\x18\a \x03(\rR\x10indirectBlockIds\x124\n" +
+	"\x16direct_block_checksums\x18\b \x01(\fR\x14directBlockChecksums\x12 \n" +
+	"\vcompression\x18\t \x01(\rR\vcompression\x124\n" +
+	"\x16compression_chunk_size\x18\n" +
+	" \x01(\rR\x14compressionChunkSize\x12\x1f\n" +
+	"\vchunk_sizes\x18\v \x03(\rR\n" +
+	"chunkSizes\x12\x1f\n" +
+	"\vstored_size\x18\f \x01(\x03R\n" +
+	"storedSize\x12\x1f\n" +
+	"\vinline_data\x18\r \x01(\fR\n" +
+	"inlineData\x12\x14\n" +
+	"\x05inode\x18\x0e \x01(\x04R\x05inode\"\xdc\x02\n" +
 	"\x0eDirectoryEntry\x12-\n" +
 	"\bmetadata\x18\x01 \x01(\v2\x11.yfs.FileMetadataR\bmetadata\x124\n" +
 	"\x05files\x18\x02 \x03(\v2\x1e.yfs.DirectoryEntry.FilesEntryR\x05files\x12F\n" +
@@ -489,7 +996,18 @@ const file_yfs_proto_rawDesc = "" +
 	"\x05value\x18\x02 \x01(\v2\x0e.yfs.FileEntryR\x05value:\x028\x01\x1aS\n" +
 	"\x10DirectoriesEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12)\n" +
-	"\x05value\x18\x02 \x01(\v2\x13.yfs.DirectoryEntryR\x05value:\x028\x01B\aZ\x05./yfsb\x06proto3"
+	"\x05value\x18\x02 \x01(\v2\x13.yfs.DirectoryEntryR\x05value:\x028\x01\";\n" +
+	"\n" +
+	"BlockWrite\x12\x19\n" +
+	"\bblock_id\x18\x01 \x01(\rR\ablockId\x12\x12\n" +
+	"\x04data\x18\x02 \x01(\fR\x04data\"\xe7\x01\n" +
+	"\rJournalRecord\x12\x1a\n" +
+	"\bsequence\x18\x01 \x01(\x04R\bsequence\x12!\n" +
+	"\ftotal_blocks\x18\x02 \x01(\x04R\vtotalBlocks\x12.\n" +
+	"\x13allocated_block_ids\x18\x03 \x03(\rR\x11allocatedBlockIds\x12&\n" +
+	"\x0ffreed_block_ids\x18\x04 \x03(\rR\rfreedBlockIds\x12'\n" +
+	"\x06writes\x18\x05 \x03(\v2\x0f.yfs.BlockWriteR\x06writes\x12\x16\n" +
+	"\x06header\x18\x06 \x01(\fR\x06headerB\aZ\x05./yfsb\x06proto3"
 
 var (
 	file_yfs_proto_rawDescOnce sync.Once
@@ -503,31 +1021,45 @@ func file_yfs_proto_rawDescGZIP() []byte {
 	return file_yfs_proto_rawDescData
 }
 
-var file_yfs_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_yfs_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
 var file_yfs_proto_goTypes = []any{
 	(*FileSystemHeader)(nil), // 0: yfs.FileSystemHeader
-	(*FileMetadata)(nil),     // 1: yfs.FileMetadata
-	(*Extent)(nil),           // 2: yfs.Extent
-	(*IndexBlock)(nil),       // 3: yfs.IndexBlock
-	(*FileEntry)(nil),        // 4: yfs.FileEntry
-	(*DirectoryEntry)(nil),   // 5: yfs.DirectoryEntry
-	nil,                      // 6: yfs.DirectoryEntry.FilesEntry
-	nil,                      // 7: yfs.DirectoryEntry.DirectoriesEntry
+	(*EncryptionParams)(nil), // 1: yfs.EncryptionParams
+	(*Snapshot)(nil),         // 2: yfs.Snapshot
+	(*FileMetadata)(nil),     // 3: yfs.FileMetadata
+	(*Extent)(nil),           // 4: yfs.Extent
+	(*IndexBlock)(nil),       // 5: yfs.IndexBlock
+	(*FileEntry)(nil),        // 6: yfs.FileEntry
+	(*DirectoryEntry)(nil),   // 7: yfs.DirectoryEntry
+	(*BlockWrite)(nil),       // 8: yfs.BlockWrite
+	(*JournalRecord)(nil),    // 9: yfs.JournalRecord
+	nil,                      // 10: yfs.FileSystemHeader.BlockRefsEntry
+	nil,                      // 11: yfs.FileSystemHeader.SnapshotsEntry
+	nil,                      // 12: yfs.FileSystemHeader.DedupBlocksEntry
+	nil,                      // 13: yfs.DirectoryEntry.FilesEntry
+	nil,                      // 14: yfs.DirectoryEntry.DirectoriesEntry
 }
 var file_yfs_proto_depIdxs = []int32{
-	5, // 0: yfs.FileSystemHeader.root:type_name -> yfs.DirectoryEntry
-	2, // 1: yfs.IndexBlock.extents:type_name -> yfs.Extent
-	1, // 2: yfs.FileEntry.metadata:type_name -> yfs.FileMetadata
-	1, // 3: yfs.DirectoryEntry.metadata:type_name -> yfs.FileMetadata
-	6, // 4: yfs.DirectoryEntry.files:type_name -> yfs.DirectoryEntry.FilesEntry
-	7, // 5: yfs.DirectoryEntry.directories:type_name -> yfs.DirectoryEntry.DirectoriesEntry
-	4, // 6: yfs.DirectoryEntry.FilesEntry.value:type_name -> yfs.FileEntry
-	5, // 7: yfs.DirectoryEntry.DirectoriesEntry.value:type_name -> yfs.DirectoryEntry
-	8, // [8:8] is the sub-list for method output_type
-	8, // [8:8] is the sub-list for method input_type
-	8, // [8:8] is the sub-list for extension type_name
-	8, // [8:8] is the sub-list for extension extendee
-	0, // [0:8] is the sub-list for field type_name
+	7,  // 0: yfs.FileSystemHeader.root:type_name -> yfs.DirectoryEntry
+	10, // 1: yfs.FileSystemHeader.block_refs:type_name -> yfs.FileSystemHeader.BlockRefsEntry
+	11, // 2: yfs.FileSystemHeader.snapshots:type_name -> yfs.FileSystemHeader.SnapshotsEntry
+	1,  // 3: yfs.FileSystemHeader.encryption:type_name -> yfs.EncryptionParams
+	12, // 4: yfs.FileSystemHeader.dedup_blocks:type_name -> yfs.FileSystemHeader.DedupBlocksEntry
+	7,  // 5: yfs.Snapshot.root:type_name -> yfs.DirectoryEntry
+	4,  // 6: yfs.IndexBlock.extents:type_name -> yfs.Extent
+	3,  // 7: yfs.FileEntry.metadata:type_name -> yfs.FileMetadata
+	3,  // 8: yfs.DirectoryEntry.metadata:type_name -> yfs.FileMetadata
+	13, // 9: yfs.DirectoryEntry.files:type_name -> yfs.DirectoryEntry.FilesEntry
+	14, // 10: yfs.DirectoryEntry.directories:type_name -> yfs.DirectoryEntry.DirectoriesEntry
+	8,  // 11: yfs.JournalRecord.writes:type_name -> yfs.BlockWrite
+	2,  // 12: yfs.FileSystemHeader.SnapshotsEntry.value:type_name -> yfs.Snapshot
+	6,  // 13: yfs.DirectoryEntry.FilesEntry.value:type_name -> yfs.FileEntry
+	7,  // 14: yfs.DirectoryEntry.DirectoriesEntry.value:type_name -> yfs.DirectoryEntry
+	15, // [15:15] is the sub-list for method output_type
+	15, // [15:15] is the sub-list for method input_type
+	15, // [15:15] is the sub-list for extension type_name
+	15, // [15:15] is the sub-list for extension extendee
+	0,  // [0:15] is the sub-list for field type_name
 }
 
 func init() { file_yfs_proto_init() }
@@ -541,7 +1073,7 @@ func file_yfs_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_yfs_proto_rawDesc), len(file_yfs_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   8,
+			NumMessages:   15,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,439 @@
+package yfs
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestFS creates a file system in a temporary directory
+func newTestFS(t *testing.T, opts Options) (*YFS, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	return openTestFS(t, dir, opts), dir
+}
+
+// openTestFS opens the file system in dir. Tests close it themselves, so a
+// closed instance never saves over one opened after it.
+func openTestFS(t *testing.T, dir string, opts Options) *YFS {
+	t.Helper()
+
+	fs, err := NewWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", dir, err)
+	}
+	return fs
+}
+
+// reopenTestFS closes a file system and opens it again
+func reopenTestFS(t *testing.T, fs *YFS, dir string, opts Options) *YFS {
+	t.Helper()
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	return openTestFS(t, dir, opts)
+}
+
+// testData returns n bytes that neither compress nor deduplicate
+func testData(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// expectFile fails the test unless a file holds exactly want
+func expectFile(t *testing.T, fs *YFS, path string, want []byte) {
+	t.Helper()
+
+	got, err := fs.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s holds %d bytes that differ from the %d written", path, len(got), len(want))
+	}
+}
+
+// usedBlocks counts the blocks marked used in the bitmap
+func usedBlocks(fs *YFS) int {
+	fs.bitmap.mutex.RLock()
+	defer fs.bitmap.mutex.RUnlock()
+
+	used := 0
+	for pos := uint64(0); pos < fs.bitmap.totalBlocks; pos++ {
+		if !fs.isBlockFree(pos) {
+			used++
+		}
+	}
+	return used
+}
+
+func TestWriteAt(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	f, err := fs.Create("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testData(10000, 1)
+	if _, err := f.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	// An overwrite within the file rewrites its blocks in place
+	patch := testData(5000, 2)
+	if err := fs.WriteAt("/f", 2000, patch); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[2000:], patch)
+	expectFile(t, fs, "/f", want)
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("an in-place write changed the used blocks from %d to %d", used, got)
+	}
+
+	// Writing past the end extends the file and zero fills the gap
+	if err := fs.WriteAt("/f", 12000, []byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, make([]byte, 2000)...)
+	want = append(want, "tail"...)
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/f", want)
+
+	if err := fs.WriteAt("/missing", 0, []byte("x")); err == nil {
+		t.Fatal("writing into a missing file succeeded")
+	}
+	if err := fs.WriteAt("/f", -1, []byte("x")); err == nil {
+		t.Fatal("writing at a negative offset succeeded")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	empty := usedBlocks(fs)
+
+	want := testData(20000, 1)
+	if err := fs.AppendFile("/f", want); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	// Shrinking frees the trailing blocks
+	if err := fs.Truncate("/f", 5000); err != nil {
+		t.Fatal(err)
+	}
+	want = want[:5000]
+	expectFile(t, fs, "/f", want)
+	if got := usedBlocks(fs); got >= used {
+		t.Fatalf("shrinking kept %d of %d used blocks", got, used)
+	}
+
+	// Growing fills the new space with zeros, also where the tail block held data
+	if err := fs.Truncate("/f", 3000); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Truncate("/f", 15000); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want[:3000], make([]byte, 12000)...)
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/f", want)
+
+	if err := fs.Truncate("/f", 0); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, fs, "/f", []byte{})
+	if got := usedBlocks(fs); got != empty {
+		t.Fatalf("an empty file still holds %d blocks", got-empty)
+	}
+
+	if err := fs.Truncate("/f", -1); err == nil {
+		t.Fatal("truncating to a negative size succeeded")
+	}
+}
+
+func TestFallocate(t *testing.T) {
+	opts := Options{InlineSize: -1} // Keep "head" in a block of its own
+	fs, dir := newTestFS(t, opts)
+
+	if err := fs.AppendFile("/f", []byte("head")); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	if err := fs.Fallocate("/f", 20000); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, fs, "/f", []byte("head"))
+	reserved := usedBlocks(fs)
+	if reserved <= used {
+		t.Fatal("Fallocate reserved no blocks")
+	}
+
+	info, err := fs.GetFileInfo("/f")
+	if err != nil || info.Size != 4 {
+		t.Fatalf("Fallocate changed the size to %v, %v", info, err)
+	}
+
+	// Writes within the reserved space use the reserved blocks
+	want := append([]byte("head"), testData(19996, 1)...)
+	if err := fs.WriteAt("/f", 4, want[4:]); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != reserved {
+		t.Fatalf("writing into reserved space changed the used blocks from %d to %d", reserved, got)
+	}
+
+	fs = reopenTestFS(t, fs, dir, opts)
+	expectFile(t, fs, "/f", want)
+
+	// Shrinking below the reservation frees the reserved blocks too
+	if err := fs.Fallocate("/f", 40000); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Truncate("/f", 4); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("truncating kept %d reserved blocks", got-used)
+	}
+}
+
+func TestBuildExtents(t *testing.T) {
+	extents := buildExtents([]uint32{5, 6, 7, 9, 3, 4, 10})
+
+	want := [][2]uint32{{5, 3}, {9, 1}, {3, 2}, {10, 1}}
+	if len(extents) != len(want) {
+		t.Fatalf("got %d extents, want %d", len(extents), len(want))
+	}
+	for i, extent := range extents {
+		if extent.StartBlockId != want[i][0] || extent.BlockCount != want[i][1] {
+			t.Fatalf("extent %d is %d+%d, want %d+%d", i, extent.StartBlockId, extent.BlockCount, want[i][0], want[i][1])
+		}
+	}
+}
+
+func TestIndexBlockEncoding(t *testing.T) {
+	fs, _ := newTestFS(t, Options{})
+
+	contiguous := fs.newIndexBlock([]uint32{10, 11, 12, 13, 14, 15, 16, 17}, nil)
+	if len(contiguous.Extents) != 1 || len(contiguous.BlockIds) != 0 {
+		t.Fatalf("a contiguous run was stored as %d extents and %d block IDs", len(contiguous.Extents), len(contiguous.BlockIds))
+	}
+
+	scattered := fs.newIndexBlock([]uint32{10, 20, 30, 40, 50, 60}, nil)
+	if len(scattered.Extents) != 0 || len(scattered.BlockIds) != 6 {
+		t.Fatalf("scattered blocks were stored as %d extents and %d block IDs", len(scattered.Extents), len(scattered.BlockIds))
+	}
+}
+
+func TestFragmentedFiles(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	// Interleaved appends leave both files in alternating, fragmented runs
+	a, b := testData(30000, 1), testData(30000, 2)
+	for off := 0; off < len(a); off += 6000 {
+		if err := fs.AppendFile("/a", a[off:off+6000]); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.AppendFile("/b", b[off:off+6000]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/a", a)
+	expectFile(t, fs, "/b", b)
+
+	f, err := fs.Open("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 10000)
+	if n, err := f.ReadAt(buf, 11000); err != nil || !bytes.Equal(buf[:n], b[11000:21000]) {
+		t.Fatalf("ReadAt across runs = %d, %v", n, err)
+	}
+}
+
+// fileEntry returns the entry of a file in the live tree
+func fileEntry(t *testing.T, fs *YFS, path string) *FileEntry {
+	t.Helper()
+
+	_, file, _, err := fs.findEntry(path)
+	if err != nil || file == nil {
+		t.Fatalf("file not found: %s: %v", path, err)
+	}
+	return file
+}
+
+func TestGrowth(t *testing.T) {
+	opts := Options{InitialBlocks: 64, GrowthBlocks: 32, MaxBlocks: 160}
+	fs, dir := newTestFS(t, opts)
+
+	want := testData(100*fs.payloadSize(), 1)
+	if err := fs.AppendFile("/f", want); err != nil {
+		t.Fatal(err)
+	}
+
+	total := fs.header.TotalBlocks
+	if total <= 64 || total > 160 || fs.bitmap.totalBlocks != total {
+		t.Fatalf("the volume grew to %d blocks with a %d-block bitmap", total, fs.bitmap.totalBlocks)
+	}
+	info, err := os.Stat(filepath.Join(dir, "blocks.glob"))
+	if err != nil || info.Size() < fs.calculateBlockOffset(uint32(total)) {
+		t.Fatalf("blocks.glob was not grown to %d blocks: %v", total, err)
+	}
+
+	fs = reopenTestFS(t, fs, dir, opts)
+	expectFile(t, fs, "/f", want)
+
+	// Growth stops at MaxBlocks
+	if err := fs.AppendFile("/g", testData(80*fs.payloadSize(), 2)); err == nil {
+		t.Fatal("a write past MaxBlocks succeeded")
+	}
+	if fs.header.TotalBlocks > 160 {
+		t.Fatalf("the volume grew to %d blocks past MaxBlocks", fs.header.TotalBlocks)
+	}
+	expectFile(t, fs, "/f", want)
+	if err := fs.AppendFile("/g", testData(40*fs.payloadSize(), 2)); err != nil {
+		t.Fatalf("a write up to MaxBlocks failed: %v", err)
+	}
+	if fs.header.TotalBlocks != 160 {
+		t.Fatalf("the volume has %d blocks, want 160", fs.header.TotalBlocks)
+	}
+}
+
+func TestDeleteDirectory(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+
+	if err := fs.CreateDirectory("/a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/a/f", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.DeleteDirectory("/a"); err == nil {
+		t.Fatal("a directory that is not empty was deleted")
+	}
+	if err := fs.DeleteDirectory("/a/f"); err == nil {
+		t.Fatal("a file was deleted as a directory")
+	}
+	if err := fs.DeleteDirectory("/"); err == nil {
+		t.Fatal("the root directory was deleted")
+	}
+
+	if err := fs.DeleteDirectory("/a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteDirectory("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	if _, err := fs.GetFileInfo("/a/b"); err == nil {
+		t.Fatal("the deleted directory is still there")
+	}
+	expectFile(t, fs, "/a/f", []byte("data"))
+}
+
+func TestCopyFileReflink(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	payload := fs.payloadSize()
+	empty := usedBlocks(fs)
+
+	a := testData(20*payload, 1)
+	if err := fs.WriteFile("/a", a); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	// The copy shares every block
+	if err := fs.CopyFile("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != used {
+		t.Fatalf("a reflink copy changed the used blocks from %d to %d", used, got)
+	}
+
+	// Writing to the copy unshares only the blocks written, and the index
+	// block on the way to them
+	b := append([]byte(nil), a...)
+	patch := testData(100, 2)
+	if err := fs.WriteAt("/b", int64(15*payload), patch); err != nil {
+		t.Fatal(err)
+	}
+	copy(b[15*payload:], patch)
+	if got := usedBlocks(fs); got != used+2 {
+		t.Fatalf("unsharing one block changed the used blocks from %d to %d", used, got)
+	}
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/a", a)
+	expectFile(t, fs, "/b", b)
+
+	// Each file keeps the blocks it still shares after the other is deleted
+	if err := fs.DeleteFile("/a"); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, fs, "/b", b)
+	if err := fs.DeleteFile("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != empty {
+		t.Fatalf("%d blocks are still used after deleting both files", got-empty)
+	}
+}
+
+func TestCopyFilePhysical(t *testing.T) {
+	fs, dir := newTestFS(t, Options{})
+	payload := fs.payloadSize()
+	empty := usedBlocks(fs)
+
+	a := testData(20*payload, 1)
+	if err := fs.WriteFile("/a", a); err != nil {
+		t.Fatal(err)
+	}
+	fileBlocks := usedBlocks(fs) - empty
+	if err := fs.WriteFile("/c", testData(payload, 2)); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(fs)
+
+	// A physical copy over an existing file duplicates every block and frees the old one
+	if err := fs.CopyFileWithOptions("/a", "/c", CopyOptions{Physical: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBlocks(fs); got != used-1+fileBlocks {
+		t.Fatalf("a physical copy changed the used blocks from %d to %d", used, got)
+	}
+	if len(fs.header.BlockRefs) != 0 {
+		t.Fatal("a physical copy shares blocks")
+	}
+
+	c := append([]byte(nil), a...)
+	if err := fs.WriteAt("/c", 0, []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	copy(c, "changed")
+
+	fs = reopenTestFS(t, fs, dir, Options{})
+	expectFile(t, fs, "/a", a)
+	expectFile(t, fs, "/c", c)
+
+	if err := fs.CopyFile("/missing", "/d"); err == nil {
+		t.Fatal("copying a missing file succeeded")
+	}
+}